@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/derWhity/micasa/internal/backup"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// backupCommands are the sub-commands of "micasa backup"
+var backupCommands map[string]command
+
+func init() {
+	backupCommands = map[string]command{
+		"create": {
+			usage:       "backup create [-json]",
+			description: "Create a backup of the database and the configuration file",
+			run:         runBackupCreate,
+		},
+		"list": {
+			usage:       "backup list [-json]",
+			description: "List the existing backups - the newest first",
+			run:         runBackupList,
+		},
+	}
+}
+
+// printBackups writes the given backups as table or JSON document
+func printBackups(list []*backup.Info, asJSON bool) error {
+	if asJSON {
+		return writeJSON(os.Stdout, list)
+	}
+	rows := make([][]string, 0, len(list))
+	for _, b := range list {
+		rows = append(rows, []string{
+			b.Name, string(b.Kind), formatTime(&b.CreatedAt), strconv.FormatInt(b.Size/1024, 10) + " KiB",
+		})
+	}
+	return writeTable(os.Stdout, []string{"NAME", "KIND", "CREATED", "SIZE"}, rows)
+}
+
+func runBackupCreate(a *app, args []string) error {
+	fs := newFlagSet(backupCommands["create"])
+	asJSON := fs.Bool("json", false, "Print the backup as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The create command does not take any arguments")
+	}
+	return a.withDatabase(func(db *sqlx.DB, conf models.Configuration) error {
+		info, err := backup.New(conf.DataDir, db, a.configFile, a.logger).Create(backup.KindManual)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return writeJSON(os.Stdout, info)
+		}
+		fmt.Fprintf(os.Stderr, "Created backup '%s'\n", info.Path)
+		return nil
+	})
+}
+
+func runBackupList(a *app, args []string) error {
+	fs := newFlagSet(backupCommands["list"])
+	asJSON := fs.Bool("json", false, "Print the backups as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The list command does not take any arguments")
+	}
+	conf, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	list, err := backup.List(conf.DataDir)
+	if err != nil {
+		return err
+	}
+	return printBackups(list, *asJSON)
+}
+
+func runRestore(a *app, args []string) error {
+	fs := newFlagSet(commands["restore"])
+	skipConfig := fs.Bool("skip-config", false, "Only restore the database - keep the current configuration file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("Expecting the backup file to restore")
+	}
+	conf, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	file := fs.Arg(0)
+	if _, err := os.Stat(file); os.IsNotExist(err) && !filepath.IsAbs(file) {
+		// Allow the names shown by "micasa backup list"
+		file = filepath.Join(backup.Dir(conf.DataDir), file)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return errors.Errorf("Backup '%s' does not exist", fs.Arg(0))
+	}
+	lock, err := a.lockDataDir(conf)
+	if err != nil {
+		return errors.Wrap(err, "Stop the server before restoring a backup")
+	}
+	defer lock.Unlock()
+
+	// Keep the current state - in case the wrong backup has been chosen
+	if _, err := os.Stat(dbPath(conf)); err == nil {
+		err := a.withDatabase(func(db *sqlx.DB, conf models.Configuration) error {
+			backups := backup.New(conf.DataDir, db, a.configFile, a.logger)
+			info, err := backups.Create(backup.KindRestore)
+			if err != nil {
+				return errors.Wrap(err, "Failed to back up the current state")
+			}
+			fmt.Fprintf(os.Stderr, "Saved the current state as '%s'\n", info.Name)
+			if err := backups.Prune(backup.KindRestore, conf.Backup.Keep); err != nil {
+				a.logger.Error("Failed to remove old backups", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	configFile := a.configFile
+	if *skipConfig {
+		configFile = ""
+	}
+	configRestored, err := backup.Restore(file, dbPath(conf), configFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restored the database from '%s'\n", file)
+	if configRestored {
+		fmt.Fprintf(os.Stderr, "Restored the configuration file '%s'\n", configFile)
+	}
+	return nil
+}
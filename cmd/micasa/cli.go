@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// command is a sub-command of the micasa binary
+type command struct {
+	// The command line syntax of the command - without the leading "micasa"
+	usage string
+	// A short description of what the command does
+	description string
+	// run executes the command with the arguments following the command name
+	run func(a *app, args []string) error
+}
+
+// usageError is returned by commands that have been called with invalid arguments
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// dispatch runs the command named by the first argument
+func dispatch(a *app, prefix string, cmds map[string]command, args []string) error {
+	if len(args) == 0 {
+		printCommands(os.Stderr, cmds)
+		return usageError("No command given")
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		printCommands(os.Stderr, cmds)
+		return usageError(fmt.Sprintf("Unknown command '%s'", strings.TrimSpace(prefix+" "+args[0])))
+	}
+	return cmd.run(a, args[1:])
+}
+
+// printCommands writes an overview of the given commands
+func printCommands(w io.Writer, cmds map[string]command) {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		cmd := cmds[name]
+		fmt.Fprintf(w, "  micasa %s\n      %s\n", cmd.usage, cmd.description)
+	}
+}
+
+// newFlagSet creates the flag set for parsing the options of a command - the flags have to precede the positional
+// arguments
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.usage, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: micasa %s\n\n%s\n", cmd.usage, cmd.description)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(os.Stderr, "\nOptions:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseExpiry parses a validity period like "90d" or "12h" and returns the resulting expiry time - an empty period
+// means that there is no expiry time
+func parseExpiry(period string, now time.Time) (*time.Time, error) {
+	if period == "" {
+		return nil, nil
+	}
+	var d time.Duration
+	if strings.HasSuffix(period, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(period, "d"))
+		if err != nil {
+			return nil, usageError(fmt.Sprintf("Invalid period '%s'", period))
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(period); err != nil {
+			return nil, usageError(fmt.Sprintf("Invalid period '%s'", period))
+		}
+	}
+	if d <= 0 {
+		return nil, usageError("The period must be positive")
+	}
+	expires := now.Add(d)
+	return &expires, nil
+}
+
+// stdin is used for reading passwords that are piped into the binary
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword asks for a password without echoing it. If stdin is no terminal, the password is read from the next
+// line of the input instead - this allows scripting the commands.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", errors.Wrap(err, "Failed to read the password")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read the password")
+	}
+	return string(pass), nil
+}
+
+// readNewPassword asks for a new password - on a terminal, the password has to be entered twice
+func readNewPassword() (string, error) {
+	pass, err := readPassword("New password: ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", errors.New("The password must not be empty")
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		repeated, err := readPassword("Repeat password: ")
+		if err != nil {
+			return "", err
+		}
+		if repeated != pass {
+			return "", errors.New("The passwords do not match")
+		}
+	}
+	return pass, nil
+}
+
+// formatTime formats an optional time for table output
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// writeJSON writes the given data as indented JSON document
+func writeJSON(w io.Writer, data interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(data)
+}
+
+// writeTable writes the given rows as table with a header line
+func writeTable(w io.Writer, headers []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/derWhity/micasa"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/pkg/errors"
+)
+
+// configCommands are the sub-commands of "micasa config"
+var configCommands map[string]command
+
+func init() {
+	configCommands = map[string]command{
+		"diff": {
+			usage:       "config diff [-json] <version> [version]",
+			description: "Show the settings which differ between two versions of the configuration file",
+			run:         runConfigDiff,
+		},
+		"history": {
+			usage:       "config history [-json]",
+			description: "List the current and the previous versions of the configuration file - the newest first",
+			run:         runConfigHistory,
+		},
+		"print": {
+			usage:       "config print [-effective] [-json]",
+			description: "Print the configuration file merged with the defaults - or the effective configuration",
+			run:         runConfigPrint,
+		},
+		"rollback": {
+			usage:       "config rollback <version>",
+			description: "Replace the configuration file by a previous version - the running server applies it",
+			run:         runConfigRollback,
+		},
+		"validate": {
+			usage:       "config validate [-json] [file]",
+			description: "Check the configuration file - or the given file - and report every problem found",
+			run:         runConfigValidate,
+		},
+	}
+}
+
+// settingFlag is the command line flag overriding a setting of the configuration
+type settingFlag struct {
+	setting   models.ConfigSetting
+	overrides *[]models.ConfigOverride
+}
+
+// String returns the default value of the flag - the defaults are shown in the description of the configuration
+func (f *settingFlag) String() string {
+	return ""
+}
+
+// Set records the override given by the flag
+func (f *settingFlag) Set(value string) error {
+	*f.overrides = append(*f.overrides, models.ConfigOverride{
+		Path:   f.setting.Path,
+		Value:  value,
+		Source: models.SourceFlag,
+		Name:   "-" + f.setting.Path,
+	})
+	return nil
+}
+
+// IsBoolFlag allows switching on boolean settings without giving a value
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.setting.IsBool()
+}
+
+// registerSettingFlags adds a command line flag for every setting of the configuration - the flags given are added to
+// the overrides
+func registerSettingFlags(fs *flag.FlagSet, overrides *[]models.ConfigOverride) {
+	for _, setting := range models.ConfigSettings() {
+		fs.Var(
+			&settingFlag{setting: setting, overrides: overrides},
+			setting.Path,
+			fmt.Sprintf("Override the setting '%s' of the configuration file (or set %s)", setting.Path, setting.Env),
+		)
+	}
+}
+
+// envOverrides returns the overrides given by MICASA_* environment variables. Unknown variables are reported, as they
+// are most likely typos.
+func envOverrides(environ []string, logger log.Logger) []models.ConfigOverride {
+	byName := map[string]models.ConfigSetting{}
+	for _, setting := range models.ConfigSettings() {
+		byName[setting.Env] = setting
+	}
+	res := []models.ConfigOverride{}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], models.EnvPrefix) {
+			continue
+		}
+		setting, ok := byName[parts[0]]
+		if !ok {
+			logger.Warn(fmt.Sprintf("Ignoring unknown environment variable '%s'", parts[0]))
+			continue
+		}
+		res = append(res, models.ConfigOverride{
+			Path:   setting.Path,
+			Value:  parts[1],
+			Source: models.SourceEnv,
+			Name:   parts[0],
+		})
+	}
+	return res
+}
+
+// printProblems writes one line for each problem of a configuration
+func printProblems(w io.Writer, problems models.ValidationErrors) {
+	for _, p := range problems {
+		fmt.Fprintf(w, "  %v\n", p)
+	}
+}
+
+func runConfigValidate(a *app, args []string) error {
+	fs := newFlagSet(configCommands["validate"])
+	asJSON := fs.Bool("json", false, "Print the problems as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return usageError("Expecting at most one configuration file")
+	}
+	file := a.configFile
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	cs := micasa.NewConfigService(file, a.logger)
+	cs.SetOverrides(a.overrides)
+	err := cs.Load()
+	problems, ok := errors.Cause(err).(models.ValidationErrors)
+	if err != nil && !ok {
+		return err
+	}
+	if *asJSON {
+		if problems == nil {
+			problems = models.ValidationErrors{}
+		}
+		if err := writeJSON(os.Stdout, problems); err != nil {
+			return err
+		}
+	} else if len(problems) > 0 {
+		printProblems(os.Stdout, problems)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("The configuration file '%s' has %d problem(s)", file, len(problems))
+	}
+	if !*asJSON {
+		fmt.Fprintf(os.Stderr, "The configuration file '%s' is valid\n", file)
+	}
+	return nil
+}
+
+// effectiveSetting is a setting of the effective configuration as printed by "micasa config print -effective"
+type effectiveSetting struct {
+	Path   string              `json:"path"`
+	Value  string              `json:"value"`
+	Source models.ConfigSource `json:"source"`
+	Env    string              `json:"env"`
+}
+
+func runConfigPrint(a *app, args []string) error {
+	fs := newFlagSet(configCommands["print"])
+	effective := fs.Bool(
+		"effective", false,
+		"Print every setting of the configuration in use - including the overrides - and where its value comes from",
+	)
+	asJSON := fs.Bool("json", false, "Print the effective configuration as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The print command does not take any arguments")
+	}
+	if !*effective {
+		// Only the configuration file - as it would be written back
+		cs := micasa.NewConfigService(a.configFile, a.logger)
+		if err := cs.Load(); err != nil {
+			return err
+		}
+		return writeJSON(os.Stdout, cs.GetConfig())
+	}
+
+	conf, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	sources := a.cs.GetSources()
+	list := []effectiveSetting{}
+	for _, setting := range models.ConfigSettings() {
+		value := setting.Get(&conf)
+		if setting.Secret && value != "" {
+			value = models.SecretMask
+		}
+		list = append(list, effectiveSetting{
+			Path:   setting.Path,
+			Value:  value,
+			Source: sources[setting.Path],
+			Env:    setting.Env,
+		})
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, list)
+	}
+	rows := make([][]string, 0, len(list))
+	for _, s := range list {
+		rows = append(rows, []string{s.Path, s.Value, string(s.Source)})
+	}
+	return writeTable(os.Stdout, []string{"SETTING", "VALUE", "SOURCE"}, rows)
+}
+
+func runConfigHistory(a *app, args []string) error {
+	fs := newFlagSet(configCommands["history"])
+	asJSON := fs.Bool("json", false, "Print the versions as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The history command does not take any arguments")
+	}
+	if _, err := a.loadConfig(); err != nil {
+		return err
+	}
+	versions, err := a.cs.Versions()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, versions)
+	}
+	rows := make([][]string, 0, len(versions))
+	for _, v := range versions {
+		modifiedAt := v.ModifiedAt
+		rows = append(rows, []string{v.ID, formatTime(&modifiedAt), strconv.FormatInt(v.Size, 10) + " B"})
+	}
+	return writeTable(os.Stdout, []string{"VERSION", "MODIFIED", "SIZE"}, rows)
+}
+
+// printChanges writes the settings changed between two versions as table or JSON document
+func printChanges(changes []models.ConfigChange, asJSON bool) error {
+	if asJSON {
+		return writeJSON(os.Stdout, changes)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(os.Stderr, "The versions do not differ")
+		return nil
+	}
+	rows := make([][]string, 0, len(changes))
+	for _, c := range changes {
+		rows = append(rows, []string{c.Path, c.Old, c.New})
+	}
+	return writeTable(os.Stdout, []string{"SETTING", "OLD", "NEW"}, rows)
+}
+
+func runConfigDiff(a *app, args []string) error {
+	fs := newFlagSet(configCommands["diff"])
+	asJSON := fs.Bool("json", false, "Print the changed settings as JSON document")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return usageError("Expecting one or two versions to compare")
+	}
+	from, to := fs.Arg(0), micasa.CurrentVersion
+	if fs.NArg() == 2 {
+		to = fs.Arg(1)
+	}
+	if _, err := a.loadConfig(); err != nil {
+		return err
+	}
+	changes, err := a.cs.Diff(from, to)
+	if err != nil {
+		return err
+	}
+	return printChanges(changes, *asJSON)
+}
+
+func runConfigRollback(a *app, args []string) error {
+	fs := newFlagSet(configCommands["rollback"])
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) == micasa.CurrentVersion {
+		return usageError("Expecting the previous version to roll back to")
+	}
+	if _, err := a.loadConfig(); err != nil {
+		return err
+	}
+	changes, err := a.cs.Diff(micasa.CurrentVersion, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := a.cs.Rollback(fs.Arg(0)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "The configuration file has been rolled back to version '%s'\n", fs.Arg(0))
+	return printChanges(changes, false)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// logging directs the log output of the server according to the logging settings of the configuration
+type logging struct {
+	output *log.Output
+	// Keeps the recent log entries for the API
+	buffer *log.Buffer
+	stdout io.Writer
+	// Relative log files are located inside this directory - it is only changed by restarting the server
+	dataDir string
+	// Guards file
+	mu sync.Mutex
+	// The log file currently written to - nil if the log is written to stdout only
+	file *log.RotatingFile
+}
+
+// newLogging creates the log output of the server - writing everything but debug messages to stdout until the
+// logging settings are applied
+func newLogging(stdout io.Writer) *logging {
+	l := &logging{buffer: log.NewBuffer(log.DefaultBufferSize), stdout: stdout}
+	l.output = log.NewOutput(l.withBuffer(kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(stdout))), log.LvlInfo)
+	return l
+}
+
+// withBuffer returns a GoKit logger adding the log entries to the buffer before passing them on to the given logger
+func (l *logging) withBuffer(logger kitlog.Logger) kitlog.Logger {
+	return kitlog.LoggerFunc(func(keyvals ...interface{}) error {
+		l.buffer.Log(keyvals...)
+		return logger.Log(keyvals...)
+	})
+}
+
+// logger returns a logger writing to the log output - it follows changes of the logging settings
+func (l *logging) logger() log.Logger {
+	return withContext(log.New(l.output, log.LvlDebug))
+}
+
+// start applies the logging settings for the first time - relative log files are located inside the given data
+// directory
+func (l *logging) start(cfg models.LogConfig, dataDir string) error {
+	l.dataDir = dataDir
+	return l.apply(cfg)
+}
+
+// apply switches the log output to the given settings - levels of components changed at runtime are replaced by the
+// configured ones
+func (l *logging) apply(cfg models.LogConfig) error {
+	lvl, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	components := map[string]int{}
+	for component, name := range cfg.Components.Levels() {
+		if components[component], err = log.ParseLevel(name); err != nil {
+			return err
+		}
+	}
+	var file *log.RotatingFile
+	var w io.Writer = l.stdout
+	if cfg.Output == models.LogOutputFile || cfg.Output == models.LogOutputBoth {
+		name := cfg.File
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(l.dataDir, name)
+		}
+		file, err = log.NewRotatingFile(name, log.RotateOptions{
+			MaxSize:  int64(cfg.MaxSize) * 1024 * 1024,
+			MaxAge:   time.Duration(cfg.MaxAge) * time.Hour,
+			Keep:     cfg.Keep,
+			Compress: cfg.Compress,
+		})
+		if err != nil {
+			return err
+		}
+		w = file
+		if cfg.Output == models.LogOutputBoth {
+			w = io.MultiWriter(l.stdout, file)
+		}
+	}
+	kitLogger, err := log.NewFormatLogger(kitlog.NewSyncWriter(w), cfg.Format)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}
+	l.buffer.SetSize(cfg.Buffer)
+	l.output.SetLogger(l.withBuffer(kitLogger))
+	l.output.SetLevel(lvl)
+	l.output.SetComponentLevels(components)
+	l.replaceFile(file)
+	return nil
+}
+
+// replaceFile remembers the log file written to and closes the previous one
+func (l *logging) replaceFile(file *log.RotatingFile) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+}
+
+// close writes the log to stdout only and closes the log file
+func (l *logging) close() error {
+	l.output.SetLogger(l.withBuffer(kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(l.stdout))))
+	l.replaceFile(nil)
+	return nil
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -12,18 +13,165 @@ import (
 	"github.com/derWhity/micasa/internal/fsutils"
 	"github.com/derWhity/micasa/internal/log"
 	"github.com/derWhity/micasa/internal/migrate"
+	"github.com/derWhity/micasa/internal/models"
 	kitlog "github.com/go-kit/kit/log"
 	"github.com/jmoiron/sqlx"
 	"github.com/kardianos/osext"
 	_ "github.com/mattn/go-sqlite3" // Just needed for the sqlite driver
+	"github.com/pkg/errors"
 )
 
 const (
 	appName    = "MiCasa"
 	appVersion = "0.1.0"
 	dbFile     = "micasa.db"
+	// The file inside the data directory which is locked while the server is running
+	lockFile = "micasa.lock"
 )
 
+// commands are the sub-commands of the micasa binary - running it without a command starts the server
+var commands map[string]command
+
+func init() {
+	// The commands are registered here, as they refer to the map for printing their usage
+	commands = map[string]command{
+		"serve": {
+			usage:       "serve",
+			description: "Run the MiCasa server (default)",
+			run:         runServe,
+		},
+		"user": {
+			usage:       "user <command>",
+			description: "Manage the users who are allowed to log in",
+			run: func(a *app, args []string) error {
+				return dispatch(a, "user", userCommands, args)
+			},
+		},
+		"config": {
+			usage:       "config <command>",
+			description: "Check the configuration file and show the configuration in use",
+			run: func(a *app, args []string) error {
+				return dispatch(a, "config", configCommands, args)
+			},
+		},
+		"migrate": {
+			usage:       "migrate <command>",
+			description: "Show the state of the database schema and migrate it up or down",
+			run: func(a *app, args []string) error {
+				return dispatch(a, "migrate", migrateCommands, args)
+			},
+		},
+		"backup": {
+			usage:       "backup <command>",
+			description: "Create and list backups of the database and the configuration file",
+			run: func(a *app, args []string) error {
+				return dispatch(a, "backup", backupCommands, args)
+			},
+		},
+		"restore": {
+			usage:       "restore [-skip-config] <file>",
+			description: "Restore the database and the configuration file from a backup - stop the server before",
+			run:         runRestore,
+		},
+		"token": {
+			usage:       "token <command>",
+			description: "Manage the personal API tokens of users",
+			run: func(a *app, args []string) error {
+				return dispatch(a, "token", tokenCommands, args)
+			},
+		},
+	}
+}
+
+// app holds the settings and resources shared by all commands
+type app struct {
+	configFile string
+	// Whether the configuration file has been given explicitly - it has to exist then
+	configFileSet bool
+	// The settings given by environment variables and command line flags - in the order of their precedence
+	overrides []models.ConfigOverride
+	logger    log.Logger
+	cs        micasa.ConfigService
+}
+
+// newLogger creates a logger writing to the given destination
+func newLogger(w io.Writer, minLevel int) log.Logger {
+	return withContext(log.New(kitlog.NewLogfmtLogger(w), minLevel))
+}
+
+// withContext adds the timestamp and the application version to all entries of the logger
+func withContext(logger log.Logger) log.Logger {
+	return logger.With(
+		log.FldTimestamp, kitlog.DefaultTimestampUTC,
+		log.FldVersion, appVersion,
+	)
+}
+
+// loadConfig loads the main configuration file. The defaults are only used if the default configuration file does not
+// exist - an invalid configuration file is an error.
+func (a *app) loadConfig() (models.Configuration, error) {
+	a.cs = micasa.NewConfigService(a.configFile, a.logger)
+	a.cs.SetOverrides(a.overrides)
+	if err := a.cs.Load(); err != nil {
+		if !os.IsNotExist(errors.Cause(err)) || a.configFileSet {
+			return models.Configuration{}, err
+		}
+		a.logger.Warn("Configuration file does not exist - using the defaults", log.FldFile, a.configFile)
+		if err := a.cs.LoadDefaults(); err != nil {
+			return models.Configuration{}, err
+		}
+	}
+	return a.cs.GetConfig(), nil
+}
+
+// dbPath returns the path of the database file inside the configured data directory
+func dbPath(conf models.Configuration) string {
+	return path.Join(conf.DataDir, dbFile)
+}
+
+// lockDataDir makes sure that no other process uses the data directory - the server holds the lock while it is
+// running, so the database is not replaced underneath it
+func (a *app) lockDataDir(conf models.Configuration) (*fsutils.FileLock, error) {
+	if err := fsutils.CheckAndCreateDir(conf.DataDir, a.logger); err != nil {
+		return nil, err
+	}
+	lock, err := fsutils.LockFile(path.Join(conf.DataDir, lockFile))
+	if err == fsutils.ErrLocked {
+		return nil, errors.Errorf("The data directory '%s' is in use by a running MiCasa server", conf.DataDir)
+	}
+	return lock, err
+}
+
+// connectDatabase opens the database inside the configured data directory without touching its schema
+func (a *app) connectDatabase(conf models.Configuration) (*sqlx.DB, error) {
+	if err := fsutils.CheckAndCreateDir(conf.DataDir, a.logger); err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Open("sqlite3", dbPath(conf))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open database connection")
+	}
+	return db, nil
+}
+
+// openDatabase opens the database inside the configured data directory and performs all pending migrations
+func (a *app) openDatabase(conf models.Configuration) (*sqlx.DB, error) {
+	db, err := a.connectDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.backupBeforeMigration(db, conf, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	a.logger.Info("Performing database migrations...")
+	if err = migrate.ExecuteMigrationsOnDb(db, a.logger.Named(log.ComponentMigrate)); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Database migration has failed")
+	}
+	return db, nil
+}
+
 func main() {
 	execDir, err := osext.ExecutableFolder()
 	if err != nil {
@@ -35,42 +183,37 @@ func main() {
 		filepath.Join(execDir, "config.json"),
 		"The configuration file to load the application's configruation from",
 	)
-
-	// Initialize the logger
-	var logger log.Logger
-	{
-		logger = log.New(kitlog.NewLogfmtLogger(os.Stdout), log.LvlDebug)
-		logger = logger.With(
-			log.FldTimestamp, kitlog.DefaultTimestampUTC,
-			log.FldVersion, appVersion,
-		)
+	var flagOverrides []models.ConfigOverride
+	registerSettingFlags(flag.CommandLine, &flagOverrides)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: micasa [-config FILE] [-<setting> VALUE]... <command>\n\n")
+		printCommands(os.Stderr, commands)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
 	}
-	logger.Info(fmt.Sprintf("%s version %s is starting up...", appName, appVersion))
+	flag.Parse()
 
-	// Load the main configuration file
-	cs := micasa.NewConfigService(*configFile, logger)
-	if err := cs.Load(); err != nil {
-		logger.Error("Cannot load config. Using defaults", err)
+	// Commands other than "serve" only report problems - on stderr, so their output stays machine-readable
+	a := &app{configFile: *configFile, logger: newLogger(os.Stderr, log.LvlWarn)}
+	// Command line flags take precedence over environment variables
+	a.overrides = append(envOverrides(os.Environ(), a.logger), flagOverrides...)
+	flag.Visit(func(f *flag.Flag) {
+		a.configFileSet = a.configFileSet || f.Name == "config"
+	})
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
 	}
-
-	// Load configuration and prepare data directory
-	conf := cs.GetConfig()
-	logger.Info(fmt.Sprintf("Using '%s' as data directory", conf.DataDir))
-	fsutils.CheckAndCreateDir(conf.DataDir, logger)
-
-	// Set up the database connection and perform pending migrations
-	var db *sqlx.DB
-	{
-		dbFileName := path.Join(conf.DataDir, dbFile)
-
-		if db, err = sqlx.Open("sqlite3", dbFileName); err != nil {
-			logger.Crit("Failed to open database connection:", log.FldError, err)
-			panic("Startup failed")
+	if err := dispatch(a, "", commands, args); err != nil {
+		if problems, ok := errors.Cause(err).(models.ValidationErrors); ok {
+			fmt.Fprintf(os.Stderr, "Error: The configuration file '%s' is invalid:\n", a.configFile)
+			printProblems(os.Stderr, problems)
+			os.Exit(1)
 		}
-		logger.Info("Performing database migrations...")
-		if err = migrate.ExecuteMigrationsOnDb(db, logger); err != nil {
-			logger.Crit("Database migration has failed", log.FldError, err)
-			panic("Cannot continue. Please check database for consistency and try again")
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if _, ok := err.(usageError); ok {
+			os.Exit(2)
 		}
+		os.Exit(1)
 	}
 }
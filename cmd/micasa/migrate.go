@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/derWhity/micasa/internal/backup"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/migrate"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// migrateCommands are the sub-commands of "micasa migrate"
+var migrateCommands map[string]command
+
+func init() {
+	migrateCommands = map[string]command{
+		"status": {
+			usage:       "migrate status [-json]",
+			description: "Show which migrations have been applied to the database",
+			run:         runMigrateStatus,
+		},
+		"up": {
+			usage:       "migrate up [-module NAME [-to VERSION]] [-dry-run]",
+			description: "Apply all pending migrations - or only those of a module up to the given version",
+			run:         runMigrateUp,
+		},
+		"down": {
+			usage:       "migrate down [-module NAME] -to VERSION [-dry-run]",
+			description: "Roll back all migrations of a module newer than the given version - including failed ones",
+			run:         runMigrateDown,
+		},
+	}
+}
+
+// withDatabase opens the database without migrating it and calls the given function with it
+func (a *app) withDatabase(f func(db *sqlx.DB, conf models.Configuration) error) error {
+	conf, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := a.connectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return f(db, conf)
+}
+
+// backupBeforeMigration creates a backup if migrations are pending - or, when rolling back, any migration has been
+// executed. Empty databases are not backed up.
+func (a *app) backupBeforeMigration(db *sqlx.DB, conf models.Configuration, rollback bool) error {
+	status, err := migrate.GetStatus(db)
+	if err != nil {
+		return err
+	}
+	executed, pending := false, false
+	for _, s := range status {
+		executed = executed || s.Applied || s.Failed
+		pending = pending || !s.Applied
+	}
+	if !executed || !(pending || rollback) {
+		return nil
+	}
+	a.logger.Info("Creating a backup before migrating the database...")
+	backups := backup.New(conf.DataDir, db, a.configFile, a.logger)
+	if _, err := backups.Create(backup.KindMigration); err != nil {
+		return errors.Wrap(err, "Failed to create a backup before migrating the database")
+	}
+	if err := backups.Prune(backup.KindMigration, conf.Backup.Keep); err != nil {
+		a.logger.Error("Failed to remove old backups", err)
+	}
+	return nil
+}
+
+// printSchemaVersions reports the version of the newest migration applied to the database for each module
+func printSchemaVersions(db *sqlx.DB) error {
+	status, err := migrate.GetStatus(db)
+	if err != nil {
+		return err
+	}
+	var modules []string
+	versions := map[string]uint{}
+	for _, s := range status {
+		if _, ok := versions[s.Module]; !ok {
+			modules = append(modules, s.Module)
+			versions[s.Module] = 0
+		}
+		if s.Applied {
+			versions[s.Module] = s.Version
+		}
+	}
+	for _, m := range modules {
+		fmt.Fprintf(os.Stderr, "Module '%s' is at version %d of %d\n", m, versions[m], migrate.LatestVersion(m))
+	}
+	return nil
+}
+
+func runMigrateStatus(a *app, args []string) error {
+	fs := newFlagSet(migrateCommands["status"])
+	asJSON := fs.Bool("json", false, "Print the status as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The status command does not take any arguments")
+	}
+	return a.withDatabase(func(db *sqlx.DB, _ models.Configuration) error {
+		status, err := migrate.GetStatus(db)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return writeJSON(os.Stdout, status)
+		}
+		rows := make([][]string, 0, len(status))
+		for _, s := range status {
+			state, duration := "pending", "-"
+			switch {
+			case s.Modified:
+				state = "MODIFIED"
+			case s.Applied:
+				state = "applied"
+			case s.Failed:
+				state = "FAILED"
+			}
+			if s.Applied && s.AppliedAt != nil {
+				duration = s.Duration.String()
+			}
+			reversible := "yes"
+			if !s.Reversible {
+				reversible = "no"
+			}
+			description := s.Description
+			if description == "" {
+				description = "-"
+			}
+			rows = append(rows, []string{
+				s.Module, strconv.FormatUint(uint64(s.Version), 10), description, state, formatTime(s.AppliedAt),
+				duration, reversible,
+			})
+		}
+		return writeTable(
+			os.Stdout,
+			[]string{"MODULE", "VERSION", "DESCRIPTION", "STATUS", "APPLIED AT", "DURATION", "REVERSIBLE"},
+			rows,
+		)
+	})
+}
+
+func runMigrateUp(a *app, args []string) error {
+	fs := newFlagSet(migrateCommands["up"])
+	module := fs.String("module", "", "Only migrate the module and the modules it depends on")
+	to := fs.Uint("to", 0, "The version to migrate the module to - defaults to the latest version")
+	dryRun := fs.Bool("dry-run", false, "Print the SQL instead of executing it")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The up command does not take any arguments")
+	}
+	if *to > 0 && *module == "" {
+		return usageError("The module to migrate has to be given using -module")
+	}
+	return a.withDatabase(func(db *sqlx.DB, conf models.Configuration) error {
+		if *dryRun {
+			return migrate.MigrateUp(db, a.logger.Named(log.ComponentMigrate), *module, *to, os.Stdout)
+		}
+		if err := a.backupBeforeMigration(db, conf, false); err != nil {
+			return err
+		}
+		if err := migrate.MigrateUp(db, a.logger.Named(log.ComponentMigrate), *module, *to, nil); err != nil {
+			return err
+		}
+		return printSchemaVersions(db)
+	})
+}
+
+func runMigrateDown(a *app, args []string) error {
+	fs := newFlagSet(migrateCommands["down"])
+	module := fs.String("module", migrate.CoreModule, "The module to roll back")
+	to := fs.Int("to", -1, "The version to roll back to - 0 rolls back all migrations of the module")
+	dryRun := fs.Bool("dry-run", false, "Print the SQL instead of executing it")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The down command does not take any arguments")
+	}
+	if *to < 0 {
+		return usageError("The version to roll back to has to be given using -to")
+	}
+	return a.withDatabase(func(db *sqlx.DB, conf models.Configuration) error {
+		if *dryRun {
+			return migrate.MigrateDown(db, a.logger.Named(log.ComponentMigrate), *module, uint(*to), os.Stdout)
+		}
+		if err := a.backupBeforeMigration(db, conf, true); err != nil {
+			return err
+		}
+		if err := migrate.MigrateDown(db, a.logger.Named(log.ComponentMigrate), *module, uint(*to), nil); err != nil {
+			return err
+		}
+		return printSchemaVersions(db)
+	})
+}
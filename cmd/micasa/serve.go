@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/derWhity/micasa/internal/backup"
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/fhem"
+	"github.com/derWhity/micasa/internal/fsutils"
+	"github.com/derWhity/micasa/internal/lifecycle"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	devicerepo "github.com/derWhity/micasa/internal/repo/device/memory"
+	rolerepo "github.com/derWhity/micasa/internal/repo/role/sqlite"
+	sessionrepo "github.com/derWhity/micasa/internal/repo/session/sqlite"
+	tokenrepo "github.com/derWhity/micasa/internal/repo/token/sqlite"
+	userrepo "github.com/derWhity/micasa/internal/repo/user/sqlite"
+	"github.com/derWhity/micasa/internal/server"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// The time active requests are given to finish when shutting down
+	shutdownTimeout = 10 * time.Second
+	// The time a backup being created is given to finish when shutting down
+	backupStopTimeout = 5 * time.Minute
+	// How often the configuration file is checked for changes
+	configWatchInterval = 2 * time.Second
+)
+
+// runServe runs the MiCasa server until it receives a signal to shut down
+func runServe(a *app, args []string) error {
+	fs := newFlagSet(commands["serve"])
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The serve command does not take any arguments")
+	}
+
+	// Initialize the logger - it is switched to the logging settings once the configuration has been loaded
+	logs := newLogging(os.Stdout)
+	logger := logs.logger()
+	a.logger = logger
+	logger.Info(fmt.Sprintf("%s version %s is starting up...", appName, appVersion))
+
+	// Load configuration and prepare data directory
+	conf, err := a.loadConfig()
+	if err != nil {
+		logger.Crit("Failed to load the configuration", log.FldError, err)
+		return err
+	}
+	if err := logs.start(conf.Log, conf.DataDir); err != nil {
+		logger.Crit("Failed to set up the log output", log.FldError, err)
+		return err
+	}
+	logger.Info(fmt.Sprintf("Using '%s' as data directory", conf.DataDir))
+
+	lc := lifecycle.New(logger)
+
+	// The log file is needed until everything else has been stopped
+	lc.Register(lifecycle.Component{
+		Name: "log file",
+		Stop: func(ctx context.Context) error {
+			return logs.close()
+		},
+	})
+
+	// Keep other processes - like "micasa restore" - from changing the data directory while the server is running
+	var lock *fsutils.FileLock
+	lc.Register(lifecycle.Component{
+		Name: "data directory lock",
+		Start: func(ctx context.Context) (err error) {
+			lock, err = a.lockDataDir(conf)
+			return err
+		},
+		Stop: func(ctx context.Context) error {
+			return lock.Unlock()
+		},
+	})
+
+	// Set up the database connection and perform pending migrations
+	var db *sqlx.DB
+	lc.Register(lifecycle.Component{
+		Name: "database",
+		Start: func(ctx context.Context) (err error) {
+			db, err = a.openDatabase(conf)
+			return err
+		},
+		Stop: func(ctx context.Context) error {
+			return db.Close()
+		},
+	})
+
+	// Create backups of the database and the configuration periodically
+	var backups *backup.Manager
+	lc.Register(lifecycle.Component{
+		Name: "backup scheduler",
+		Start: func(ctx context.Context) error {
+			backups = backup.New(conf.DataDir, db, a.configFile, logger)
+			backups.Start(time.Duration(conf.Backup.Interval)*time.Hour, conf.Backup.Keep)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			// Waits for a backup being created
+			backups.Stop()
+			return nil
+		},
+		StopTimeout: backupStopTimeout,
+	})
+
+	// Connect to FHEM and keep the device states up to date using its event stream
+	fhemLogger := logger.Named(log.ComponentFhem)
+	fhemClient := fhem.NewClient(conf.Fhem, fhemLogger)
+	bus := events.NewBus(logger)
+	deviceRepo := devicerepo.New(fhemClient, logger.Named(log.ComponentRepo))
+	stream := fhem.NewStream(conf.Fhem, bus, fhemLogger)
+	stream.OnConnect = func() {
+		// Events may have been missed while not being connected - so load the complete state again
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := deviceRepo.Sync(ctx); err != nil {
+				logger.Error("Failed to load the device states from FHEM", err)
+			}
+		}()
+	}
+	lc.Register(lifecycle.Component{
+		Name: "FHEM client",
+		Stop: func(ctx context.Context) error {
+			return fhemClient.Close()
+		},
+	})
+	lc.Register(lifecycle.Component{
+		Name: "event bus",
+		Stop: func(ctx context.Context) error {
+			bus.Close()
+			return nil
+		},
+	})
+	lc.Register(lifecycle.Component{
+		Name: "device repository",
+		Start: func(ctx context.Context) error {
+			deviceRepo.Start(bus)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			deviceRepo.Stop()
+			return nil
+		},
+	})
+	lc.Register(lifecycle.Component{
+		Name: "FHEM event stream",
+		Start: func(ctx context.Context) error {
+			stream.Start()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			stream.Stop()
+			return nil
+		},
+	})
+
+	// Start the HTTP API server
+	var srv *server.Server
+	lc.Register(lifecycle.Component{
+		Name: "HTTP server",
+		Start: func(ctx context.Context) error {
+			srv = server.New(conf.ListenAddress, server.Dependencies{
+				Users:           userrepo.New(db),
+				Sessions:        sessionrepo.New(db),
+				SessionConfig:   conf.Sessions,
+				Tokens:          tokenrepo.New(db),
+				Roles:           rolerepo.New(db),
+				Devices:         deviceRepo,
+				Commander:       fhemClient,
+				Bus:             bus,
+				Config:          a.cs,
+				Whitelist:       a.cs,
+				WhitelistConfig: conf.Whitelist,
+				LogLevels:       logs.output,
+				LogBuffer:       logs.buffer,
+			}, logger.Named(log.ComponentHTTP))
+			return srv.Start()
+		},
+		Stop: func(ctx context.Context) error {
+			// Active requests are given the time to finish
+			return srv.Shutdown(ctx)
+		},
+		StopTimeout: shutdownTimeout,
+	})
+
+	// Apply changes of the configuration file without restarting
+	var unsubscribe func()
+	lc.Register(lifecycle.Component{
+		Name: "configuration watcher",
+		Start: func(ctx context.Context) error {
+			unsubscribe = a.cs.Subscribe(func(old models.Configuration, new models.Configuration) {
+				applyConfig(logger, old, new, logs, fhemClient, stream, srv, backups)
+			})
+			a.cs.Watch(configWatchInterval)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			a.cs.StopWatching()
+			unsubscribe()
+			return nil
+		},
+	})
+
+	if err := lc.Start(context.Background()); err != nil {
+		logger.Crit("Startup failed", log.FldError, err)
+		return err
+	}
+	logger.Info(fmt.Sprintf("%s is up and running", appName))
+
+	// Wait for the signal to shut down - SIGHUP reloads the configuration
+	sig := lifecycle.WaitForSignal(func() {
+		a.cs.Reload()
+	})
+	logger.Info(fmt.Sprintf("Received signal '%s' - shutting down...", sig))
+	if err := lc.Stop(); err != nil {
+		// Everything else has been stopped anyway
+		logger.Warn("Shutdown has not been clean", log.FldError, err)
+		return err
+	}
+	logger.Info(fmt.Sprintf("%s has been shut down", appName))
+	return nil
+}
+
+// applyConfig applies the changes of the configuration file to the running components
+func applyConfig(
+	logger log.Logger,
+	old models.Configuration,
+	new models.Configuration,
+	logs *logging,
+	fhemClient *fhem.Client,
+	stream *fhem.Stream,
+	srv *server.Server,
+	backups *backup.Manager,
+) {
+	if new.Log != old.Log {
+		logger.Info("Applying the changed logging settings")
+		if err := logs.apply(new.Log); err != nil {
+			logger.Error("Failed to apply the logging settings - keeping the current log output", err)
+		}
+	}
+	if new.Fhem != old.Fhem {
+		logger.Info("Applying the changed FHEM settings")
+		fhemClient.UpdateConfig(new.Fhem)
+		stream.UpdateConfig(new.Fhem)
+	}
+	if new.Sessions != old.Sessions {
+		logger.Info("Applying the changed session settings")
+		srv.UpdateSessionConfig(new.Sessions)
+	}
+	if !reflect.DeepEqual(new.Whitelist, old.Whitelist) {
+		logger.Info("Applying the changed whitelist settings")
+		srv.UpdateWhitelistConfig(new.Whitelist)
+	}
+	if new.Backup != old.Backup {
+		logger.Info("Applying the changed backup settings")
+		backups.Stop()
+		backups.Start(time.Duration(new.Backup.Interval)*time.Hour, new.Backup.Keep)
+	}
+	if new.ListenAddress != old.ListenAddress || new.DataDir != old.DataDir {
+		logger.Warn("The listen address and the data directory are only changed after a restart")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	tokenrepo "github.com/derWhity/micasa/internal/repo/token/sqlite"
+	userrepo "github.com/derWhity/micasa/internal/repo/user/sqlite"
+	"github.com/derWhity/micasa/internal/server"
+	"github.com/pkg/errors"
+)
+
+// tokenCommands are the sub-commands of "micasa token"
+var tokenCommands map[string]command
+
+func init() {
+	tokenCommands = map[string]command{
+		"create": {
+			usage:       "token create [-scope PERMISSION]... [-expires PERIOD] [-json] <user> <name>",
+			description: "Create a new API token for the user - the token is only shown once",
+			run:         runTokenCreate,
+		},
+		"list": {
+			usage:       "token list [-json] <user>",
+			description: "List the API tokens of the user",
+			run:         runTokenList,
+		},
+		"revoke": {
+			usage:       "token revoke <user> <token-id>",
+			description: "Revoke an API token of the user",
+			run:         runTokenRevoke,
+		},
+	}
+}
+
+// withTokenRepo opens the database and calls the given function with the repositories needed for managing tokens
+func (a *app) withTokenRepo(f func(users repo.UserRepo, tokens repo.APITokenRepo) error) error {
+	conf, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := a.openDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return f(userrepo.New(db), tokenrepo.New(db))
+}
+
+func runTokenCreate(a *app, args []string) error {
+	fs := newFlagSet(tokenCommands["create"])
+	var scopes stringList
+	fs.Var(&scopes, "scope", "Restrict the token to the given permission - e.g. devices.control:light_* (repeatable)")
+	expires := fs.String("expires", "", "Let the token expire after the given period - e.g. 90d or 12h")
+	asJSON := fs.Bool("json", false, "Print the token as JSON document")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return usageError("Expecting the user name and the token name")
+	}
+	now := time.Now()
+	expiresAt, err := parseExpiry(*expires, now)
+	if err != nil {
+		return err
+	}
+	return a.withTokenRepo(func(users repo.UserRepo, tokens repo.APITokenRepo) error {
+		user, err := userByName(users, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		secret, err := models.NewAPIToken()
+		if err != nil {
+			return err
+		}
+		token := &models.APIToken{
+			UserID:    user.ID,
+			Name:      strings.TrimSpace(fs.Arg(1)),
+			TokenHash: models.HashAPIToken(secret),
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+		}
+		for _, s := range scopes {
+			token.Scopes = append(token.Scopes, models.Permission(s))
+		}
+		if token.Name == "" {
+			return usageError("The token needs a name")
+		}
+		if err := tokens.Create(token); err != nil {
+			switch errors.Cause(err) {
+			case repo.ErrDuplicate:
+				return errors.Errorf("User '%s' already has a token named '%s'", user.Name, token.Name)
+			case repo.ErrInvalidPermission:
+				return errors.New("Invalid scope - use the name of a permission, optionally followed by :pattern")
+			}
+			return err
+		}
+		if *asJSON {
+			res := server.NewTokenResponse(token)
+			res.Token = secret
+			return writeJSON(os.Stdout, res)
+		}
+		fmt.Fprintf(os.Stderr, "Created token '%s' (%s) - it will not be shown again:\n", token.Name, token.ID)
+		fmt.Fprintln(os.Stdout, secret)
+		return nil
+	})
+}
+
+func runTokenList(a *app, args []string) error {
+	fs := newFlagSet(tokenCommands["list"])
+	asJSON := fs.Bool("json", false, "Print the tokens as JSON document")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("Expecting the user name")
+	}
+	return a.withTokenRepo(func(users repo.UserRepo, tokens repo.APITokenRepo) error {
+		user, err := userByName(users, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		list, err := tokens.GetByUser(user.ID)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			res := server.TokenListResponse{Tokens: make([]server.TokenResponse, 0, len(list))}
+			for _, t := range list {
+				res.Tokens = append(res.Tokens, server.NewTokenResponse(t))
+			}
+			res.Total = len(res.Tokens)
+			return writeJSON(os.Stdout, res)
+		}
+		rows := make([][]string, 0, len(list))
+		for _, t := range list {
+			scopes := "(all)"
+			if len(t.Scopes) > 0 {
+				parts := make([]string, 0, len(t.Scopes))
+				for _, s := range t.Scopes {
+					parts = append(parts, string(s))
+				}
+				scopes = strings.Join(parts, " ")
+			}
+			expires := formatTime(t.ExpiresAt)
+			if t.Expired(time.Now()) {
+				expires += " (expired)"
+			}
+			rows = append(rows, []string{
+				string(t.ID), t.Name, scopes, formatTime(&t.CreatedAt), expires, formatTime(t.LastUsed),
+			})
+		}
+		return writeTable(os.Stdout, []string{"ID", "NAME", "SCOPES", "CREATED", "EXPIRES", "LAST USED"}, rows)
+	})
+}
+
+func runTokenRevoke(a *app, args []string) error {
+	fs := newFlagSet(tokenCommands["revoke"])
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return usageError("Expecting the user name and the token ID")
+	}
+	return a.withTokenRepo(func(users repo.UserRepo, tokens repo.APITokenRepo) error {
+		user, err := userByName(users, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		token, err := tokens.GetByID(models.APITokenID(fs.Arg(1)))
+		if err != nil || token.UserID != user.ID {
+			if err == nil || errors.Cause(err) == repo.ErrNotExisting {
+				return errors.Errorf("User '%s' has no token with ID '%s'", user.Name, fs.Arg(1))
+			}
+			return err
+		}
+		if err := tokens.Delete(token.ID); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Revoked token '%s'\n", token.Name)
+		return nil
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	rolerepo "github.com/derWhity/micasa/internal/repo/role/sqlite"
+	sessionrepo "github.com/derWhity/micasa/internal/repo/session/sqlite"
+	userrepo "github.com/derWhity/micasa/internal/repo/user/sqlite"
+	"github.com/pkg/errors"
+)
+
+// userCommands are the sub-commands of "micasa user"
+var userCommands map[string]command
+
+func init() {
+	userCommands = map[string]command{
+		"add": {
+			usage:       "user add [-fullname NAME] [-role ROLE]... [-json] <name>",
+			description: "Create a new user - the password is read from the terminal or from stdin",
+			run:         runUserAdd,
+		},
+		"list": {
+			usage:       "user list [-search TEXT] [-json]",
+			description: "List all users or the users whose name contains the search text",
+			run:         runUserList,
+		},
+		"passwd": {
+			usage:       "user passwd <name>",
+			description: "Set a new password for the user and end all of his/her sessions",
+			run:         runUserPasswd,
+		},
+		"delete": {
+			usage:       "user delete <name>",
+			description: "Delete the user together with his/her sessions and API tokens",
+			run:         runUserDelete,
+		},
+		"show": {
+			usage:       "user show [-json] <name>",
+			description: "Show the user together with his/her roles and permissions",
+			run:         runUserShow,
+		},
+	}
+}
+
+// userRepos are the repositories needed for managing users
+type userRepos struct {
+	users    repo.UserRepo
+	roles    repo.RoleRepo
+	sessions repo.SessionRepo
+}
+
+// userInfo is the JSON representation of a user printed by the user commands
+type userInfo struct {
+	ID          models.UserID       `json:"id"`
+	Name        string              `json:"name"`
+	FullName    string              `json:"fullName"`
+	Roles       []models.RoleID     `json:"roles"`
+	Permissions []models.Permission `json:"permissions,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	UpdatedAt   time.Time           `json:"updatedAt"`
+}
+
+// userInfoList is the JSON document printed by "micasa user list"
+type userInfoList struct {
+	Users []userInfo `json:"users"`
+	Total uint       `json:"total"`
+}
+
+// withUserRepos opens the database and calls the given function with the repositories needed for managing users
+func (a *app) withUserRepos(f func(r userRepos) error) error {
+	conf, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := a.openDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return f(userRepos{users: userrepo.New(db), roles: rolerepo.New(db), sessions: sessionrepo.New(db)})
+}
+
+// userByName looks up a user by his/her name and reports a readable error if the user does not exist
+func userByName(users repo.UserRepo, name string) (*models.User, error) {
+	user, err := users.GetByName(name)
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			return nil, errors.Errorf("User '%s' does not exist", name)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// newUserInfo collects the roles of the user - the permissions are only included if withPermissions is set
+func newUserInfo(roles repo.RoleRepo, u *models.User, withPermissions bool) (userInfo, error) {
+	assigned, err := roles.GetByUser(u.ID)
+	if err != nil {
+		return userInfo{}, err
+	}
+	info := userInfo{
+		ID:        u.ID,
+		Name:      u.Name,
+		FullName:  u.FullName,
+		Roles:     make([]models.RoleID, 0, len(assigned)),
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+	for _, r := range assigned {
+		info.Roles = append(info.Roles, r.ID)
+	}
+	if withPermissions {
+		info.Permissions = models.PermissionsOf(assigned)
+	}
+	return info, nil
+}
+
+// joinRoles formats the roles for table output
+func joinRoles(roles []models.RoleID) string {
+	if len(roles) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(roles))
+	for _, r := range roles {
+		parts = append(parts, string(r))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func runUserAdd(a *app, args []string) error {
+	fs := newFlagSet(userCommands["add"])
+	fullName := fs.String("fullname", "", "The full name of the user")
+	var roleIDs stringList
+	fs.Var(&roleIDs, "role", "Assign the role to the user (repeatable) - the first user becomes admin, others member")
+	asJSON := fs.Bool("json", false, "Print the created user as JSON document")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("Expecting the user name")
+	}
+	name := strings.TrimSpace(fs.Arg(0))
+	if name == "" {
+		return usageError("The user needs a name")
+	}
+	return a.withUserRepos(func(r userRepos) error {
+		if _, err := r.users.GetByName(name); err == nil {
+			return errors.Errorf("User '%s' already exists", name)
+		} else if errors.Cause(err) != repo.ErrNotExisting {
+			return err
+		}
+		if len(roleIDs) == 0 {
+			// Someone has to be able to manage the others
+			count, err := r.users.Count("")
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				roleIDs = stringList{string(models.RoleAdmin)}
+			} else {
+				roleIDs = stringList{string(models.RoleMember)}
+			}
+		}
+		for _, id := range roleIDs {
+			if _, err := r.roles.GetByID(models.RoleID(id)); err != nil {
+				if errors.Cause(err) == repo.ErrNotExisting {
+					return errors.Errorf("Role '%s' does not exist", id)
+				}
+				return err
+			}
+		}
+		pass, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		user := &models.User{Name: name, FullName: strings.TrimSpace(*fullName)}
+		if err := user.SetPassword(pass); err != nil {
+			return err
+		}
+		if err := r.users.Create(user); err != nil {
+			if errors.Cause(err) == repo.ErrDuplicate {
+				return errors.Errorf("User '%s' already exists", name)
+			}
+			return err
+		}
+		for _, id := range roleIDs {
+			if err := r.roles.Assign(user.ID, models.RoleID(id)); err != nil {
+				return err
+			}
+		}
+		if !*asJSON {
+			fmt.Fprintf(os.Stderr, "Created user '%s' with role(s) %s\n", user.Name, strings.Join(roleIDs, ", "))
+			return nil
+		}
+		// Read the user again to get the timestamps set by the database
+		if user, err = r.users.GetByID(user.ID); err != nil {
+			return err
+		}
+		info, err := newUserInfo(r.roles, user, false)
+		if err != nil {
+			return err
+		}
+		return writeJSON(os.Stdout, info)
+	})
+}
+
+func runUserList(a *app, args []string) error {
+	fs := newFlagSet(userCommands["list"])
+	search := fs.String("search", "", "Only list users whose name or full name contains the text")
+	asJSON := fs.Bool("json", false, "Print the users as JSON document")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageError("The list command does not take any arguments")
+	}
+	return a.withUserRepos(func(r userRepos) error {
+		users, err := r.users.Find(*search, 0, 0)
+		if err != nil {
+			return err
+		}
+		res := userInfoList{Users: make([]userInfo, 0, len(users)), Total: uint(len(users))}
+		for _, u := range users {
+			info, err := newUserInfo(r.roles, u, false)
+			if err != nil {
+				return err
+			}
+			res.Users = append(res.Users, info)
+		}
+		if *asJSON {
+			return writeJSON(os.Stdout, res)
+		}
+		rows := make([][]string, 0, len(res.Users))
+		for _, u := range res.Users {
+			fullName := u.FullName
+			if fullName == "" {
+				fullName = "-"
+			}
+			rows = append(rows, []string{u.Name, fullName, joinRoles(u.Roles), formatTime(&u.CreatedAt)})
+		}
+		return writeTable(os.Stdout, []string{"NAME", "FULL NAME", "ROLES", "CREATED"}, rows)
+	})
+}
+
+func runUserPasswd(a *app, args []string) error {
+	fs := newFlagSet(userCommands["passwd"])
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("Expecting the user name")
+	}
+	return a.withUserRepos(func(r userRepos) error {
+		user, err := userByName(r.users, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		pass, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if err := user.SetPassword(pass); err != nil {
+			return err
+		}
+		if err := r.users.Update(user); err != nil {
+			return err
+		}
+		// Whoever knew the old password should not stay logged in
+		if err := r.sessions.DeleteByUser(user.ID); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Changed the password of user '%s'\n", user.Name)
+		return nil
+	})
+}
+
+func runUserDelete(a *app, args []string) error {
+	fs := newFlagSet(userCommands["delete"])
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("Expecting the user name")
+	}
+	return a.withUserRepos(func(r userRepos) error {
+		user, err := userByName(r.users, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if err := r.users.Delete(user.ID); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Deleted user '%s'\n", user.Name)
+		return nil
+	})
+}
+
+func runUserShow(a *app, args []string) error {
+	fs := newFlagSet(userCommands["show"])
+	asJSON := fs.Bool("json", false, "Print the user as JSON document")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usageError("Expecting the user name")
+	}
+	return a.withUserRepos(func(r userRepos) error {
+		user, err := userByName(r.users, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		info, err := newUserInfo(r.roles, user, true)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return writeJSON(os.Stdout, info)
+		}
+		perms := make([]string, 0, len(info.Permissions))
+		for _, p := range info.Permissions {
+			perms = append(perms, string(p))
+		}
+		if len(perms) == 0 {
+			perms = append(perms, "-")
+		}
+		fullName := info.FullName
+		if fullName == "" {
+			fullName = "-"
+		}
+		return writeTable(os.Stdout, []string{"FIELD", "VALUE"}, [][]string{
+			{"ID", string(info.ID)},
+			{"Name", info.Name},
+			{"Full name", fullName},
+			{"Roles", joinRoles(info.Roles)},
+			{"Permissions", strings.Join(perms, ", ")},
+			{"Created", formatTime(&info.CreatedAt)},
+			{"Updated", formatTime(&info.UpdatedAt)},
+		})
+	})
+}
@@ -0,0 +1,205 @@
+package micasa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/fsutils"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HistoryDirName is the name of the directory next to the configuration file the previous versions are kept in
+	HistoryDirName = "config-history"
+	// CurrentVersion is the version ID of the configuration file in use
+	CurrentVersion = "current"
+	// The format of the modification time used as version ID
+	versionFormat = "20060102-150405.000"
+)
+
+// versionPattern matches valid version IDs of previous versions
+var versionPattern = regexp.MustCompile(`^\d{8}-\d{6}\.\d{3}$`)
+
+// historyDir returns the directory the previous versions of the given configuration file are kept in
+func historyDir(filename string) string {
+	return filepath.Join(filepath.Dir(filename), HistoryDirName)
+}
+
+// versionFile returns the file name of a previous version of the configuration file - "config.json" is kept as
+// "config-history/config-20261017-020304.567.json"
+func versionFile(filename string, version string) string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filepath.Base(filename), ext)
+	return filepath.Join(historyDir(filename), base+"-"+version+ext)
+}
+
+// writeFile replaces the configuration file atomically - keeping the previous version in the history
+func (s *configService) writeFile(filename string, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	keep := s.GetConfig().ConfigHistory
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+		if keep > 0 {
+			if err := archive(filename, info); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fsutils.WriteFileAtomic(filename, data, perm); err != nil {
+		return errors.Wrap(err, "WriteToFile: Failed to write configuration file")
+	}
+	if keep > 0 {
+		if err := s.pruneHistory(filename, keep); err != nil {
+			s.logger.Error("Failed to remove old versions of the configuration file", err)
+		}
+	}
+	return nil
+}
+
+// archive copies the current version of the configuration file into the history
+func archive(filename string, info os.FileInfo) error {
+	target := versionFile(filename, info.ModTime().UTC().Format(versionFormat))
+	if _, err := os.Stat(target); err == nil {
+		// This version has been kept already
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read the current configuration file")
+	}
+	if err := os.MkdirAll(historyDir(filename), 0700); err != nil {
+		return errors.Wrap(err, "Failed to create the directory for previous versions of the configuration")
+	}
+	if err := fsutils.WriteFileAtomic(target, data, 0600); err != nil {
+		return errors.Wrap(err, "Failed to keep the current version of the configuration file")
+	}
+	return nil
+}
+
+// history returns the previous versions of the given configuration file - the newest first
+func history(filename string) ([]models.ConfigVersion, error) {
+	entries, err := ioutil.ReadDir(historyDir(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []models.ConfigVersion{}, nil
+		}
+		return nil, errors.Wrap(err, "Failed to read the previous versions of the configuration file")
+	}
+	ext := filepath.Ext(filename)
+	prefix := strings.TrimSuffix(filepath.Base(filename), ext) + "-"
+	res := []models.ConfigVersion{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) || !strings.HasSuffix(e.Name(), ext) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(e.Name(), prefix), ext)
+		modifiedAt, err := time.Parse(versionFormat, id)
+		if err != nil || !versionPattern.MatchString(id) {
+			continue
+		}
+		res = append(res, models.ConfigVersion{ID: id, ModifiedAt: modifiedAt, Size: e.Size()})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ModifiedAt.After(res[j].ModifiedAt)
+	})
+	return res, nil
+}
+
+// pruneHistory removes the oldest versions of the configuration file, so only the newest keep versions remain
+func (s *configService) pruneHistory(filename string, keep int) error {
+	versions, err := history(filename)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(versions); i++ {
+		file := versionFile(filename, versions[i].ID)
+		if err := os.Remove(file); err != nil {
+			return errors.Wrapf(err, "Failed to remove '%s'", file)
+		}
+		s.logger.Debug("Removed old version of the configuration file", log.FldFile, file)
+	}
+	return nil
+}
+
+// Versions returns the current and the previous versions of the configuration file - the newest first
+func (s *configService) Versions() ([]models.ConfigVersion, error) {
+	res := []models.ConfigVersion{}
+	if info, err := os.Stat(s.configFilename); err == nil {
+		res = append(res, models.ConfigVersion{
+			ID:         CurrentVersion,
+			ModifiedAt: info.ModTime().UTC(),
+			Size:       info.Size(),
+			Current:    true,
+		})
+	}
+	previous, err := history(s.configFilename)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, previous...), nil
+}
+
+// readVersion returns the contents of a version of the configuration file
+func (s *configService) readVersion(version string) ([]byte, error) {
+	file := s.configFilename
+	if version != CurrentVersion {
+		if !versionPattern.MatchString(version) {
+			return nil, errors.Wrapf(repo.ErrNotExisting, "Unknown version '%s' of the configuration", version)
+		}
+		file = versionFile(s.configFilename, version)
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(repo.ErrNotExisting, "Unknown version '%s' of the configuration", version)
+	}
+	return data, errors.Wrapf(err, "Failed to read version '%s' of the configuration", version)
+}
+
+// Diff returns the settings which differ between two versions of the configuration file - the overrides are not
+// taken into account
+func (s *configService) Diff(from string, to string) ([]models.ConfigChange, error) {
+	var confs [2]*models.Configuration
+	for i, version := range []string{from, to} {
+		data, err := s.readVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		if confs[i], err = models.GetDefaultConfig(); err != nil {
+			return nil, err
+		}
+		if set, err := models.ParseConfig(data, confs[i]); set == nil {
+			return nil, errors.Wrapf(err, "Version '%s' of the configuration is damaged", version)
+		}
+	}
+	return models.DiffConfig(confs[0], confs[1]), nil
+}
+
+// Rollback replaces the configuration file by a previous version and reloads it
+func (s *configService) Rollback(version string) error {
+	if version == CurrentVersion {
+		return nil
+	}
+	data, err := s.readVersion(version)
+	if err != nil {
+		return err
+	}
+	if _, err := s.parse(data, versionFile(s.configFilename, version)); err != nil {
+		return errors.Wrapf(err, "Rollback: Version '%s' cannot be used", version)
+	}
+	s.logger.Info(fmt.Sprintf("Rolling back the configuration file to version '%s'", version))
+	if err := s.writeFile(s.configFilename, data); err != nil {
+		return err
+	}
+	return s.Reload()
+}
@@ -2,8 +2,13 @@ package micasa
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/derWhity/micasa/internal/log"
 	"github.com/derWhity/micasa/internal/models"
@@ -13,28 +18,131 @@ import (
 // ConfigService gives the authenticated user access to parts of the application's configuration
 type ConfigService interface {
 	Load() error
+	// LoadDefaults uses the default configuration instead of a configuration file - the overrides are still applied
+	LoadDefaults() error
 	// LoadFromFile loads the configuration from the given JSON file and returns it
 	LoadFromFile(filename string) error
-	// Write writes the current application configuration to the default file name
+	// Write writes the current application configuration to the default file name - without the overrides
 	Write() error
-	// WriteToFile writes the current application configuration to a JSON file
+	// WriteToFile writes the current application configuration to a JSON file - without the overrides
 	WriteToFile(filename string) error
+	// Versions returns the current and the previous versions of the configuration file - the newest first
+	Versions() ([]models.ConfigVersion, error)
+	// Diff returns the settings which differ between two versions of the configuration file
+	Diff(from string, to string) ([]models.ConfigChange, error)
+	// Rollback replaces the configuration file by a previous version and reloads it - the current version is kept in
+	// the history. A version which is invalid by now is rejected.
+	Rollback(version string) error
 	// GetConfig retuns the current application configuration
 	GetConfig() models.Configuration
+	// GetSources returns where the values of the current configuration have come from - by the JSON path of the
+	// settings
+	GetSources() map[string]models.ConfigSource
+	// SetOverrides sets the values replacing the settings of the configuration file - e.g. from environment variables
+	// or command line flags. They are applied whenever the configuration is loaded; later overrides win.
+	SetOverrides(overrides []models.ConfigOverride)
+	// Reload loads the configuration from the default file name again. If the file cannot be loaded or the new
+	// configuration is invalid, the current configuration is kept and an error is returned. The subscribers are
+	// notified if the configuration has changed.
+	Reload() error
+	// Subscribe registers a function which is called with the previous and the new configuration whenever the
+	// configuration has been changed by Reload. The returned function cancels the subscription.
+	Subscribe(fn ConfigListener) (cancel func())
+	// Watch checks the configuration file for changes in the given interval and reloads it if it has changed - until
+	// StopWatching is called
+	Watch(interval time.Duration)
+	// StopWatching stops checking the configuration file for changes
+	StopWatching()
+	// IsWhitelisted checks whether the client with the given IP address is on the whitelist of the current
+	// configuration
+	IsWhitelisted(ip net.IP) bool
+	// IsTrustedProxy checks whether the X-Forwarded-For header added by the given address is trusted
+	IsTrustedProxy(ip net.IP) bool
 }
 
+// ConfigListener is called after the configuration has changed
+type ConfigListener func(old models.Configuration, new models.Configuration)
+
 // -- ConfigService implementation -------------------------------------------------------------------------------------
 
 // Simple index structure to speed up whitelist lookups
 type whitelistIdx struct {
 	sync.RWMutex
+	// Single addresses - by their string representation
 	data map[string]bool
+	// CIDR ranges
+	nets []*net.IPNet
+}
+
+// update replaces the contents of the index by the given entries - single IP addresses, CIDR ranges or "lan"
+func (idx *whitelistIdx) update(entries []string) {
+	data := map[string]bool{}
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		// Invalid entries have been rejected by the validation already
+		networks, _ := models.ParseNetworks(entry)
+		for _, n := range networks {
+			if ones, bits := n.Mask.Size(); ones == bits {
+				data[n.IP.String()] = true
+			} else {
+				nets = append(nets, n)
+			}
+		}
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	idx.data = data
+	idx.nets = nets
+}
+
+// contains checks whether the given IP address is part of the index
+func (idx *whitelistIdx) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	idx.RLock()
+	defer idx.RUnlock()
+	if idx.data[ip.String()] {
+		return true
+	}
+	for _, n := range idx.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileState is used to detect changes of the configuration file
+type fileState struct {
+	modTime time.Time
+	size    int64
 }
 
 type configService struct {
 	configFilename string
-	config         *models.Configuration
 	logger         log.Logger
+	// Guards config, fileConfig, sources, overrides and fileState
+	mu     sync.RWMutex
+	config *models.Configuration
+	// The configuration as read from the file - without the overrides. This is what is written back.
+	fileConfig *models.Configuration
+	sources    map[string]models.ConfigSource
+	overrides  []models.ConfigOverride
+	fileState  fileState
+	// The whitelisted clients and the trusted proxies of the current configuration
+	whitelist whitelistIdx
+	proxies   whitelistIdx
+	// Serializes reloads, so subscribers are notified in the order of the changes
+	reloadMu sync.Mutex
+	// Serializes writing the configuration file and its history
+	writeMu sync.Mutex
+	// Guards listeners and nextID
+	listenerMu sync.Mutex
+	listeners  map[int]ConfigListener
+	nextID     int
+	stop       chan struct{}
+	done       chan struct{}
 }
 
 // NewConfigService creates a new configuration service instance with the given default file name
@@ -42,6 +150,7 @@ func NewConfigService(configFilename string, logger log.Logger) ConfigService {
 	return &configService{
 		configFilename: configFilename,
 		logger:         logger,
+		listeners:      map[int]ConfigListener{},
 	}
 }
 
@@ -50,49 +159,279 @@ func (s *configService) Load() error {
 	return s.LoadFromFile(s.configFilename)
 }
 
+// parsedConfig is the result of reading a configuration file
+type parsedConfig struct {
+	// The configuration to use - including the overrides
+	effective *models.Configuration
+	// The configuration as read from the file - merged with the defaults, but without the overrides
+	file *models.Configuration
+	// Where the values of the effective configuration have come from
+	sources map[string]models.ConfigSource
+}
+
+// readFile reads the configuration file, applies the overrides and validates the result without using it. An empty
+// file name reads the defaults.
+func (s *configService) readFile(filename string) (parsedConfig, fileState, error) {
+	var state fileState
+	var data []byte
+	if filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return parsedConfig{}, state, errors.Wrap(err, "LoadFromFile: cannot load configuration file")
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil {
+			state = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+		if data, err = ioutil.ReadAll(f); err != nil {
+			return parsedConfig{}, state, errors.Wrap(err, "LoadFromFile: Failed to read configuration file")
+		}
+	}
+	parsed, err := s.parse(data, filename)
+	return parsed, state, err
+}
+
+// parse decodes the contents of a configuration file, applies the overrides and validates the result - nil data
+// stands for the defaults. The file name is only used for reporting problems.
+func (s *configService) parse(data []byte, filename string) (parsedConfig, error) {
+	conf, err := models.GetDefaultConfig()
+	if err != nil {
+		return parsedConfig{}, errors.Wrap(err, "LoadFromFile: Failed to create default config")
+	}
+	sources := map[string]models.ConfigSource{}
+	var problems models.ValidationErrors
+	if data != nil {
+		set, err := models.ParseConfig(data, conf)
+		if set == nil {
+			// The file is no valid JSON at all
+			return parsedConfig{}, errors.Wrapf(err, "LoadFromFile: Invalid configuration file '%s'", filename)
+		}
+		if err != nil {
+			problems = append(problems, err.(models.ValidationErrors)...)
+		}
+		for _, path := range set {
+			sources[path] = models.SourceFile
+		}
+	}
+	fileConf := *conf
+	s.mu.RLock()
+	overrides := s.overrides
+	s.mu.RUnlock()
+	if err := conf.ApplyOverrides(overrides); err != nil {
+		problems = append(problems, err.(models.ValidationErrors)...)
+	}
+	for _, o := range overrides {
+		sources[o.Path] = o.Source
+	}
+	if err := conf.Validate(); err != nil {
+		problems = append(problems, err.(models.ValidationErrors)...)
+	}
+	if len(problems) > 0 {
+		return parsedConfig{}, errors.Wrapf(problems, "LoadFromFile: Invalid configuration file '%s'", filename)
+	}
+	return parsedConfig{effective: conf, file: &fileConf, sources: sources}, nil
+}
+
 // LoadFromFile loads the configuration from the given JSON file and returns it
 func (s *configService) LoadFromFile(filename string) error {
 	s.logger.Info("Loading configuration file", log.FldFile, filename)
-	conf, err := models.GetDefaultConfig()
+	return s.load(filename)
+}
+
+// LoadDefaults uses the default configuration instead of a configuration file
+func (s *configService) LoadDefaults() error {
+	return s.load("")
+}
+
+// load reads the configuration file and uses it
+func (s *configService) load(filename string) error {
+	parsed, state, err := s.readFile(filename)
 	if err != nil {
-		return errors.Wrap(err, "LoadFromFile: Failed to create default config")
+		return err
 	}
-	f, err := os.Open(filename)
-	if err != nil {
-		return errors.Wrap(err, "LoadFromFile: cannot load configuration file")
+	s.mu.Lock()
+	s.config = parsed.effective
+	s.fileConfig = parsed.file
+	s.sources = parsed.sources
+	s.fileState = state
+	s.mu.Unlock()
+	s.updateIndexes(parsed.effective)
+	return nil
+}
+
+// updateIndexes fills the lookup indexes with the entries of the given configuration
+func (s *configService) updateIndexes(conf *models.Configuration) {
+	s.whitelist.update(conf.Whitelist.Addresses)
+	s.proxies.update(conf.Whitelist.TrustedProxies)
+}
+
+// IsWhitelisted checks whether the client with the given IP address is on the whitelist
+func (s *configService) IsWhitelisted(ip net.IP) bool {
+	return s.whitelist.contains(ip)
+}
+
+// IsTrustedProxy checks whether the X-Forwarded-For header added by the given address is trusted
+func (s *configService) IsTrustedProxy(ip net.IP) bool {
+	return s.proxies.contains(ip)
+}
+
+// SetOverrides sets the values replacing the settings of the configuration file
+func (s *configService) SetOverrides(overrides []models.ConfigOverride) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = append([]models.ConfigOverride{}, overrides...)
+}
+
+// GetSources returns where the values of the current configuration have come from
+func (s *configService) GetSources() map[string]models.ConfigSource {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := map[string]models.ConfigSource{}
+	for _, setting := range models.ConfigSettings() {
+		res[setting.Path] = models.SourceDefault
 	}
-	defer f.Close()
-	if err = json.NewDecoder(f).Decode(&conf); err != nil {
-		return errors.Wrap(err, "LoadFromFile: Failed to decode configuration file")
+	for path, source := range s.sources {
+		res[path] = source
 	}
+	return res
+}
+
+// Reload loads the configuration from the default file name again and notifies the subscribers about changes
+func (s *configService) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.logger.Info("Reloading configuration file", log.FldFile, s.configFilename)
+	parsed, state, err := s.readFile(s.configFilename)
+	s.mu.Lock()
+	// Do not try to load a broken file again until it has been changed
+	s.fileState = state
+	if err != nil {
+		s.mu.Unlock()
+		s.logger.Error("Rejected the new configuration - keeping the current one", err)
+		return err
+	}
+	old := s.getConfig()
+	conf := parsed.effective
 	s.config = conf
+	s.fileConfig = parsed.file
+	s.sources = parsed.sources
+	s.mu.Unlock()
+	s.updateIndexes(conf)
+	if reflect.DeepEqual(*conf, old) {
+		return nil
+	}
+	s.logger.Info("Configuration has changed")
+	s.listenerMu.Lock()
+	ids := make([]int, 0, len(s.listeners))
+	for id := range s.listeners {
+		ids = append(ids, id)
+	}
+	listeners := make([]ConfigListener, 0, len(ids))
+	// Call the listeners in the order they have subscribed
+	sort.Ints(ids)
+	for _, id := range ids {
+		listeners = append(listeners, s.listeners[id])
+	}
+	s.listenerMu.Unlock()
+	for _, fn := range listeners {
+		fn(old, *conf)
+	}
 	return nil
 }
 
+// Subscribe registers a function which is called whenever the configuration has changed
+func (s *configService) Subscribe(fn ConfigListener) func() {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.listeners[id] = fn
+	return func() {
+		s.listenerMu.Lock()
+		defer s.listenerMu.Unlock()
+		delete(s.listeners, id)
+	}
+}
+
+// Watch checks the configuration file for changes in the given interval
+func (s *configService) Watch(interval time.Duration) {
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+			info, err := os.Stat(s.configFilename)
+			if err != nil {
+				// The file may just be replaced by an editor
+				continue
+			}
+			s.mu.RLock()
+			changed := s.fileState != fileState{modTime: info.ModTime(), size: info.Size()}
+			s.mu.RUnlock()
+			if changed {
+				s.Reload()
+			}
+		}
+	}()
+}
+
+// StopWatching stops checking the configuration file for changes
+func (s *configService) StopWatching() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
 // Write writes the current application configuration to the default file name
 func (s *configService) Write() error {
 	return s.WriteToFile(s.configFilename)
 }
 
-// WriteToFile writes the current application configuration to a JSON file
+// WriteToFile writes the current application configuration to a JSON file - as read from the configuration file,
+// so the overrides by environment variables and command line flags are not made permanent. The file is replaced
+// atomically and the previous version is kept in the history.
 func (s *configService) WriteToFile(filename string) error {
 	s.logger.Info("Writing configuration file", log.FldFile, filename)
-	f, err := os.Create(filename)
+	conf := s.getFileConfig()
+	data, err := json.MarshalIndent(&conf, "", "    ")
 	if err != nil {
-		return errors.Wrapf(err, "WriteToFile: Cannot open configuration file '%s' to write to", filename)
-	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "    ")
-	conf := s.GetConfig()
-	if err := enc.Encode(&conf); err != nil {
 		return errors.Wrap(err, "WriteToFile: Failed to serialize configuration data")
 	}
-	return nil
+	return s.writeFile(filename, append(data, '\n'))
 }
 
 // GetConfig retuns the current application configuration
 func (s *configService) GetConfig() models.Configuration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getConfig()
+}
+
+// getFileConfig returns the current configuration as read from the configuration file - without the overrides
+func (s *configService) getFileConfig() models.Configuration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.fileConfig != nil {
+		return *s.fileConfig
+	}
+	return s.getConfig()
+}
+
+// getConfig returns the current configuration - the caller has to hold the lock
+func (s *configService) getConfig() models.Configuration {
 	var ret models.Configuration
 	if s.config != nil {
 		ret = *s.config
@@ -0,0 +1,195 @@
+package micasa
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigService(t *testing.T) {
+	Convey("Having a configuration file", t, func() {
+		dir := filepath.Join(os.TempDir(), uuid.NewV4().String())
+		So(os.MkdirAll(dir, 0700), ShouldBeNil)
+		configFile := filepath.Join(dir, "config.json")
+		write := func(content string) {
+			content = strings.Replace(content, "DATADIR", filepath.Join(dir, "data"), -1)
+			So(ioutil.WriteFile(configFile, []byte(content), 0600), ShouldBeNil)
+		}
+		write(`{"dataDir": "DATADIR", "listenAddress": ":3000"}`)
+		cs := NewConfigService(configFile, log.New(kitlog.NewNopLogger(), log.LvlDebug))
+		So(cs.Load(), ShouldBeNil)
+
+		var mu sync.Mutex
+		var changes [][2]models.Configuration
+		cancel := cs.Subscribe(func(old models.Configuration, new models.Configuration) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, [2]models.Configuration{old, new})
+		})
+		received := func() [][2]models.Configuration {
+			mu.Lock()
+			defer mu.Unlock()
+			return changes
+		}
+
+		Convey("reloading a changed file should notify the subscribers", func() {
+			write(`{"dataDir": "DATADIR", "listenAddress": ":4000"}`)
+			So(cs.Reload(), ShouldBeNil)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":4000")
+			So(received(), ShouldHaveLength, 1)
+			So(received()[0][0].ListenAddress, ShouldEqual, ":3000")
+			So(received()[0][1].ListenAddress, ShouldEqual, ":4000")
+		})
+
+		Convey("reloading an unchanged file should not notify the subscribers", func() {
+			So(cs.Reload(), ShouldBeNil)
+			So(received(), ShouldBeEmpty)
+		})
+
+		Convey("an invalid configuration should be rejected", func() {
+			write(`{"dataDir": "DATADIR", "listenAddress": ":4000", "sessions": {"lifetime": -1}}`)
+			So(cs.Reload(), ShouldNotBeNil)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":3000")
+			So(received(), ShouldBeEmpty)
+
+			write(`{"dataDir": `)
+			So(cs.Reload(), ShouldNotBeNil)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":3000")
+		})
+
+		Convey("cancelled subscriptions should not be notified", func() {
+			cancel()
+			write(`{"dataDir": "DATADIR", "listenAddress": ":4000"}`)
+			So(cs.Reload(), ShouldBeNil)
+			So(received(), ShouldBeEmpty)
+		})
+
+		Convey("overrides should take precedence over the file", func() {
+			cs.SetOverrides([]models.ConfigOverride{
+				{Path: "listenAddress", Value: ":4000", Source: models.SourceEnv},
+				{Path: "listenAddress", Value: ":5000", Source: models.SourceFlag},
+			})
+			So(cs.Reload(), ShouldBeNil)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":5000")
+			sources := cs.GetSources()
+			So(sources["listenAddress"], ShouldEqual, models.SourceFlag)
+			So(sources["dataDir"], ShouldEqual, models.SourceFile)
+			So(sources["fhem.address"], ShouldEqual, models.SourceDefault)
+
+			cs.SetOverrides([]models.ConfigOverride{{Path: "fhem.timeout", Value: "0", Source: models.SourceEnv}})
+			So(cs.Reload(), ShouldNotBeNil)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":5000")
+		})
+
+		Convey("writing the configuration should not make the overrides permanent", func() {
+			cs.SetOverrides([]models.ConfigOverride{
+				{Path: "fhem.password", Value: "geheim", Source: models.SourceEnv},
+				{Path: "listenAddress", Value: ":5000", Source: models.SourceFlag},
+			})
+			So(cs.Reload(), ShouldBeNil)
+			So(cs.Write(), ShouldBeNil)
+			data, err := ioutil.ReadFile(configFile)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldNotContainSubstring, "geheim")
+			So(string(data), ShouldContainSubstring, `":3000"`)
+			So(string(data), ShouldNotContainSubstring, ":5000")
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":5000")
+			So(cs.GetSources()["listenAddress"], ShouldEqual, models.SourceFlag)
+		})
+
+		Convey("watching the file should reload it after it has been changed", func() {
+			cs.Watch(10 * time.Millisecond)
+			defer cs.StopWatching()
+			write(`{"dataDir": "DATADIR", "listenAddress": ":5000"}`)
+			for i := 0; i < 100 && len(received()) == 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(received(), ShouldHaveLength, 1)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":5000")
+		})
+
+		Convey("the whitelist index should follow the configuration", func() {
+			So(cs.IsWhitelisted(net.ParseIP("192.168.1.10")), ShouldBeFalse)
+			write(`{"dataDir": "DATADIR", "whitelist": {"addresses": ["192.168.1.0/24", "10.0.0.1"],
+				"trustedProxies": ["::1"]}}`)
+			So(cs.Reload(), ShouldBeNil)
+			So(cs.IsWhitelisted(net.ParseIP("192.168.1.10")), ShouldBeTrue)
+			So(cs.IsWhitelisted(net.ParseIP("10.0.0.1")), ShouldBeTrue)
+			So(cs.IsWhitelisted(net.ParseIP("10.0.0.2")), ShouldBeFalse)
+			So(cs.IsWhitelisted(nil), ShouldBeFalse)
+			So(cs.IsTrustedProxy(net.ParseIP("::1")), ShouldBeTrue)
+			So(cs.IsTrustedProxy(net.ParseIP("10.0.0.1")), ShouldBeFalse)
+
+			write(`{"dataDir": "DATADIR", "whitelist": {"addresses": ["10.0.0.0/8"]}}`)
+			So(cs.Reload(), ShouldBeNil)
+			So(cs.IsWhitelisted(net.ParseIP("192.168.1.10")), ShouldBeFalse)
+			So(cs.IsWhitelisted(net.ParseIP("10.0.0.2")), ShouldBeTrue)
+			So(cs.IsTrustedProxy(net.ParseIP("::1")), ShouldBeFalse)
+		})
+
+		Convey("writing the configuration should keep the previous versions", func() {
+			for i, addr := range []string{":4000", ":5000", ":6000"} {
+				content := `{"dataDir": "DATADIR", "listenAddress": "` + addr + `", "configHistory": 2}`
+				content = strings.Replace(content, "DATADIR", filepath.Join(dir, "data"), -1)
+				// The versions are named after their modification time
+				So(os.Chtimes(configFile, time.Now(), time.Now().Add(time.Duration(i-10)*time.Minute)), ShouldBeNil)
+				So(cs.(*configService).writeFile(configFile, []byte(content)), ShouldBeNil)
+				So(cs.Reload(), ShouldBeNil)
+			}
+			versions, err := cs.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 3)
+			So(versions[0].ID, ShouldEqual, CurrentVersion)
+			So(versions[1].ModifiedAt.After(versions[2].ModifiedAt), ShouldBeTrue)
+
+			changes, err := cs.Diff(versions[2].ID, CurrentVersion)
+			So(err, ShouldBeNil)
+			So(changes, ShouldResemble, []models.ConfigChange{{Path: "listenAddress", Old: ":4000", New: ":6000"}})
+
+			Convey("and rolling back should restore and apply a previous version", func() {
+				So(cs.Rollback(versions[2].ID), ShouldBeNil)
+				So(cs.GetConfig().ListenAddress, ShouldEqual, ":4000")
+				So(received()[len(received())-1][1].ListenAddress, ShouldEqual, ":4000")
+				versions, err := cs.Versions()
+				So(err, ShouldBeNil)
+				So(versions, ShouldHaveLength, 3)
+			})
+
+			Convey("and unknown versions should be rejected", func() {
+				_, err := cs.Diff("20000101-000000.000", CurrentVersion)
+				So(errors.Cause(err), ShouldEqual, repo.ErrNotExisting)
+				So(errors.Cause(cs.Rollback("../config")), ShouldEqual, repo.ErrNotExisting)
+				So(cs.GetConfig().ListenAddress, ShouldEqual, ":6000")
+			})
+		})
+
+		Convey("rolling back to an invalid version should be rejected", func() {
+			write(`{"dataDir": "DATADIR", "sessions": {"lifetime": -1}}`)
+			So(os.Chtimes(configFile, time.Now(), time.Now().Add(-time.Hour)), ShouldBeNil)
+			So(cs.Write(), ShouldBeNil)
+			versions, err := cs.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 2)
+			So(cs.Rollback(versions[1].ID), ShouldNotBeNil)
+			So(cs.GetConfig().ListenAddress, ShouldEqual, ":3000")
+		})
+
+		Reset(func() {
+			cancel()
+			os.RemoveAll(dir)
+		})
+	})
+}
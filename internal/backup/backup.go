@@ -0,0 +1,339 @@
+// Package backup creates and restores backups of MiCasa's database and configuration file.
+//
+// A backup is a ZIP archive inside the "backups" directory of the data directory containing a consistent snapshot of
+// the database - taken using SQLite's online backup API while the database is in use - and a copy of the
+// configuration file.
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DirName is the name of the directory inside the data directory the backups are stored in
+	DirName = "backups"
+	// The names of the files inside a backup archive
+	dbEntry     = "micasa.db"
+	configEntry = "config.json"
+	// The format of the creation time inside the file names
+	timeFormat = "20060102-150405.000"
+)
+
+// Kind describes why a backup has been created
+type Kind string
+
+// The kinds of backups - the retention policy is applied to each kind separately
+const (
+	// KindManual is a backup created on request
+	KindManual Kind = "manual"
+	// KindScheduled is a backup created periodically by the server
+	KindScheduled Kind = "scheduled"
+	// KindMigration is a backup created before the database schema is migrated
+	KindMigration Kind = "migration"
+	// KindRestore is a backup of the current state created before restoring another backup
+	KindRestore Kind = "restore"
+)
+
+// namePattern matches the file names of backups - e.g. "micasa-20261017-020304.567-scheduled.zip"
+var namePattern = regexp.MustCompile(`^micasa-(\d{8}-\d{6}\.\d{3})-([a-z]+)\.zip$`)
+
+// Info describes an existing backup
+type Info struct {
+	// The file name of the backup
+	Name string `json:"name"`
+	// The full path of the backup file
+	Path string `json:"path"`
+	// Why the backup has been created
+	Kind Kind `json:"kind"`
+	// The creation time of the backup
+	CreatedAt time.Time `json:"createdAt"`
+	// The size of the backup file in bytes
+	Size int64 `json:"size"`
+}
+
+// Manager creates backups of a database and a configuration file
+type Manager struct {
+	dir        string
+	db         *sqlx.DB
+	configFile string
+	logger     log.Logger
+	// Serializes the creation and removal of backups
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Dir returns the directory the backups are stored in
+func Dir(dataDir string) string {
+	return filepath.Join(dataDir, DirName)
+}
+
+// New creates a backup manager storing the backups of the database and the configuration file inside the data
+// directory
+func New(dataDir string, db *sqlx.DB, configFile string, logger log.Logger) *Manager {
+	return &Manager{
+		dir:        Dir(dataDir),
+		db:         db,
+		configFile: configFile,
+		logger:     logger,
+	}
+}
+
+// Create creates a new backup of the given kind
+func (m *Manager) Create(kind Kind) (*Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Failed to create the backup directory")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	name := fmt.Sprintf("micasa-%s-%s.zip", now.Format(timeFormat), kind)
+	target := filepath.Join(m.dir, name)
+	if _, err := os.Stat(target); err == nil {
+		return nil, errors.Errorf("Backup '%s' already exists", name)
+	}
+
+	// Take the snapshot of the database first - it is packed into the archive afterwards
+	snapshotFile := target + ".db.tmp"
+	defer os.Remove(snapshotFile)
+	if err := snapshot(m.db, snapshotFile); err != nil {
+		return nil, errors.Wrap(err, "Failed to take a snapshot of the database")
+	}
+
+	tmpFile := target + ".tmp"
+	defer os.Remove(tmpFile)
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the backup file")
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	if err := addFile(zw, dbEntry, snapshotFile); err != nil {
+		return nil, err
+	}
+	if m.configFile != "" {
+		if _, err := os.Stat(m.configFile); err == nil {
+			if err := addFile(zw, configEntry, m.configFile); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Failed to access the configuration file")
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Failed to write the backup file")
+	}
+	if err := f.Sync(); err != nil {
+		return nil, errors.Wrap(err, "Failed to write the backup file")
+	}
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrap(err, "Failed to write the backup file")
+	}
+	if err := os.Rename(tmpFile, target); err != nil {
+		return nil, errors.Wrap(err, "Failed to store the backup file")
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to access the backup file")
+	}
+	m.logger.Info(fmt.Sprintf("Created %s backup", kind), log.FldFile, target)
+	return &Info{Name: name, Path: target, Kind: kind, CreatedAt: now, Size: info.Size()}, nil
+}
+
+// snapshot copies the database into the given file using SQLite's online backup API
+func snapshot(db *sqlx.DB, dest string) error {
+	ctx := context.Background()
+	src, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	dst, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return dst.Raw(func(destConn interface{}) error {
+		return src.Raw(func(srcConn interface{}) error {
+			d, ok := destConn.(*sqlite3.SQLiteConn)
+			s, ok2 := srcConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("Not an SQLite database")
+			}
+			bk, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := bk.Step(-1); err != nil {
+				bk.Finish()
+				return err
+			}
+			return bk.Finish()
+		})
+	})
+}
+
+// addFile adds the contents of a file to the archive
+func addFile(zw *zip.Writer, name string, filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open '%s'", filename)
+	}
+	defer src.Close()
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return errors.Wrap(err, "Failed to write the backup file")
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return errors.Wrapf(err, "Failed to add '%s' to the backup", filename)
+	}
+	return nil
+}
+
+// List returns all backups - the newest first
+func (m *Manager) List() ([]*Info, error) {
+	return List(filepath.Dir(m.dir))
+}
+
+// List returns all backups stored inside the given data directory - the newest first
+func List(dataDir string) ([]*Info, error) {
+	dir := Dir(dataDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Info{}, nil
+		}
+		return nil, errors.Wrap(err, "Failed to read the backup directory")
+	}
+	res := []*Info{}
+	for _, e := range entries {
+		match := namePattern.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		createdAt, err := time.Parse(timeFormat, match[1])
+		if err != nil {
+			continue
+		}
+		res = append(res, &Info{
+			Name:      e.Name(),
+			Path:      filepath.Join(dir, e.Name()),
+			Kind:      Kind(match[2]),
+			CreatedAt: createdAt,
+			Size:      e.Size(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+// Prune removes the oldest backups of the given kind, so only the newest keep backups remain - keep values below 1 do
+// not remove anything
+func (m *Manager) Prune(kind Kind, keep int) error {
+	if keep < 1 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list, err := m.List()
+	if err != nil {
+		return err
+	}
+	found := 0
+	for _, b := range list {
+		if b.Kind != kind {
+			continue
+		}
+		found++
+		if found <= keep {
+			continue
+		}
+		if err := os.Remove(b.Path); err != nil {
+			return errors.Wrapf(err, "Failed to remove backup '%s'", b.Name)
+		}
+		m.logger.Info("Removed old backup", log.FldFile, b.Path)
+	}
+	return nil
+}
+
+// Start creates scheduled backups in the given interval until Stop is called - keeping the newest ones. If the last
+// scheduled backup is older than the interval, a backup is created right away.
+func (m *Manager) Start(interval time.Duration, keep int) {
+	if interval <= 0 || m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.schedule(interval, keep)
+}
+
+// Stop stops creating scheduled backups - a backup currently being created is finished first
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// schedule is the loop creating the scheduled backups
+func (m *Manager) schedule(interval time.Duration, keep int) {
+	defer close(m.done)
+	var wait time.Duration
+	if last := m.lastScheduled(); !last.IsZero() {
+		wait = interval - time.Since(last)
+	}
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-m.stop:
+			timer.Stop()
+			return
+		}
+		if _, err := m.Create(KindScheduled); err != nil {
+			m.logger.Error("Failed to create scheduled backup", err)
+		} else if err := m.Prune(KindScheduled, keep); err != nil {
+			m.logger.Error("Failed to remove old backups", err)
+		}
+		wait = interval
+	}
+}
+
+// lastScheduled returns the creation time of the newest scheduled backup
+func (m *Manager) lastScheduled() time.Time {
+	list, err := m.List()
+	if err != nil {
+		m.logger.Error("Failed to list the existing backups", err)
+	}
+	for _, b := range list {
+		if b.Kind == KindScheduled {
+			return b.CreatedAt
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,183 @@
+package backup_test
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/backup"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/migrate"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3" // Just needed for the sqlite driver
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var testDir = filepath.Join(os.TempDir(), uuid.NewV4().String())
+
+func setupTestDB(logger log.Logger) (*sqlx.DB, error) {
+	teardownTestDB(nil)
+	if err := os.MkdirAll(testDir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Open("sqlite3", filepath.Join(testDir, "micasa.db"))
+	if err != nil {
+		return nil, err
+	}
+	if err = migrate.ExecuteMigrationsOnDb(db, logger); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func teardownTestDB(db *sqlx.DB) {
+	if db != nil {
+		db.Close()
+	}
+	os.RemoveAll(testDir)
+}
+
+// userNames returns the names of all users inside the given database file
+func userNames(dbFile string) []string {
+	db, err := sqlx.Open("sqlite3", dbFile)
+	So(err, ShouldBeNil)
+	defer db.Close()
+	names := []string{}
+	So(db.Select(&names, `SELECT name FROM Users ORDER BY name`), ShouldBeNil)
+	return names
+}
+
+func TestBackups(t *testing.T) {
+	Convey("Having a database and a configuration file", t, func() {
+		logger := log.New(kitlog.NewNopLogger(), log.LvlDebug)
+		db, err := setupTestDB(logger)
+		So(err, ShouldBeNil)
+		_, err = db.Exec(`INSERT INTO Users(userid, name) VALUES('1', 'amy')`)
+		So(err, ShouldBeNil)
+		dbFile := filepath.Join(testDir, "micasa.db")
+		configFile := filepath.Join(testDir, "config.json")
+		So(ioutil.WriteFile(configFile, []byte(`{"listenAddress": ":3000"}`), 0600), ShouldBeNil)
+		m := backup.New(testDir, db, configFile, logger)
+
+		Convey("creating a backup should store the database and the configuration file", func() {
+			info, err := m.Create(backup.KindManual)
+			So(err, ShouldBeNil)
+			So(info.Kind, ShouldEqual, backup.KindManual)
+			So(filepath.Dir(info.Path), ShouldEqual, backup.Dir(testDir))
+			So(info.Size, ShouldBeGreaterThan, 0)
+			zr, err := zip.OpenReader(info.Path)
+			So(err, ShouldBeNil)
+			names := []string{}
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+			}
+			zr.Close()
+			So(names, ShouldResemble, []string{"micasa.db", "config.json"})
+
+			Convey("and it should be listed", func() {
+				list, err := m.List()
+				So(err, ShouldBeNil)
+				So(list, ShouldHaveLength, 1)
+				So(list[0].Name, ShouldEqual, info.Name)
+				So(list[0].CreatedAt.Equal(info.CreatedAt), ShouldBeTrue)
+			})
+
+			Convey("restoring it should bring back the old state", func() {
+				_, err := db.Exec(`INSERT INTO Users(userid, name) VALUES('2', 'rory')`)
+				So(err, ShouldBeNil)
+				So(ioutil.WriteFile(configFile, []byte(`{}`), 0600), ShouldBeNil)
+				db.Close()
+
+				restored, err := backup.Restore(info.Path, dbFile, configFile)
+				So(err, ShouldBeNil)
+				So(restored, ShouldBeTrue)
+				So(userNames(dbFile), ShouldResemble, []string{"amy"})
+				data, err := ioutil.ReadFile(configFile)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, `{"listenAddress": ":3000"}`)
+			})
+
+			Convey("failing to replace the database should keep the configuration file", func() {
+				So(ioutil.WriteFile(configFile, []byte(`{}`), 0600), ShouldBeNil)
+				// A directory which is not empty cannot be replaced by the database
+				blocked := filepath.Join(testDir, "blocked.db")
+				So(os.MkdirAll(filepath.Join(blocked, "data"), 0700), ShouldBeNil)
+
+				_, err := backup.Restore(info.Path, blocked, configFile)
+				So(err, ShouldNotBeNil)
+				data, err := ioutil.ReadFile(configFile)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, `{}`)
+				_, err = os.Stat(configFile + ".restore.old")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("restoring it without configuration file should only restore the database", func() {
+				So(ioutil.WriteFile(configFile, []byte(`{}`), 0600), ShouldBeNil)
+				db.Close()
+
+				restored, err := backup.Restore(info.Path, dbFile, "")
+				So(err, ShouldBeNil)
+				So(restored, ShouldBeFalse)
+				data, err := ioutil.ReadFile(configFile)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, `{}`)
+			})
+		})
+
+		Convey("restoring a damaged backup should not touch the database", func() {
+			broken := filepath.Join(testDir, "broken.zip")
+			f, err := os.Create(broken)
+			So(err, ShouldBeNil)
+			zw := zip.NewWriter(f)
+			w, err := zw.Create("micasa.db")
+			So(err, ShouldBeNil)
+			w.Write([]byte("This is no database"))
+			So(zw.Close(), ShouldBeNil)
+			f.Close()
+			db.Close()
+
+			_, err = backup.Restore(broken, dbFile, configFile)
+			So(err, ShouldNotBeNil)
+			So(userNames(dbFile), ShouldResemble, []string{"amy"})
+		})
+
+		Convey("pruning should only keep the newest backups of the given kind", func() {
+			var created []*backup.Info
+			for i := 0; i < 3; i++ {
+				info, err := m.Create(backup.KindScheduled)
+				So(err, ShouldBeNil)
+				created = append(created, info)
+				time.Sleep(5 * time.Millisecond)
+			}
+			_, err := m.Create(backup.KindMigration)
+			So(err, ShouldBeNil)
+			So(m.Prune(backup.KindScheduled, 2), ShouldBeNil)
+			list, err := m.List()
+			So(err, ShouldBeNil)
+			So(list, ShouldHaveLength, 3)
+			So(list[0].Kind, ShouldEqual, backup.KindMigration)
+			So(list[1].Name, ShouldEqual, created[2].Name)
+			So(list[2].Name, ShouldEqual, created[1].Name)
+		})
+
+		Convey("starting the scheduler should create backups periodically", func() {
+			m.Start(50*time.Millisecond, 2)
+			time.Sleep(180 * time.Millisecond)
+			m.Stop()
+			list, err := m.List()
+			So(err, ShouldBeNil)
+			So(list, ShouldHaveLength, 2)
+			So(list[0].Kind, ShouldEqual, backup.KindScheduled)
+		})
+
+		Reset(func() {
+			teardownTestDB(db)
+		})
+	})
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Restore replaces the database file by the database inside the given backup. If configFile is set and the backup
+// contains a configuration file, the configuration file is replaced, too - the result reports whether this has been
+// done. The database must not be in use while it is restored.
+func Restore(backupFile string, dbFile string, configFile string) (configRestored bool, err error) {
+	zr, err := zip.OpenReader(backupFile)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to open the backup")
+	}
+	defer zr.Close()
+	var dbSrc, configSrc *zip.File
+	for _, f := range zr.File {
+		switch f.Name {
+		case dbEntry:
+			dbSrc = f
+		case configEntry:
+			configSrc = f
+		}
+	}
+	if dbSrc == nil {
+		return false, errors.New("The backup does not contain a database")
+	}
+
+	// Extract and check everything before replacing anything
+	dbTmp := dbFile + ".restore.tmp"
+	defer os.Remove(dbTmp)
+	if err := extract(dbSrc, dbTmp); err != nil {
+		return false, err
+	}
+	if err := checkDatabase(dbTmp); err != nil {
+		return false, err
+	}
+	restoreConfig := configFile != "" && configSrc != nil
+	configTmp := configFile + ".restore.tmp"
+	if restoreConfig {
+		defer os.Remove(configTmp)
+		if err := extract(configSrc, configTmp); err != nil {
+			return false, err
+		}
+		data, err := ioutil.ReadFile(configTmp)
+		if err != nil {
+			return false, errors.Wrap(err, "Failed to read the configuration file of the backup")
+		}
+		if !json.Valid(data) {
+			return false, errors.New("The configuration file inside the backup is damaged")
+		}
+	}
+
+	// The configuration file is replaced first - unlike the database, it can be put back if replacing the other one
+	// fails
+	configOld := configFile + ".restore.old"
+	if restoreConfig {
+		if err := os.Rename(configFile, configOld); err != nil && !os.IsNotExist(err) {
+			return false, errors.Wrap(err, "Failed to replace the configuration file")
+		}
+		if err := os.Rename(configTmp, configFile); err != nil {
+			os.Rename(configOld, configFile)
+			return false, errors.Wrap(err, "Failed to replace the configuration file")
+		}
+	}
+	if err := replaceDatabase(dbTmp, dbFile); err != nil {
+		if restoreConfig {
+			if _, statErr := os.Stat(configOld); os.IsNotExist(statErr) {
+				// There has been no configuration file before
+				os.Remove(configFile)
+			} else if renameErr := os.Rename(configOld, configFile); renameErr != nil {
+				return false, errors.Wrapf(
+					err,
+					"The configuration file has been restored, but not the database - the previous configuration file "+
+						"is kept as '%s'",
+					configOld,
+				)
+			}
+		}
+		return false, err
+	}
+	if restoreConfig {
+		os.Remove(configOld)
+	}
+	return restoreConfig, nil
+}
+
+// replaceDatabase replaces the database file by the given one
+func replaceDatabase(newFile string, dbFile string) error {
+	// Leftovers of the old database would be applied to the restored one
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(dbFile + suffix); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Failed to remove the journal of the current database")
+		}
+	}
+	if err := os.Rename(newFile, dbFile); err != nil {
+		return errors.Wrap(err, "Failed to replace the database")
+	}
+	return nil
+}
+
+// extract writes the contents of an archived file to the given file
+func extract(src *zip.File, filename string) error {
+	r, err := src.Open()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read '%s' from the backup", src.Name)
+	}
+	defer r.Close()
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s'", filename)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "Failed to extract '%s' from the backup", src.Name)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", filename)
+	}
+	return f.Close()
+}
+
+// checkDatabase verifies the integrity of the given database file
+func checkDatabase(filename string) error {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open the database of the backup")
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return errors.Wrap(err, "The database inside the backup is damaged")
+	}
+	if result != "ok" {
+		return errors.Errorf("The database inside the backup is damaged: %s", result)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Package events provides an in-process publish/subscribe bus for distributing FHEM events inside MiCasa
+package events
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+)
+
+// DefaultBufferSize is the default number of events buffered for each subscription
+const DefaultBufferSize = 64
+
+// Event is a single change event emitted by FHEM
+type Event struct {
+	// The name of the device that emitted the event
+	Device string `json:"device"`
+	// The TYPE of the device
+	Type string `json:"type"`
+	// The name of the reading that has changed - `state` for plain state events
+	Reading string `json:"reading"`
+	// The new value of the reading
+	Value string `json:"value"`
+	// The time the event has been emitted
+	Time time.Time `json:"time"`
+}
+
+// Filter selects the events a subscriber is interested in. Device and reading names may contain shell-style
+// wildcards like `*` and `?`. Empty lists match everything.
+type Filter struct {
+	Devices  []string
+	Readings []string
+	// Func is an additional condition the events have to fulfill - if set. It is called while publishing, so it must
+	// not block.
+	Func func(Event) bool
+}
+
+// matchAny checks if the value matches one of the patterns - an empty pattern list matches everything
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, err := path.Match(p, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches checks if the given event passes the filter
+func (f Filter) Matches(e Event) bool {
+	return matchAny(f.Devices, e.Device) && matchAny(f.Readings, e.Reading) && (f.Func == nil || f.Func(e))
+}
+
+// Subscription is a subscriber's connection to the bus. Events are delivered through its channel C.
+type Subscription struct {
+	// C is the channel the subscriber receives its events from
+	C       <-chan Event
+	ch      chan Event
+	bus     *Bus
+	filter  Filter
+	dropped uint64
+	once    sync.Once
+}
+
+// Dropped returns the number of events that could not be delivered because the subscriber did not keep up
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe removes the subscription from the bus and closes its channel
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
+
+// Bus distributes published events to all subscribers whose filter matches.
+// Publishing never blocks: if a subscriber's buffer is full, the event is dropped for that subscriber only.
+type Bus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	logger log.Logger
+}
+
+// NewBus creates a new event bus
+func NewBus(logger log.Logger) *Bus {
+	return &Bus{
+		subs:   make(map[*Subscription]struct{}),
+		logger: logger,
+	}
+}
+
+// Subscribe registers a new subscriber for all events matching the filter. The subscription buffers up to bufferSize
+// events - a value of 0 uses the default buffer size.
+func (b *Bus) Subscribe(filter Filter, bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	ch := make(chan Event, bufferSize)
+	s := &Subscription{C: ch, ch: ch, bus: b, filter: filter}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Publish sends the event to all matching subscribers
+func (b *Bus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.filter.Matches(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			if atomic.AddUint64(&s.dropped, 1) == 1 {
+				b.logger.Warn("Subscriber does not keep up with the events - dropping events")
+			}
+		}
+	}
+}
+
+// Close removes all subscriptions from the bus
+func (b *Bus) Close() {
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.RUnlock()
+	for _, s := range subs {
+		s.Unsubscribe()
+	}
+}
@@ -0,0 +1,60 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/log"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBus(t *testing.T) {
+	Convey("Having an event bus", t, func() {
+		bus := events.NewBus(log.New(kitlog.NewNopLogger(), log.LvlDebug))
+
+		Convey("Filters should select events by device and reading", func() {
+			sub := bus.Subscribe(events.Filter{Devices: []string{"lamp*"}, Readings: []string{"state"}}, 10)
+			bus.Publish(events.Event{Device: "lamp1", Reading: "state", Value: "on"})
+			bus.Publish(events.Event{Device: "lamp1", Reading: "brightness", Value: "50"})
+			bus.Publish(events.Event{Device: "heater", Reading: "state", Value: "on"})
+			bus.Publish(events.Event{Device: "lamp2", Reading: "state", Value: "off"})
+			So(len(sub.C), ShouldEqual, 2)
+			So((<-sub.C).Device, ShouldEqual, "lamp1")
+			So((<-sub.C).Device, ShouldEqual, "lamp2")
+		})
+
+		Convey("Events rejected by the function of a filter should neither be delivered nor dropped", func() {
+			sub := bus.Subscribe(events.Filter{Func: func(e events.Event) bool { return e.Value == "on" }}, 1)
+			bus.Publish(events.Event{Device: "lamp", Value: "on"})
+			bus.Publish(events.Event{Device: "lamp", Value: "off"})
+			So(len(sub.C), ShouldEqual, 1)
+			So(sub.Dropped(), ShouldEqual, 0)
+		})
+
+		Convey("Slow subscribers should lose events without blocking the publisher", func() {
+			slow := bus.Subscribe(events.Filter{}, 2)
+			fast := bus.Subscribe(events.Filter{}, 10)
+			for i := 0; i < 5; i++ {
+				bus.Publish(events.Event{Device: "lamp"})
+			}
+			So(len(slow.C), ShouldEqual, 2)
+			So(slow.Dropped(), ShouldEqual, 3)
+			So(len(fast.C), ShouldEqual, 5)
+			So(fast.Dropped(), ShouldEqual, 0)
+		})
+
+		Convey("Unsubscribing should close the channel", func() {
+			sub := bus.Subscribe(events.Filter{}, 0)
+			sub.Unsubscribe()
+			sub.Unsubscribe()
+			bus.Publish(events.Event{Device: "lamp"})
+			_, open := <-sub.C
+			So(open, ShouldBeFalse)
+		})
+
+		Reset(func() {
+			bus.Close()
+		})
+	})
+}
@@ -0,0 +1,33 @@
+package fhem
+
+import "time"
+
+const minReconnectDelay = 500 * time.Millisecond
+
+// backoff calculates exponentially increasing delays between reconnection attempts
+type backoff struct {
+	max     time.Duration
+	current time.Duration
+}
+
+func newBackoff(max time.Duration) *backoff {
+	if max < minReconnectDelay {
+		max = minReconnectDelay
+	}
+	return &backoff{max: max}
+}
+
+// next returns the delay to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = minReconnectDelay
+	} else if b.current *= 2; b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+// reset starts over with the minimum delay
+func (b *backoff) reset() {
+	b.current = 0
+}
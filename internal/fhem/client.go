@@ -0,0 +1,399 @@
+// Package fhem provides access to a FHEM server via its telnet port
+package fhem
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	passwordPrompt = "Password: "
+	// Longest greeting accepted before the password prompt
+	maxGreetingSize = 1024
+	// Prefix of the marker that is echoed by FHEM after each command to detect the end of the command output
+	markerPrefix = "micasa-eoc-"
+)
+
+// Telnet commands sent by FHEM around the password prompt - e.g. IAC WILL ECHO for hiding the password
+const (
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIAC  = 255
+)
+
+var (
+	// ErrInvalidCommand is returned when a command cannot be sent to FHEM because it contains line breaks
+	ErrInvalidCommand = errors.New("Commands must not contain line breaks")
+	// ErrUnescapedSeparator is returned when a command contains a `;` which would make FHEM run the rest of the line
+	// as another command - a literal `;` has to be escaped as `;;`
+	ErrUnescapedSeparator = errors.New("Commands must not contain unescaped command separators")
+	// ErrClosed is returned when a command is executed on a client which has already been closed
+	ErrClosed = errors.New("FHEM client has been closed")
+)
+
+// CommandError is returned when FHEM responds to a command that normally has no output with an error message
+type CommandError struct {
+	Command string
+	Message string
+}
+
+// Error returns the error message
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("FHEM command '%s' failed: %s", e.Command, e.Message)
+}
+
+// conn is a single telnet connection to FHEM
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// dial opens a new telnet connection to FHEM and authenticates if a password is configured
+func dial(ctx context.Context, cfg models.FhemConfig) (*conn, error) {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+	var nc net.Conn
+	var err error
+	if cfg.TLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}}
+		nc, err = tlsDialer.DialContext(ctx, "tcp", cfg.Address)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", cfg.Address)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot connect to FHEM at '%s'", cfg.Address)
+	}
+	c := &conn{Conn: nc, reader: bufio.NewReader(nc)}
+	if cfg.Password != "" {
+		if err := c.authenticate(cfg.Password, timeout); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// authenticate waits for FHEM's password prompt and answers it. FHEM confirms a correct password by a line break
+// and closes the connection otherwise.
+func (c *conn) authenticate(password string, timeout time.Duration) error {
+	c.SetDeadline(time.Now().Add(timeout))
+	defer c.SetDeadline(time.Time{})
+	var greeting []byte
+	for !strings.HasSuffix(string(greeting), passwordPrompt) {
+		if len(greeting) >= maxGreetingSize {
+			return errors.Errorf("Unexpected greeting from FHEM: '%s'", greeting)
+		}
+		b, err := c.readByte()
+		if err != nil {
+			return errors.Wrap(err, "Failed to read the password prompt from FHEM")
+		}
+		greeting = append(greeting, b)
+	}
+	if _, err := fmt.Fprintf(c, "%s\n", password); err != nil {
+		return errors.Wrap(err, "Failed to send the password to FHEM")
+	}
+	// Consume the confirmation, so it does not end up in the output of the first command
+	for {
+		b, err := c.readByte()
+		if err != nil {
+			return errors.Wrap(err, "FHEM has rejected the password")
+		}
+		if b == '\n' {
+			return nil
+		}
+		if b != '\r' {
+			return errors.Errorf("Unexpected answer from FHEM to the password: '%c'", b)
+		}
+	}
+}
+
+// readByte reads the next byte sent by FHEM - telnet commands are skipped
+func (c *conn) readByte() (byte, error) {
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil || b != telnetIAC {
+			return b, err
+		}
+		cmd, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch cmd {
+		case telnetIAC:
+			// An escaped data byte
+			return cmd, nil
+		case telnetWill, telnetWont, telnetDo, telnetDont:
+			// Followed by the option negotiated
+			if _, err := c.reader.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// execute sends a command to FHEM and reads its output - the end of the output is detected by echoing a marker
+// string right after the command
+func (c *conn) execute(cmd string, marker string, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+	if _, err := fmt.Fprintf(c, "%s\n{\"%s\"}\n", cmd, marker); err != nil {
+		return "", errors.Wrap(err, "Failed to send command to FHEM")
+	}
+	var lines []string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to read command output from FHEM")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasSuffix(line, marker) {
+			// The password prompt answer or telnet prompts may precede the marker on the same line
+			if prefix := strings.TrimSuffix(line, marker); strings.TrimSpace(prefix) != "" {
+				lines = append(lines, prefix)
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// Client executes commands on a FHEM server using its telnet port.
+// The connection is established lazily and re-established with an increasing delay when it breaks - for example
+// because FHEM has been restarted. The client is safe for concurrent use; commands are executed one after another.
+type Client struct {
+	logger log.Logger
+	// Guards the settings and the state of the connection - it is never held while connecting or waiting for FHEM
+	mu      sync.Mutex
+	cfg     models.FhemConfig
+	conn    *conn
+	backoff *backoff
+	counter uint64
+	closed  bool
+	// Closed when the settings change or the client is closed - this ends waiting for the next connection attempt
+	changed chan struct{}
+	// Makes sure that only one command at a time is sent over the connection
+	execMu sync.Mutex
+}
+
+// NewClient creates a new FHEM client using the given connection settings
+func NewClient(cfg models.FhemConfig, logger log.Logger) *Client {
+	return &Client{
+		cfg:     cfg,
+		logger:  logger,
+		backoff: newBackoff(time.Duration(cfg.MaxReconnectDelay) * time.Second),
+		changed: make(chan struct{}),
+	}
+}
+
+// connect returns the open connection or establishes a new one - retrying with backoff until the context is done.
+// It also returns whether an existing connection is reused.
+func (c *Client) connect(ctx context.Context) (*conn, bool, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, false, ErrClosed
+		}
+		if c.conn != nil {
+			conn := c.conn
+			c.mu.Unlock()
+			return conn, true, nil
+		}
+		cfg, changed := c.cfg, c.changed
+		c.mu.Unlock()
+
+		conn, err := dial(ctx, cfg)
+		c.mu.Lock()
+		if err == nil {
+			if c.closed || c.changed != changed || c.conn != nil {
+				// The connection is outdated already - or another command has connected in the meantime
+				c.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			c.logger.Info("Connected to FHEM", log.FldAddress, cfg.Address)
+			c.conn = conn
+			c.backoff.reset()
+			c.mu.Unlock()
+			return conn, false, nil
+		}
+		delay := c.backoff.next()
+		c.mu.Unlock()
+		c.logger.Warn("Connecting to FHEM has failed - retrying", log.FldError, err, log.FldDuration, delay)
+		select {
+		case <-ctx.Done():
+			return nil, false, errors.Wrapf(ctx.Err(), "Giving up connecting to FHEM (%v)", err)
+		case <-changed:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// disconnect closes the current connection - the caller has to hold the lock
+func (c *Client) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// dropConnection closes a broken connection - unless it has already been replaced
+func (c *Client) dropConnection(conn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		c.disconnect()
+	}
+}
+
+// notifyChanged wakes up all commands waiting for the next connection attempt - the caller has to hold the lock
+func (c *Client) notifyChanged() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// executeOn sends the command over the given connection and returns its output
+func (c *Client) executeOn(conn *conn, cmd string) (string, error) {
+	c.execMu.Lock()
+	defer c.execMu.Unlock()
+	c.mu.Lock()
+	c.counter++
+	marker := fmt.Sprintf("%s%d", markerPrefix, c.counter)
+	timeout := time.Duration(c.cfg.Timeout) * time.Second
+	c.mu.Unlock()
+	return conn.execute(cmd, marker, timeout)
+}
+
+// Execute runs the given FHEM command and returns its raw output. The command must be a single line and must not
+// contain further commands separated by `;` - a literal `;` has to be escaped as `;;`.
+func (c *Client) Execute(ctx context.Context, cmd string) (string, error) {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return "", ErrInvalidCommand
+	}
+	if hasUnescapedSeparator(cmd) {
+		return "", ErrUnescapedSeparator
+	}
+	// A connection that has been idle for a while may have been closed by FHEM in the meantime - so retry once
+	// with a fresh connection if a reused one fails
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := c.connect(ctx)
+		if err != nil {
+			return "", err
+		}
+		out, err := c.executeOn(conn, cmd)
+		if err == nil {
+			return out, nil
+		}
+		c.dropConnection(conn)
+		if !reused || attempt > 0 {
+			return "", err
+		}
+		c.logger.Debug("FHEM connection seems to be stale - reconnecting", log.FldError, err)
+	}
+}
+
+// executeSilent runs a command which is expected to have no output - any output is considered to be an error
+func (c *Client) executeSilent(ctx context.Context, cmd string) error {
+	out, err := c.Execute(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		return &CommandError{Command: cmd, Message: out}
+	}
+	return nil
+}
+
+// Set executes a `set` command on the given device specification
+func (c *Client) Set(ctx context.Context, devspec string, args ...string) error {
+	return c.executeSilent(ctx, buildCommand("set", append([]string{devspec}, args...)...))
+}
+
+// Get executes a `get` command on the given device specification and returns its output
+func (c *Client) Get(ctx context.Context, devspec string, args ...string) (string, error) {
+	return c.Execute(ctx, buildCommand("get", append([]string{devspec}, args...)...))
+}
+
+// Attr sets the attribute of the given device specification to the given value
+func (c *Client) Attr(ctx context.Context, devspec string, attr string, value string) error {
+	return c.executeSilent(ctx, buildCommand("attr", devspec, attr, value))
+}
+
+// DeleteAttr removes the attribute from the given device specification
+func (c *Client) DeleteAttr(ctx context.Context, devspec string, attr string) error {
+	return c.executeSilent(ctx, buildCommand("deleteattr", devspec, attr))
+}
+
+// JSONList2 runs `jsonlist2` for the given device specification and returns the parsed result.
+// An empty device specification returns all devices.
+func (c *Client) JSONList2(ctx context.Context, devspec string) (*JSONList2, error) {
+	out, err := c.Execute(ctx, buildCommand("jsonlist2", devspec))
+	if err != nil {
+		return nil, err
+	}
+	return ParseJSONList2(out)
+}
+
+// UpdateConfig changes the connection settings - the current connection is closed, so the next command connects
+// using the new settings. Commands waiting for FHEM to become reachable try the new settings right away.
+func (c *Client) UpdateConfig(cfg models.FhemConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+	c.backoff = newBackoff(time.Duration(cfg.MaxReconnectDelay) * time.Second)
+	c.disconnect()
+	c.notifyChanged()
+}
+
+// Close closes the connection to FHEM - the client cannot be used afterwards. Commands waiting for FHEM to become
+// reachable fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.disconnect()
+	c.notifyChanged()
+	return nil
+}
+
+// hasUnescapedSeparator checks whether the command contains a `;` which is not part of an escaped `;;`
+func hasUnescapedSeparator(cmd string) bool {
+	run := 0
+	for _, r := range cmd + " " {
+		if r == ';' {
+			run++
+			continue
+		}
+		if run%2 != 0 {
+			return true
+		}
+		run = 0
+	}
+	return false
+}
+
+// buildCommand joins the command parts, leaving out empty ones
+func buildCommand(cmd string, parts ...string) string {
+	res := []string{cmd}
+	for _, p := range parts {
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return strings.Join(res, " ")
+}
@@ -0,0 +1,205 @@
+package fhem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testJSONList = `{
+  "Arg":"lamp",
+  "Results": [
+  {
+    "Name":"lamp",
+    "PossibleSets":"on off toggle",
+    "PossibleAttrs":"room alias",
+    "Internals": { "NAME": "lamp", "TYPE": "dummy", "NR": 42 },
+    "Readings": { "state": { "Value":"on", "Time":"2017-11-29 20:15:00" } },
+    "Attributes": { "room": "Living" }
+  }  ],
+  "totalResultsReturned":1
+}`
+
+func TestClient(t *testing.T) {
+	Convey("Having a fake FHEM server", t, func() {
+		fake := newFakeFhem("", map[string]string{
+			"get lamp status":    "on",
+			"jsonlist2 lamp":     testJSONList,
+			"set broken on":      "Unknown argument on, choose one of off",
+			"list multi":         "line 1\nline 2",
+			"jsonlist2 nonsense": "No device named nonsense found",
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		Convey("Having a client connected to it", func() {
+			c := NewClient(fake.config(), createTestLogger(t))
+
+			Convey("Executing commands should return their output", func() {
+				out, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldBeNil)
+				So(out, ShouldEqual, "on")
+				out, err = c.Execute(ctx, "list multi")
+				So(err, ShouldBeNil)
+				So(out, ShouldEqual, "line 1\nline 2")
+				So(fake.acceptedConnections(), ShouldEqual, 1)
+			})
+
+			Convey("Set commands without output should succeed", func() {
+				So(c.Set(ctx, "lamp", "on"), ShouldBeNil)
+				So(c.Attr(ctx, "lamp", "room", "Kitchen"), ShouldBeNil)
+				So(fake.receivedCommands(), ShouldResemble, []string{"set lamp on", "attr lamp room Kitchen"})
+			})
+
+			Convey("Set commands with output should fail", func() {
+				err := c.Set(ctx, "broken", "on")
+				So(err, ShouldHaveSameTypeAs, &CommandError{})
+				So(err.(*CommandError).Message, ShouldStartWith, "Unknown argument")
+			})
+
+			Convey("Commands with line breaks should be rejected", func() {
+				_, err := c.Execute(ctx, "set lamp on\nshutdown")
+				So(err, ShouldEqual, ErrInvalidCommand)
+			})
+
+			Convey("Commands with unescaped separators should be rejected", func() {
+				So(c.Set(ctx, "lamp", "on;", "{system('shutdown')}"), ShouldEqual, ErrUnescapedSeparator)
+				So(c.Set(ctx, "lamp", "on", ";;;shutdown"), ShouldEqual, ErrUnescapedSeparator)
+				_, err := c.Execute(ctx, "set lamp on; shutdown")
+				So(err, ShouldEqual, ErrUnescapedSeparator)
+				So(fake.receivedCommands(), ShouldBeEmpty)
+				So(c.Attr(ctx, "lamp", "comment", "on;;off"), ShouldBeNil)
+				So(fake.receivedCommands(), ShouldResemble, []string{"attr lamp comment on;;off"})
+			})
+
+			Convey("jsonlist2 output should be parsed", func() {
+				res, err := c.JSONList2(ctx, "lamp")
+				So(err, ShouldBeNil)
+				So(res.TotalResultsReturned, ShouldEqual, 1)
+				So(res.Results, ShouldHaveLength, 1)
+				dev := res.Results[0]
+				So(dev.Name, ShouldEqual, "lamp")
+				So(dev.Internals["TYPE"], ShouldEqual, Value("dummy"))
+				So(dev.Internals["NR"], ShouldEqual, Value("42"))
+				So(dev.Readings["state"].Value, ShouldEqual, Value("on"))
+				ts, err := dev.Readings["state"].Timestamp()
+				So(err, ShouldBeNil)
+				So(ts.Hour(), ShouldEqual, 20)
+				So(dev.Attributes["room"], ShouldEqual, Value("Living"))
+			})
+
+			Convey("jsonlist2 errors should be reported", func() {
+				_, err := c.JSONList2(ctx, "nonsense")
+				So(err, ShouldHaveSameTypeAs, &CommandError{})
+			})
+
+			Convey("The client should reconnect after FHEM has been restarted", func() {
+				_, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldBeNil)
+				fake.dropConnections()
+				out, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldBeNil)
+				So(out, ShouldEqual, "on")
+				So(fake.acceptedConnections(), ShouldEqual, 2)
+			})
+
+			Convey("Changing the settings should connect to the new server", func() {
+				_, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldBeNil)
+				other := newFakeFhem("", map[string]string{"get lamp status": "off"})
+				defer other.close()
+				c.UpdateConfig(other.config())
+				out, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldBeNil)
+				So(out, ShouldEqual, "off")
+				So(other.acceptedConnections(), ShouldEqual, 1)
+			})
+
+			Convey("A closed client should refuse to execute commands", func() {
+				So(c.Close(), ShouldBeNil)
+				_, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldEqual, ErrClosed)
+			})
+
+			Reset(func() {
+				c.Close()
+			})
+		})
+
+		Convey("Having a client waiting for an unreachable FHEM", func() {
+			down := newFakeFhem("", nil)
+			cfg := down.config()
+			down.close()
+			c := NewClient(cfg, createTestLogger(t))
+			errs := make(chan error, 1)
+			go func() {
+				_, err := c.Get(ctx, "lamp", "status")
+				errs <- err
+			}()
+			// Let the first attempt fail
+			time.Sleep(100 * time.Millisecond)
+			result := func() error {
+				select {
+				case err := <-errs:
+					return err
+				case <-time.After(time.Second):
+					return errors.New("Still waiting")
+				}
+			}
+
+			Convey("closing it should not wait for the reconnection", func() {
+				start := time.Now()
+				So(c.Close(), ShouldBeNil)
+				So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+				So(result(), ShouldEqual, ErrClosed)
+			})
+
+			Convey("changing the settings should connect to the new server right away", func() {
+				c.UpdateConfig(fake.config())
+				So(result(), ShouldBeNil)
+				So(fake.acceptedConnections(), ShouldEqual, 1)
+			})
+
+			Reset(func() {
+				c.Close()
+			})
+		})
+
+		Convey("Connecting to a password protected FHEM", func() {
+			pwFake := newFakeFhem("geheim", map[string]string{"get lamp status": "off"})
+			cfg := pwFake.config()
+
+			Convey("should work with the correct password", func() {
+				c := NewClient(cfg, createTestLogger(t))
+				defer c.Close()
+				out, err := c.Get(ctx, "lamp", "status")
+				So(err, ShouldBeNil)
+				So(out, ShouldEqual, "off")
+			})
+
+			Convey("should fail with a wrong password", func() {
+				cfg.Password = "falsch"
+				c := NewClient(cfg, createTestLogger(t))
+				defer c.Close()
+				shortCtx, shortCancel := context.WithTimeout(ctx, time.Second)
+				defer shortCancel()
+				_, err := c.Get(shortCtx, "lamp", "status")
+				So(err, ShouldNotBeNil)
+				_, err = dial(ctx, cfg)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "rejected the password")
+			})
+
+			Reset(func() {
+				pwFake.close()
+			})
+		})
+
+		Reset(func() {
+			cancel()
+			fake.close()
+		})
+	})
+}
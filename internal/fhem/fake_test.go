@@ -0,0 +1,140 @@
+package fhem
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// fakeFhem is a minimal FHEM telnet server used for testing
+type fakeFhem struct {
+	listener  net.Listener
+	password  string
+	responses map[string]string
+	// Event lines sent to connections that switched to inform mode
+	events []string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	commands []string
+	accepted int
+}
+
+func newFakeFhem(password string, responses map[string]string) *fakeFhem {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	f := &fakeFhem{listener: l, password: password, responses: responses}
+	go f.serve()
+	return f
+}
+
+func (f *fakeFhem) config() models.FhemConfig {
+	return models.FhemConfig{
+		Address:           f.listener.Addr().String(),
+		Password:          f.password,
+		Timeout:           2,
+		MaxReconnectDelay: 1,
+	}
+}
+
+func (f *fakeFhem) serve() {
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, c)
+		f.accepted++
+		f.mu.Unlock()
+		go f.handle(c)
+	}
+}
+
+func (f *fakeFhem) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	if f.password != "" {
+		// Like FHEM, switch off the local echo of the client while the password is entered
+		c.Write(append([]byte{telnetIAC, telnetWill, 1}, passwordPrompt...))
+		pw, err := r.ReadString('\n')
+		if err != nil || strings.TrimSpace(pw) != f.password {
+			return
+		}
+		c.Write([]byte{telnetIAC, telnetWont, 1, '\r', '\n'})
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, `{"`) {
+			// Perl expression - just echo the string
+			fmt.Fprintf(c, "%s\n", strings.TrimSuffix(strings.TrimPrefix(line, `{"`), `"}`))
+			continue
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		evts := f.events
+		f.mu.Unlock()
+		if strings.HasPrefix(line, "inform ") {
+			for _, e := range evts {
+				fmt.Fprintf(c, "%s\n", e)
+			}
+			continue
+		}
+		if out, ok := f.responses[line]; ok {
+			fmt.Fprintf(c, "%s\n", out)
+		} else if !strings.HasPrefix(line, "set ") && !strings.HasPrefix(line, "attr ") {
+			fmt.Fprintf(c, "Unknown command %s, try help.\n", line)
+		}
+	}
+}
+
+// setEvents defines the event lines to send to connections in inform mode
+func (f *fakeFhem) setEvents(evts ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = evts
+}
+
+// dropConnections closes all open connections - simulating a FHEM restart
+func (f *fakeFhem) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeFhem) receivedCommands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func (f *fakeFhem) acceptedConnections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.accepted
+}
+
+func (f *fakeFhem) close() {
+	f.listener.Close()
+	f.dropConnections()
+}
+
+func createTestLogger(t *testing.T) log.Logger {
+	return log.New(kitlog.NewNopLogger(), log.LvlDebug)
+}
@@ -0,0 +1,111 @@
+package fhem
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/pkg/errors"
+)
+
+// TimeFormat is the format FHEM uses for timestamps
+const TimeFormat = "2006-01-02 15:04:05"
+
+// JSONList2 is the result of FHEM's `jsonlist2` command
+type JSONList2 struct {
+	// The device specification the command has been called with
+	Arg string `json:"Arg"`
+	// The devices matching the device specification
+	Results []JSONDevice `json:"Results"`
+	// The number of devices returned
+	TotalResultsReturned int `json:"totalResultsReturned"`
+}
+
+// JSONDevice is a single device as returned by `jsonlist2`
+type JSONDevice struct {
+	Name          string                 `json:"Name"`
+	PossibleSets  string                 `json:"PossibleSets"`
+	PossibleAttrs string                 `json:"PossibleAttrs"`
+	Internals     map[string]Value       `json:"Internals"`
+	Readings      map[string]JSONReading `json:"Readings"`
+	Attributes    map[string]Value       `json:"Attributes"`
+}
+
+// JSONReading is a single reading value as returned by `jsonlist2`
+type JSONReading struct {
+	Value Value  `json:"Value"`
+	Time  string `json:"Time"`
+}
+
+// Timestamp returns the time of the reading's last update - using the local time zone like FHEM does
+func (r JSONReading) Timestamp() (time.Time, error) {
+	return ParseTime(r.Time)
+}
+
+// Value is a string value inside the `jsonlist2` output. Some FHEM modules put numbers or nested structures into
+// their internals - these are kept in their JSON representation.
+type Value string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = Value(s)
+		return nil
+	}
+	*v = Value(strings.TrimSpace(string(data)))
+	return nil
+}
+
+// ParseJSONList2 parses the output of FHEM's `jsonlist2` command
+func ParseJSONList2(out string) (*JSONList2, error) {
+	// FHEM returns a plain-text error message if the command fails
+	if !strings.HasPrefix(strings.TrimSpace(out), "{") {
+		return nil, &CommandError{Command: "jsonlist2", Message: out}
+	}
+	var res JSONList2
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse jsonlist2 output")
+	}
+	return &res, nil
+}
+
+// ParseTime parses a timestamp in FHEM's format
+func ParseTime(s string) (time.Time, error) {
+	t, err := time.ParseInLocation(TimeFormat, s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "Invalid FHEM timestamp '%s'", s)
+	}
+	return t, nil
+}
+
+// Device converts the jsonlist2 result into the device model used by MiCasa
+func (d JSONDevice) Device() *models.Device {
+	dev := &models.Device{
+		Name:       d.Name,
+		Type:       string(d.Internals["TYPE"]),
+		Internals:  make(map[string]string, len(d.Internals)),
+		Readings:   make(map[string]models.Reading, len(d.Readings)),
+		Attributes: make(map[string]string, len(d.Attributes)),
+	}
+	// The possible sets may contain widget hints like "pct:slider,0,1,100" - only the command names are of interest
+	for _, set := range strings.Fields(d.PossibleSets) {
+		if idx := strings.Index(set, ":"); idx >= 0 {
+			set = set[:idx]
+		}
+		dev.PossibleSets = append(dev.PossibleSets, set)
+	}
+	for k, v := range d.Internals {
+		dev.Internals[k] = string(v)
+	}
+	for k, v := range d.Readings {
+		// Keep readings with unparseable timestamps - their value is still valid
+		ts, _ := v.Timestamp()
+		dev.Readings[k] = models.Reading{Value: string(v.Value), Time: ts}
+	}
+	for k, v := range d.Attributes {
+		dev.Attributes[k] = string(v)
+	}
+	return dev
+}
@@ -0,0 +1,197 @@
+package fhem
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	// InformOn is the inform mode sending plain events - the timestamp is the time the event is received
+	InformOn = "on"
+	// InformTimer is the inform mode sending events prefixed by FHEM's timestamp
+	InformTimer = "timer"
+)
+
+// Matches events in the form of "reading: value" - everything else is a state event
+var readingEventRegex = regexp.MustCompile(`^([\w.\-/]+):(?: (.*))?$`)
+
+// ParseEvent parses a single event line sent by FHEM in inform mode. The line has the format
+// "[<timestamp>] <TYPE> <NAME> <event>"; a missing timestamp is replaced with the given receive time.
+func ParseEvent(line string, received time.Time) (events.Event, error) {
+	e := events.Event{Time: received}
+	line = strings.TrimSpace(line)
+	if len(line) >= len(TimeFormat) {
+		if ts, err := ParseTime(line[:len(TimeFormat)]); err == nil {
+			e.Time = ts
+			line = line[len(TimeFormat):]
+			// FHEM adds milliseconds when `mseclog` is active
+			if strings.HasPrefix(line, ".") {
+				if idx := strings.Index(line, " "); idx > 0 {
+					if msec, err := strconv.Atoi(line[1:idx]); err == nil {
+						e.Time = e.Time.Add(time.Duration(msec) * time.Millisecond)
+					}
+					line = line[idx:]
+				}
+			}
+			line = strings.TrimSpace(line)
+		}
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 {
+		return e, errors.Errorf("Malformed event line '%s'", line)
+	}
+	e.Type, e.Device = parts[0], parts[1]
+	if m := readingEventRegex.FindStringSubmatch(parts[2]); m != nil {
+		e.Reading, e.Value = m[1], m[2]
+	} else {
+		e.Reading, e.Value = "state", parts[2]
+	}
+	return e, nil
+}
+
+// Stream is a long-lived connection to FHEM in inform mode which publishes every event received to the event bus.
+// The connection is re-established with an increasing delay whenever it breaks.
+type Stream struct {
+	cfg     models.FhemConfig
+	bus     *events.Bus
+	logger  log.Logger
+	backoff *backoff
+	// Guards cfg, backoff and cancel while the settings are updated
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// OnConnect is called every time the stream has (re-)connected to FHEM - events may have been missed while the
+	// connection was down
+	OnConnect func()
+}
+
+// NewStream creates a new event stream publishing to the given bus
+func NewStream(cfg models.FhemConfig, bus *events.Bus, logger log.Logger) *Stream {
+	return &Stream{
+		cfg:     cfg,
+		bus:     bus,
+		logger:  logger,
+		backoff: newBackoff(time.Duration(cfg.MaxReconnectDelay) * time.Second),
+	}
+}
+
+// Start starts receiving events in the background
+func (s *Stream) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start()
+}
+
+// start starts the receiving loop - the caller has to hold the lock
+func (s *Stream) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx)
+	}()
+}
+
+// Stop closes the connection to FHEM and waits for the stream to terminate
+func (s *Stream) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+}
+
+// stop terminates the receiving loop - the caller has to hold the lock
+func (s *Stream) stop() {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.wg.Wait()
+}
+
+// UpdateConfig changes the connection settings - a running stream reconnects using the new settings
+func (s *Stream) UpdateConfig(cfg models.FhemConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	running := s.cancel != nil
+	s.stop()
+	s.cfg = cfg
+	s.backoff = newBackoff(time.Duration(cfg.MaxReconnectDelay) * time.Second)
+	if running {
+		s.start()
+	}
+}
+
+// run keeps the inform connection alive until the context is cancelled
+func (s *Stream) run(ctx context.Context) {
+	for {
+		err := s.receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		delay := s.backoff.next()
+		s.logger.Warn("FHEM event stream has been interrupted - reconnecting", log.FldError, err, log.FldDuration, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// receive opens a connection in inform mode and publishes events until the connection breaks
+func (s *Stream) receive(ctx context.Context) error {
+	c, err := dial(ctx, s.cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// Make sure that the blocking read is interrupted on shutdown
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	mode := s.cfg.InformMode
+	if mode != InformOn {
+		mode = InformTimer
+	}
+	if _, err := fmt.Fprintf(c, "inform %s\n", mode); err != nil {
+		return errors.Wrap(err, "Failed to enable inform mode")
+	}
+	s.logger.Info("Receiving events from FHEM", log.FldAddress, s.cfg.Address)
+	s.backoff.reset()
+	if s.OnConnect != nil {
+		s.OnConnect()
+	}
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "Failed to read event from FHEM")
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e, err := ParseEvent(line, time.Now())
+		if err != nil {
+			s.logger.Debug("Ignoring unparseable event", log.FldError, err)
+			continue
+		}
+		s.bus.Publish(e)
+	}
+}
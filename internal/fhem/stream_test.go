@@ -0,0 +1,114 @@
+package fhem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func receiveEvent(sub *events.Subscription) events.Event {
+	select {
+	case e := <-sub.C:
+		return e
+	case <-time.After(2 * time.Second):
+		So("timeout", ShouldEqual, "event")
+		return events.Event{}
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	Convey("Parsing event lines", t, func() {
+		now := time.Now()
+
+		Convey("Reading events without timestamp should be parsed", func() {
+			e, err := ParseEvent("CUL_HM thermostat measured-temp: 21.5\n", now)
+			So(err, ShouldBeNil)
+			So(e, ShouldResemble, events.Event{
+				Device: "thermostat", Type: "CUL_HM", Reading: "measured-temp", Value: "21.5", Time: now,
+			})
+		})
+
+		Convey("State events should use the state reading", func() {
+			e, err := ParseEvent("dummy lamp on", now)
+			So(err, ShouldBeNil)
+			So(e.Reading, ShouldEqual, "state")
+			So(e.Value, ShouldEqual, "on")
+		})
+
+		Convey("State values containing colons should not be taken as readings", func() {
+			e, err := ParseEvent("dummy alarm 06:30", now)
+			So(err, ShouldBeNil)
+			So(e.Reading, ShouldEqual, "state")
+			So(e.Value, ShouldEqual, "06:30")
+		})
+
+		Convey("Timestamps sent in timer mode should be used", func() {
+			e, err := ParseEvent("2017-11-29 20:15:00 dummy lamp brightness: 80", now)
+			So(err, ShouldBeNil)
+			So(e.Device, ShouldEqual, "lamp")
+			So(e.Reading, ShouldEqual, "brightness")
+			So(e.Value, ShouldEqual, "80")
+			So(e.Time, ShouldEqual, time.Date(2017, 11, 29, 20, 15, 0, 0, time.Local))
+		})
+
+		Convey("Millisecond timestamps should be supported", func() {
+			e, err := ParseEvent("2017-11-29 20:15:00.250 dummy lamp off", now)
+			So(err, ShouldBeNil)
+			So(e.Time, ShouldEqual, time.Date(2017, 11, 29, 20, 15, 0, 250000000, time.Local))
+			So(e.Value, ShouldEqual, "off")
+		})
+
+		Convey("Incomplete lines should be rejected", func() {
+			_, err := ParseEvent("dummy lamp", now)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestStream(t *testing.T) {
+	Convey("Having a fake FHEM server emitting events", t, func() {
+		fake := newFakeFhem("", nil)
+		fake.setEvents(
+			"2017-11-29 20:15:00 dummy lamp on",
+			"2017-11-29 20:15:01 CUL_HM thermostat measured-temp: 21.5",
+			"2017-11-29 20:15:02 CUL_HM thermostat desired-temp: 22.0",
+		)
+		bus := events.NewBus(createTestLogger(t))
+		stream := NewStream(fake.config(), bus, createTestLogger(t))
+
+		Convey("Subscribers should receive the events matching their filter", func() {
+			all := bus.Subscribe(events.Filter{}, 0)
+			temps := bus.Subscribe(events.Filter{Readings: []string{"*-temp"}}, 0)
+			lamps := bus.Subscribe(events.Filter{Devices: []string{"lamp"}}, 0)
+			stream.Start()
+
+			So(receiveEvent(all).Device, ShouldEqual, "lamp")
+			So(receiveEvent(all).Reading, ShouldEqual, "measured-temp")
+			So(receiveEvent(all).Reading, ShouldEqual, "desired-temp")
+			So(receiveEvent(temps).Value, ShouldEqual, "21.5")
+			So(receiveEvent(temps).Value, ShouldEqual, "22.0")
+			So(receiveEvent(lamps).Value, ShouldEqual, "on")
+			So(fake.receivedCommands(), ShouldContain, "inform timer")
+		})
+
+		Convey("The stream should reconnect after FHEM has been restarted", func() {
+			connects := make(chan struct{}, 10)
+			stream.OnConnect = func() { connects <- struct{}{} }
+			sub := bus.Subscribe(events.Filter{Devices: []string{"lamp"}}, 0)
+			stream.Start()
+			receiveEvent(sub)
+			fake.setEvents("dummy lamp off")
+			fake.dropConnections()
+			So(receiveEvent(sub).Value, ShouldEqual, "off")
+			So(len(connects), ShouldEqual, 2)
+		})
+
+		Reset(func() {
+			stream.Stop()
+			bus.Close()
+			fake.close()
+		})
+	})
+}
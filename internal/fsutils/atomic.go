@@ -0,0 +1,44 @@
+package fsutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteFileAtomic replaces the contents of a file without leaving a partially written file behind if the application
+// or the system crashes: the data is written to a temporary file inside the same directory, flushed to disk and
+// renamed to the target file afterwards.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create a temporary file next to '%s'", filename)
+	}
+	tmpFile := f.Name()
+	defer os.Remove(tmpFile)
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", tmpFile)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return errors.Wrapf(err, "Failed to set the permissions of '%s'", tmpFile)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", tmpFile)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", tmpFile)
+	}
+	if err := os.Rename(tmpFile, filename); err != nil {
+		return errors.Wrapf(err, "Failed to replace '%s'", filename)
+	}
+	// Make sure that the rename itself is persisted - not supported on every platform, so errors are ignored
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
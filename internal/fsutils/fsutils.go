@@ -1,32 +1,28 @@
 package fsutils
 
 import (
-	"fmt"
 	"os"
-	"syscall"
 
 	"github.com/derWhity/micasa/internal/log"
+	"github.com/pkg/errors"
 )
 
-// CheckAndCreateDir checks and tries to create the given directory recursively (or panics if this fails)
-func CheckAndCreateDir(path string, logger log.Logger) {
+// CheckAndCreateDir checks and tries to create the given directory recursively
+func CheckAndCreateDir(path string, logger log.Logger) error {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
-		if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOENT {
-			logger.Info("Directory does not exist - trying to create...", log.FldPath, path)
-			if err = os.MkdirAll(path, os.ModePerm); err != nil {
-				logger.Crit("Failed to create directory", log.FldError, err)
-				panic("Cannot continue")
-			}
-			logger.Info("Directory created successfully")
-		} else {
-			logger.Crit("Stat has failed", log.FldError, err.(*os.PathError).Err)
-			panic("Cannot continue")
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Cannot access '%s'", path)
 		}
-	} else {
-		if !fileInfo.IsDir() {
-			logger.Crit(fmt.Sprintf("'%s' is not a directory. Remove the plain file if you want to continue", path))
-			panic("Cannot continue")
+		logger.Info("Directory does not exist - trying to create...", log.FldPath, path)
+		if err = os.MkdirAll(path, os.ModePerm); err != nil {
+			return errors.Wrapf(err, "Failed to create directory '%s'", path)
 		}
+		logger.Info("Directory created successfully")
+		return nil
 	}
+	if !fileInfo.IsDir() {
+		return errors.Errorf("'%s' is not a directory. Remove the plain file if you want to continue", path)
+	}
+	return nil
 }
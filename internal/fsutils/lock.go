@@ -0,0 +1,31 @@
+package fsutils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked is returned by LockFile if another process holds the lock
+var ErrLocked = errors.New("The file is locked by another process")
+
+// FileLock is an exclusive lock on a file which is held until it is unlocked or the process ends
+type FileLock struct {
+	file     *os.File
+	filename string
+}
+
+// LockFile acquires an exclusive lock on the given file - creating the file if it does not exist. It does not wait
+// for the lock to become available, but returns ErrLocked instead.
+func LockFile(filename string) (*FileLock, error) {
+	f, err := lockFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLock{file: f, filename: filename}, nil
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	return unlockFile(l.file, l.filename)
+}
@@ -0,0 +1,34 @@
+package fsutils_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derWhity/micasa/internal/fsutils"
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLockFile(t *testing.T) {
+	Convey("Having a lock on a file", t, func() {
+		dir := filepath.Join(os.TempDir(), uuid.NewV4().String())
+		So(os.MkdirAll(dir, 0700), ShouldBeNil)
+		filename := filepath.Join(dir, "test.lock")
+		lock, err := fsutils.LockFile(filename)
+		So(err, ShouldBeNil)
+
+		Convey("locking it again should fail until it has been unlocked", func() {
+			_, err := fsutils.LockFile(filename)
+			So(err, ShouldEqual, fsutils.ErrLocked)
+			So(lock.Unlock(), ShouldBeNil)
+			lock, err = fsutils.LockFile(filename)
+			So(err, ShouldBeNil)
+			So(lock.Unlock(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package fsutils
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile locks the file using flock - the lock is released by the system when the process ends, so there are no
+// stale locks after a crash
+func lockFile(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open the lock file '%s'", filename)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrapf(err, "Failed to lock '%s'", filename)
+	}
+	return f, nil
+}
+
+// unlockFile releases the lock by closing the file - the file itself is kept, as removing it would allow a second
+// process to lock a new file of the same name while a third one still waits for the old one
+func unlockFile(f *os.File, filename string) error {
+	return f.Close()
+}
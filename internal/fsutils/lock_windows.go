@@ -0,0 +1,26 @@
+package fsutils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile creates the file exclusively - an existing file means that the lock is held. A file left behind by a
+// crashed process has to be removed manually.
+func lockFile(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrapf(err, "Failed to create the lock file '%s'", filename)
+	}
+	return f, nil
+}
+
+// unlockFile releases the lock by removing the file
+func unlockFile(f *os.File, filename string) error {
+	f.Close()
+	return os.Remove(filename)
+}
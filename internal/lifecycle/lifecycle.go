@@ -0,0 +1,150 @@
+// Package lifecycle starts the components of MiCasa in order and stops them in reverse order when shutting down
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/pkg/errors"
+)
+
+// DefaultStopTimeout is the time a component is given to stop if it does not define its own timeout
+const DefaultStopTimeout = 10 * time.Second
+
+// Hook starts or stops a component. The context of a stop hook expires when the component's stop timeout is over.
+type Hook func(ctx context.Context) error
+
+// Component is a part of the application which has to be started and stopped - e.g. the database or the HTTP server
+type Component struct {
+	// The name of the component used for logging
+	Name string
+	// Starts the component - optional
+	Start Hook
+	// Stops the component - optional. It is only called if the component has been started successfully.
+	Stop Hook
+	// The time the component is given to stop - DefaultStopTimeout if not set
+	StopTimeout time.Duration
+}
+
+// Manager starts the registered components in the order of their registration and stops them in reverse order.
+// Components registered later may depend on the ones registered before, as they are stopped first.
+type Manager struct {
+	logger log.Logger
+	// Guards components and started
+	mu         sync.Mutex
+	components []Component
+	// The number of components started - always the first ones registered
+	started int
+}
+
+// New creates a lifecycle manager without any components
+func New(logger log.Logger) *Manager {
+	return &Manager{logger: logger}
+}
+
+// Register adds a component - it is started after all components registered before
+func (m *Manager) Register(c Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.components = append(m.components, c)
+}
+
+// Start starts all components which have not been started yet. If a component fails to start, the components started
+// already are stopped again and the error is returned.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.started < len(m.components) {
+		c := m.components[m.started]
+		if c.Start != nil {
+			m.logger.Info(fmt.Sprintf("Starting %s...", c.Name), log.FldComponent, c.Name)
+			start := time.Now()
+			if err := c.Start(ctx); err != nil {
+				m.logger.Warn(fmt.Sprintf("Failed to start %s - stopping the components started already", c.Name))
+				m.stop()
+				return errors.Wrapf(err, "Failed to start %s", c.Name)
+			}
+			m.logger.Debug(
+				fmt.Sprintf("Started %s", c.Name),
+				log.FldComponent, c.Name,
+				log.FldDuration, time.Since(start),
+			)
+		}
+		m.started++
+	}
+	m.logger.Info("All components have been started")
+	return nil
+}
+
+// Stop stops all started components in reverse order. A component failing to stop in time is abandoned - the others
+// are stopped anyway. The first error occurred is returned.
+func (m *Manager) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stop()
+}
+
+// stop stops the started components - the caller has to hold the lock
+func (m *Manager) stop() error {
+	var res error
+	for ; m.started > 0; m.started-- {
+		c := m.components[m.started-1]
+		if c.Stop == nil {
+			continue
+		}
+		m.logger.Info(fmt.Sprintf("Stopping %s...", c.Name), log.FldComponent, c.Name)
+		start := time.Now()
+		if err := stopComponent(c); err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to stop %s", c.Name), err, log.FldComponent, c.Name)
+			if res == nil {
+				res = errors.Wrapf(err, "Failed to stop %s", c.Name)
+			}
+			continue
+		}
+		m.logger.Debug(fmt.Sprintf("Stopped %s", c.Name), log.FldComponent, c.Name, log.FldDuration, time.Since(start))
+	}
+	return res
+}
+
+// stopComponent calls the stop hook of the component and waits for it to return until the component's timeout is over
+func stopComponent(c Component) error {
+	timeout := c.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Stop(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Errorf("Timed out after %s", timeout)
+	}
+}
+
+// WaitForSignal blocks until SIGINT or SIGTERM is received and returns the signal. SIGHUP calls the given function
+// instead - e.g. for reloading the configuration - if it is not nil.
+func WaitForSignal(onHangup func()) os.Signal {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		sig := <-sigChan
+		if sig != syscall.SIGHUP {
+			return sig
+		}
+		if onHangup != nil {
+			onHangup()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/lifecycle"
+	"github.com/derWhity/micasa/internal/log"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManager(t *testing.T) {
+	Convey("Having a lifecycle manager with some components", t, func() {
+		m := lifecycle.New(log.New(kitlog.NewNopLogger(), log.LvlDebug))
+		var calls []string
+		component := func(name string, startErr error) lifecycle.Component {
+			return lifecycle.Component{
+				Name: name,
+				Start: func(ctx context.Context) error {
+					calls = append(calls, "start "+name)
+					return startErr
+				},
+				Stop: func(ctx context.Context) error {
+					calls = append(calls, "stop "+name)
+					return nil
+				},
+			}
+		}
+		m.Register(component("db", nil))
+		m.Register(lifecycle.Component{Name: "nothing"})
+		m.Register(component("server", nil))
+
+		Convey("the components should be started in order and stopped in reverse order", func() {
+			So(m.Start(context.Background()), ShouldBeNil)
+			So(m.Stop(), ShouldBeNil)
+			So(calls, ShouldResemble, []string{"start db", "start server", "stop server", "stop db"})
+
+			Convey("and stopping again should do nothing", func() {
+				So(m.Stop(), ShouldBeNil)
+				So(calls, ShouldHaveLength, 4)
+			})
+		})
+
+		Convey("a failing component should stop the ones started before", func() {
+			m.Register(component("fhem", errors.New("Connection refused")))
+			m.Register(component("scheduler", nil))
+			err := m.Start(context.Background())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Failed to start fhem")
+			So(calls, ShouldResemble, []string{"start db", "start server", "start fhem", "stop server", "stop db"})
+		})
+
+		Convey("components failing to stop in time should not block the shutdown", func() {
+			m.Register(lifecycle.Component{
+				Name:        "stuck",
+				Stop:        func(ctx context.Context) error { select {} },
+				StopTimeout: 10 * time.Millisecond,
+			})
+			m.Register(lifecycle.Component{
+				Name: "broken",
+				Stop: func(ctx context.Context) error { return errors.New("Broken") },
+			})
+			So(m.Start(context.Background()), ShouldBeNil)
+			err := m.Stop()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Failed to stop broken")
+			So(calls, ShouldResemble, []string{"start db", "start server", "stop server", "stop db"})
+		})
+	})
+}
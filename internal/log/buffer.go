@@ -0,0 +1,218 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBufferSize is the default number of log entries kept by a Buffer
+	DefaultBufferSize = 1000
+	// DefaultTailSize is the default number of log entries buffered for each subscription of a Buffer
+	DefaultTailSize = 64
+)
+
+// Entry is a single log entry kept by a Buffer
+type Entry struct {
+	// The sequence number of the entry - increasing by one with every entry logged
+	ID uint64 `json:"id"`
+	// The time the entry has been logged
+	Time time.Time `json:"time"`
+	// The level of the entry: "debug", "info", "warn", "error" or "crit"
+	Level string `json:"level"`
+	// The component the entry belongs to - if any
+	Component string `json:"component,omitempty"`
+	// The name of the user the entry belongs to - if any
+	User string `json:"user,omitempty"`
+	// The log message
+	Message string `json:"msg"`
+	// All other fields of the entry - e.g. the error
+	Fields map[string]string `json:"fields,omitempty"`
+	lvl    int
+}
+
+// EntryFilter selects log entries - empty values match every entry
+type EntryFilter struct {
+	// The minimum level of the entries
+	MinLevel int
+	// The component of the entries
+	Component string
+	// The name of the user of the entries
+	User string
+}
+
+// Matches checks whether the entry passes the filter
+func (f EntryFilter) Matches(e Entry) bool {
+	return e.lvl >= f.MinLevel &&
+		(f.Component == "" || f.Component == e.Component) &&
+		(f.User == "" || f.User == e.User)
+}
+
+// Subscription receives the log entries logged after subscribing through its channel C
+type Subscription struct {
+	// C is the channel the subscriber receives the entries from
+	C       <-chan Entry
+	ch      chan Entry
+	buf     *Buffer
+	filter  EntryFilter
+	dropped uint64
+	once    sync.Once
+}
+
+// Dropped returns the number of entries that could not be delivered because the subscriber did not keep up
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe removes the subscription from the buffer and closes its channel
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.buf.mu.Lock()
+		delete(s.buf.subs, s)
+		s.buf.mu.Unlock()
+		close(s.ch)
+	})
+}
+
+// Buffer is a GoKit logger keeping the most recent log entries in memory - e.g. for showing them via the API. It
+// passes the entries on to its subscribers without blocking: entries are dropped for subscribers which do not keep up.
+type Buffer struct {
+	mu sync.RWMutex
+	// The entries as ring - the oldest one is located at start once the ring is full
+	entries []Entry
+	start   int
+	size    int
+	seq     uint64
+	subs    map[*Subscription]struct{}
+}
+
+// NewBuffer creates a buffer keeping the given number of entries - a value of 0 uses the default size
+func NewBuffer(size int) *Buffer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Buffer{size: size, subs: map[*Subscription]struct{}{}}
+}
+
+// Log adds the log entry to the buffer and passes it on to the subscribers
+func (b *Buffer) Log(keyvals ...interface{}) error {
+	e := newEntry(keyvals)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.ID = b.seq
+	if len(b.entries) < b.size {
+		b.entries = append(b.entries, e)
+	} else {
+		b.entries[b.start] = e
+		b.start = (b.start + 1) % b.size
+	}
+	for s := range b.subs {
+		if !s.filter.Matches(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// newEntry converts the key-value pairs of a log entry - the timestamp field is replaced by the current time
+func newEntry(keyvals []interface{}) Entry {
+	lvl, component := entryInfo(keyvals)
+	e := Entry{Time: time.Now().UTC(), Level: LevelName(lvl), Component: component, lvl: lvl}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		switch key {
+		case FldLevel, FldComponent, FldTimestamp:
+		case FldUser:
+			e.User = formatValue(value)
+		case FldMessage:
+			e.Message = formatValue(value)
+		default:
+			if e.Fields == nil {
+				e.Fields = map[string]string{}
+			}
+			e.Fields[key] = formatValue(value)
+		}
+	}
+	return e
+}
+
+// formatValue converts the value of a log field to a string
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// SetSize changes the number of entries kept - the oldest entries are dropped if there are too many
+func (b *Buffer) SetSize(size int) {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.ordered()
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
+	}
+	b.entries = entries
+	b.start = 0
+	b.size = size
+}
+
+// ordered returns the entries from the oldest to the newest - the caller has to hold the lock
+func (b *Buffer) ordered() []Entry {
+	res := make([]Entry, 0, len(b.entries))
+	for i := range b.entries {
+		res = append(res, b.entries[(b.start+i)%len(b.entries)])
+	}
+	return res
+}
+
+// Entries returns the most recent entries matching the filter - from the oldest to the newest. At most limit entries
+// are returned; 0 returns all of them.
+func (b *Buffer) Entries(filter EntryFilter, limit int) []Entry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	res := []Entry{}
+	for _, e := range b.ordered() {
+		if filter.Matches(e) {
+			res = append(res, e)
+		}
+	}
+	if limit > 0 && len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	return res
+}
+
+// Subscribe registers a subscriber for all entries matching the filter which are logged from now on. The
+// subscription buffers up to bufferSize entries - a value of 0 uses the default size.
+func (b *Buffer) Subscribe(filter EntryFilter, bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultTailSize
+	}
+	ch := make(chan Entry, bufferSize)
+	s := &Subscription{C: ch, ch: ch, buf: b, filter: filter}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
@@ -0,0 +1,75 @@
+package log_test
+
+import (
+	"testing"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func messages(entries []log.Entry) []string {
+	res := []string{}
+	for _, e := range entries {
+		res = append(res, e.Message)
+	}
+	return res
+}
+
+func TestBuffer(t *testing.T) {
+	Convey("Having a logger writing to a buffer", t, func() {
+		buf := log.NewBuffer(3)
+		logger := log.New(buf, log.LvlDebug)
+
+		Convey("only the most recent entries should be kept", func() {
+			for _, msg := range []string{"one", "two", "three", "four"} {
+				logger.Info(msg)
+			}
+			entries := buf.Entries(log.EntryFilter{}, 0)
+			So(messages(entries), ShouldResemble, []string{"two", "three", "four"})
+			So(entries[2].ID, ShouldEqual, 4)
+			So(messages(buf.Entries(log.EntryFilter{}, 2)), ShouldResemble, []string{"three", "four"})
+
+			buf.SetSize(2)
+			So(messages(buf.Entries(log.EntryFilter{}, 0)), ShouldResemble, []string{"three", "four"})
+			logger.Info("five")
+			So(messages(buf.Entries(log.EntryFilter{}, 0)), ShouldResemble, []string{"four", "five"})
+		})
+
+		Convey("the fields of the entries should be kept", func() {
+			named := logger.Named(log.ComponentFhem)
+			named.Error("Failed", errors.New("Broken"), log.FldUser, "amy", log.FldDevice, "lamp")
+			entries := buf.Entries(log.EntryFilter{}, 0)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Level, ShouldEqual, "error")
+			So(entries[0].Component, ShouldEqual, log.ComponentFhem)
+			So(entries[0].User, ShouldEqual, "amy")
+			So(entries[0].Message, ShouldEqual, "Failed")
+			So(entries[0].Fields, ShouldResemble, map[string]string{log.FldDevice: "lamp", log.FldError: "Broken"})
+		})
+
+		Convey("the entries should be filtered", func() {
+			logger.Debug("debug")
+			http, fhem := logger.Named(log.ComponentHTTP), logger.Named(log.ComponentFhem)
+			http.Warn("http", log.FldUser, "amy")
+			fhem.Error("fhem", errors.New("Broken"), log.FldUser, "bob")
+			So(messages(buf.Entries(log.EntryFilter{MinLevel: log.LvlWarn}, 0)), ShouldResemble, []string{"http", "fhem"})
+			So(messages(buf.Entries(log.EntryFilter{Component: log.ComponentFhem}, 0)), ShouldResemble, []string{"fhem"})
+			So(messages(buf.Entries(log.EntryFilter{User: "amy"}, 0)), ShouldResemble, []string{"http"})
+		})
+
+		Convey("subscribers should receive the matching entries logged afterwards", func() {
+			logger.Warn("before")
+			sub := buf.Subscribe(log.EntryFilter{MinLevel: log.LvlWarn}, 1)
+			logger.Info("hidden")
+			logger.Warn("first")
+			logger.Warn("dropped")
+			So((<-sub.C).Message, ShouldEqual, "first")
+			So(sub.Dropped(), ShouldEqual, 1)
+			sub.Unsubscribe()
+			logger.Warn("after")
+			_, ok := <-sub.C
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
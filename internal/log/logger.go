@@ -30,12 +30,44 @@ const (
 	FldPath = "path"
 	// FldSession is the name of the log field for storing the session ID
 	FldSession = "session"
-	// FldUser is the name of the log field for storing the ID of the currently active user
+	// FldUser is the name of the log field for storing the name of the currently active user
 	FldUser = "user"
 	// FldVersion is the version number of the application
 	FldVersion = "ver"
+	// FldAddress is the name of the log field for storing a network address
+	FldAddress = "addr"
+	// FldMethod is the name of the log field for storing the HTTP method of a request
+	FldMethod = "method"
+	// FldStatus is the name of the log field for storing the HTTP status code of a response
+	FldStatus = "status"
+	// FldDuration is the name of the log field for storing the duration of an operation
+	FldDuration = "duration"
+	// FldDevice is the name of the log field for storing the name of a FHEM device
+	FldDevice = "device"
+	// FldCommand is the name of the log field for storing a command sent to FHEM
+	FldCommand = "cmd"
+	// FldRemote is the name of the log field for storing the remote address of a client
+	FldRemote = "remote"
+	// FldToken is the name of the log field for storing the ID of a personal API token
+	FldToken = "token"
+	// FldConnection is the name of the log field for storing the ID of a long-living client connection
+	FldConnection = "conn"
+	// FldComponent is the name of the log field for storing the name of a component of the application
+	FldComponent = "component"
+
+	// ComponentFhem is the name of the loggers of the FHEM connection
+	ComponentFhem = "fhem"
+	// ComponentHTTP is the name of the logger of the HTTP API server
+	ComponentHTTP = "http"
+	// ComponentMigrate is the name of the logger of the database migrations
+	ComponentMigrate = "migrate"
+	// ComponentRepo is the name of the loggers of the repositories
+	ComponentRepo = "repo"
 )
 
+// Components are the names of the components whose log levels can be set separately
+var Components = []string{ComponentFhem, ComponentHTTP, ComponentMigrate, ComponentRepo}
+
 // Logger is a helper that uses a levels logger to perform logging operations
 // It is used to simplify the typical logging operations a little bit
 type Logger struct {
@@ -104,3 +136,9 @@ func (l *Logger) Levels() levels.Levels {
 func (l *Logger) With(keyvals ...interface{}) Logger {
 	return Logger{l.logger.With(keyvals...), l.minLevel}
 }
+
+// Named returns a new Logger instance for the given component - see Components. An Output filters the entries of the
+// component by the level set for it.
+func (l *Logger) Named(component string) Logger {
+	return l.With(FldComponent, component)
+}
@@ -0,0 +1,183 @@
+package log
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FldLevel is the name of the log field that contains the level of the log entry
+	FldLevel = "level"
+
+	// FormatLogfmt writes the log entries as key=value pairs
+	FormatLogfmt = "logfmt"
+	// FormatJSON writes each log entry as JSON object
+	FormatJSON = "json"
+)
+
+// levelNames are the values of the level field - by level
+var levelNames = []string{"debug", "info", "warn", "error", "crit"}
+
+// ParseLevel returns the level with the given name - "debug", "info", "warn", "error" or "crit"
+func ParseLevel(name string) (int, error) {
+	for lvl, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return lvl, nil
+		}
+	}
+	return 0, errors.Errorf("Unknown log level '%s'", name)
+}
+
+// LevelName returns the name of the given level
+func LevelName(lvl int) string {
+	if lvl < 0 || lvl >= len(levelNames) {
+		return ""
+	}
+	return levelNames[lvl]
+}
+
+// NewFormatLogger creates a GoKit logger writing the log entries in the given format to the writer
+func NewFormatLogger(w io.Writer, format string) (log.Logger, error) {
+	switch format {
+	case FormatLogfmt, "":
+		return log.NewLogfmtLogger(w), nil
+	case FormatJSON:
+		return log.NewJSONLogger(w), nil
+	}
+	return nil, errors.Errorf("Unknown log format '%s'", format)
+}
+
+// Output is a GoKit logger whose destination and minimum levels can be changed while it is in use - all loggers
+// created on top of it follow the changes immediately. It filters the log entries by their level field, so the
+// loggers using it should be created with LvlDebug. Entries of a component - see Logger.Named - are filtered by the
+// level set for the component, if any.
+type Output struct {
+	// Guards logger and components
+	mu         sync.RWMutex
+	logger     log.Logger
+	components map[string]int
+	minLevel   int32
+}
+
+// NewOutput creates an output writing the log entries of at least the given level to the GoKit logger
+func NewOutput(logger log.Logger, minLevel int) *Output {
+	return &Output{logger: logger, components: map[string]int{}, minLevel: int32(minLevel)}
+}
+
+// Log writes the log entry if its level is high enough
+func (o *Output) Log(keyvals ...interface{}) error {
+	lvl, component := entryInfo(keyvals)
+	// Holding the lock while writing makes sure that a replaced destination is not written to any more once
+	// SetLogger has returned
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if !o.enabled(component, lvl) {
+		return nil
+	}
+	return o.logger.Log(keyvals...)
+}
+
+// Enabled checks whether log entries of the given component and level are written - an empty component stands for
+// the entries of no particular component
+func (o *Output) Enabled(component string, lvl int) bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.enabled(component, lvl)
+}
+
+// enabled checks whether log entries of the given component and level are written - the caller has to hold the lock
+func (o *Output) enabled(component string, lvl int) bool {
+	if min, ok := o.components[component]; ok {
+		return lvl >= min
+	}
+	return int32(lvl) >= atomic.LoadInt32(&o.minLevel)
+}
+
+// SetLogger replaces the GoKit logger the log entries are written to - the previous one is not used any more
+// afterwards
+func (o *Output) SetLogger(logger log.Logger) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.logger = logger
+}
+
+// SetLevel changes the minimum level of the log entries written
+func (o *Output) SetLevel(lvl int) {
+	atomic.StoreInt32(&o.minLevel, int32(lvl))
+}
+
+// Level returns the minimum level of the log entries written
+func (o *Output) Level() int {
+	return int(atomic.LoadInt32(&o.minLevel))
+}
+
+// SetComponentLevel changes the minimum level of the log entries of the given component - overriding the minimum
+// level of the output
+func (o *Output) SetComponentLevel(component string, lvl int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.components[component] = lvl
+}
+
+// ResetComponentLevel makes the log entries of the given component follow the minimum level of the output again
+func (o *Output) ResetComponentLevel(component string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.components, component)
+}
+
+// SetComponentLevels replaces the levels of all components - the components missing follow the minimum level of the
+// output
+func (o *Output) SetComponentLevels(levels map[string]int) {
+	components := make(map[string]int, len(levels))
+	for component, lvl := range levels {
+		components[component] = lvl
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.components = components
+}
+
+// ComponentLevels returns the minimum levels set for components - by the name of the component
+func (o *Output) ComponentLevels() map[string]int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	res := make(map[string]int, len(o.components))
+	for component, lvl := range o.components {
+		res[component] = lvl
+	}
+	return res
+}
+
+// entryInfo returns the level and the component of a log entry. Entries without level are treated as critical, so
+// they are never dropped. The component is empty if the entry does not belong to one.
+func entryInfo(keyvals []interface{}) (int, string) {
+	lvl, component := LvlCrit, ""
+	foundLevel, foundComponent := false, false
+	for i := 0; i+1 < len(keyvals) && !(foundLevel && foundComponent); i += 2 {
+		switch keyvals[i] {
+		case FldLevel:
+			if foundLevel {
+				continue
+			}
+			foundLevel = true
+			if name, ok := keyvals[i+1].(string); ok {
+				if l, err := ParseLevel(name); err == nil {
+					lvl = l
+				}
+			}
+		case FldComponent:
+			if foundComponent {
+				continue
+			}
+			foundComponent = true
+			component, _ = keyvals[i+1].(string)
+		}
+	}
+	return lvl, component
+}
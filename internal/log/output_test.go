@@ -0,0 +1,82 @@
+package log_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/derWhity/micasa/internal/log"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOutput(t *testing.T) {
+	Convey("Having a logger writing to an output", t, func() {
+		var buf bytes.Buffer
+		out := log.NewOutput(kitlog.NewLogfmtLogger(&buf), log.LvlInfo)
+		logger := log.New(out, log.LvlDebug)
+
+		Convey("entries below the minimum level should be dropped", func() {
+			logger.Debug("Hidden")
+			logger.Info("Shown")
+			So(buf.String(), ShouldEqual, "level=info msg=Shown\n")
+		})
+
+		Convey("changing the level should affect loggers created before", func() {
+			child := logger.With(log.FldUser, "amy")
+			out.SetLevel(log.LvlDebug)
+			child.Debug("Shown")
+			So(buf.String(), ShouldEqual, "level=debug user=amy msg=Shown\n")
+			out.SetLevel(log.LvlError)
+			child.Warn("Hidden")
+			So(buf.String(), ShouldEqual, "level=debug user=amy msg=Shown\n")
+			So(out.Level(), ShouldEqual, log.LvlError)
+		})
+
+		Convey("components should be filtered by their own levels", func() {
+			fhem := logger.Named(log.ComponentFhem)
+			http := logger.Named(log.ComponentHTTP)
+			out.SetComponentLevel(log.ComponentFhem, log.LvlDebug)
+			out.SetComponentLevel(log.ComponentHTTP, log.LvlError)
+			fhem.Debug("Shown")
+			http.Warn("Hidden")
+			logger.Debug("Hidden")
+			So(buf.String(), ShouldEqual, "level=debug component=fhem msg=Shown\n")
+			So(out.Enabled(log.ComponentHTTP, log.LvlError), ShouldBeTrue)
+			So(out.Enabled(log.ComponentHTTP, log.LvlWarn), ShouldBeFalse)
+			So(out.ComponentLevels(), ShouldResemble, map[string]int{"fhem": log.LvlDebug, "http": log.LvlError})
+
+			buf.Reset()
+			out.ResetComponentLevel(log.ComponentHTTP)
+			http.Info("Shown")
+			So(buf.String(), ShouldEqual, "level=info component=http msg=Shown\n")
+
+			out.SetComponentLevels(map[string]int{log.ComponentRepo: log.LvlCrit})
+			So(out.Enabled(log.ComponentFhem, log.LvlDebug), ShouldBeFalse)
+			So(out.Enabled(log.ComponentRepo, log.LvlError), ShouldBeFalse)
+		})
+
+		Convey("the destination and format should be replaceable", func() {
+			var other bytes.Buffer
+			jsonLogger, err := log.NewFormatLogger(&other, log.FormatJSON)
+			So(err, ShouldBeNil)
+			out.SetLogger(jsonLogger)
+			logger.Warn("Moved")
+			So(buf.Len(), ShouldEqual, 0)
+			var entry map[string]string
+			So(json.Unmarshal(other.Bytes(), &entry), ShouldBeNil)
+			So(entry, ShouldResemble, map[string]string{"level": "warn", "msg": "Moved"})
+		})
+	})
+
+	Convey("Levels should be parsed by their names", t, func() {
+		lvl, err := log.ParseLevel("WARN")
+		So(err, ShouldBeNil)
+		So(lvl, ShouldEqual, log.LvlWarn)
+		So(log.LevelName(lvl), ShouldEqual, "warn")
+		_, err = log.ParseLevel("verbose")
+		So(err, ShouldNotBeNil)
+		_, err = log.NewFormatLogger(&bytes.Buffer{}, "xml")
+		So(err, ShouldNotBeNil)
+	})
+}
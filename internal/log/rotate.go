@@ -0,0 +1,255 @@
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The format of the time of rotation used in the names of rotated log files
+const rotateTimeFormat = "20060102-150405.000"
+
+// RotateOptions define when a log file is rotated and how many rotated files are kept
+type RotateOptions struct {
+	// The size in bytes a log file may grow to before it is rotated - 0 disables rotating by size
+	MaxSize int64
+	// The time after which a log file is rotated - 0 disables rotating by age
+	MaxAge time.Duration
+	// The number of rotated files to keep - 0 keeps all of them
+	Keep int
+	// Compress the rotated files using gzip
+	Compress bool
+}
+
+// RotatingFile is a log file which is rotated once it has become too large or too old - the rotated files are named
+// after the time of rotation: "micasa.log" becomes "micasa-20261017-020304.567.log". It is used as writer of a GoKit
+// logger.
+type RotatingFile struct {
+	filename string
+	opts     RotateOptions
+	// Guards everything below
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// Tracks the compression of rotated files running in the background
+	wg sync.WaitGroup
+}
+
+// NewRotatingFile opens the log file for appending - its directory is created if needed. An existing file has been
+// started when the newest rotated file has been rotated. Without rotated files, the age of an existing file is unknown
+// and it is rotated by age right away.
+func NewRotatingFile(filename string, opts RotateOptions) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, errors.Wrap(err, "Failed to create the directory of the log file")
+	}
+	f := &RotatingFile{filename: filename, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the log file for appending
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open the log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "Failed to access the log file")
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	if f.size > 0 {
+		// The time of modification changes with every entry - the names of the rotated files persist the time the
+		// current file has been started
+		f.openedAt = f.lastRotation()
+	}
+	return nil
+}
+
+// lastRotation returns the time the newest rotated file has been rotated - or the zero time if there is none
+func (f *RotatingFile) lastRotation() time.Time {
+	files, err := f.Rotated()
+	if err != nil || len(files) == 0 {
+		return time.Time{}
+	}
+	t, _ := f.rotationTime(filepath.Base(files[0]))
+	return t
+}
+
+// rotationTime returns the time of rotation encoded in the name of a rotated file
+func (f *RotatingFile) rotationTime(name string) (time.Time, bool) {
+	ext := filepath.Ext(f.filename)
+	prefix := strings.TrimSuffix(filepath.Base(f.filename), ext) + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+	t, err := time.Parse(rotateTimeFormat, stamp)
+	return t, err == nil
+}
+
+// Write appends the data to the log file - rotating it before if it would become too large or has become too old
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, errors.New("The log file has been closed")
+	}
+	if f.needsRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// needsRotation checks whether the log file has to be rotated before writing the given number of bytes
+func (f *RotatingFile) needsRotation(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && time.Since(f.openedAt) >= f.opts.MaxAge
+}
+
+// Rotate starts a new log file right away
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return errors.New("The log file has been closed")
+	}
+	return f.rotate()
+}
+
+// rotate renames the current log file and opens a new one - the caller has to hold the lock
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close the log file")
+	}
+	f.file = nil
+	ext := filepath.Ext(f.filename)
+	rotated := strings.TrimSuffix(f.filename, ext) + "-" + time.Now().UTC().Format(rotateTimeFormat) + ext
+	if err := os.Rename(f.filename, rotated); err != nil {
+		// Keep on writing to the current file
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return errors.Wrap(err, "Failed to rotate the log file")
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		if f.opts.Compress {
+			// A file failing to be compressed is kept as it is
+			compress(rotated)
+		}
+		f.prune()
+	}()
+	return nil
+}
+
+// compress replaces a rotated log file by its gzipped version
+func compress(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFile := filename + ".gz.tmp"
+	dst, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	defer dst.Close()
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, filename+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// Rotated returns the rotated log files - the newest first
+func (f *RotatingFile) Rotated() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(f.filename))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list the rotated log files")
+	}
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	var res []string
+	for _, e := range entries {
+		name := e.Name()
+		// A file being compressed is listed once - by its compressed version
+		if e.IsDir() || names[name+".gz"] {
+			continue
+		}
+		if _, ok := f.rotationTime(name); !ok {
+			continue
+		}
+		res = append(res, filepath.Join(filepath.Dir(f.filename), name))
+	}
+	// The names only differ by the time of rotation
+	sort.Sort(sort.Reverse(sort.StringSlice(res)))
+	return res, nil
+}
+
+// prune removes the oldest rotated log files, so only the newest Keep files remain
+func (f *RotatingFile) prune() {
+	if f.opts.Keep <= 0 {
+		return
+	}
+	files, err := f.Rotated()
+	if err != nil {
+		return
+	}
+	for i := f.opts.Keep; i < len(files); i++ {
+		os.Remove(files[i])
+	}
+}
+
+// Close closes the log file - after the rotated files have been compressed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wg.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,125 @@
+package log_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRotatingFile(t *testing.T) {
+	Convey("Having a log directory", t, func() {
+		dir := filepath.Join(os.TempDir(), uuid.NewV4().String())
+		filename := filepath.Join(dir, "logs", "micasa.log")
+
+		Convey("the log file should be rotated once it would become too large", func() {
+			f, err := log.NewRotatingFile(filename, log.RotateOptions{MaxSize: 10, Keep: 2})
+			So(err, ShouldBeNil)
+			for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+				_, err = f.Write([]byte(line))
+				So(err, ShouldBeNil)
+				// The rotated files are named after the time of rotation
+				time.Sleep(2 * time.Millisecond)
+			}
+			So(f.Close(), ShouldBeNil)
+			data, err := ioutil.ReadFile(filename)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "fourth\n")
+			rotated, err := f.Rotated()
+			So(err, ShouldBeNil)
+			So(rotated, ShouldHaveLength, 2)
+			data, err = ioutil.ReadFile(rotated[0])
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "third\n")
+		})
+
+		Convey("the log file should be rotated once it has become too old", func() {
+			f, err := log.NewRotatingFile(filename, log.RotateOptions{MaxAge: 20 * time.Millisecond})
+			So(err, ShouldBeNil)
+			f.Write([]byte("old\n"))
+			f.Write([]byte("still young\n"))
+			time.Sleep(30 * time.Millisecond)
+			f.Write([]byte("new\n"))
+			So(f.Close(), ShouldBeNil)
+			rotated, err := f.Rotated()
+			So(err, ShouldBeNil)
+			So(rotated, ShouldHaveLength, 1)
+			data, _ := ioutil.ReadFile(rotated[0])
+			So(string(data), ShouldEqual, "old\nstill young\n")
+		})
+
+		Convey("the age of an existing log file should survive reopening it", func() {
+			So(os.MkdirAll(filepath.Dir(filename), 0700), ShouldBeNil)
+			So(ioutil.WriteFile(filename, []byte("existing\n"), 0600), ShouldBeNil)
+			rotate := func(rotatedAt time.Time) {
+				name := "micasa-" + rotatedAt.UTC().Format("20060102-150405.000") + ".log"
+				So(ioutil.WriteFile(filepath.Join(dir, "logs", name), []byte("rotated\n"), 0600), ShouldBeNil)
+			}
+			rotated := func(opts log.RotateOptions) []string {
+				f, err := log.NewRotatingFile(filename, opts)
+				So(err, ShouldBeNil)
+				f.Write([]byte("new\n"))
+				So(f.Close(), ShouldBeNil)
+				files, err := f.Rotated()
+				So(err, ShouldBeNil)
+				return files
+			}
+
+			// The file has been modified just now, but started with the last rotation
+			rotate(time.Now().Add(-2 * time.Hour))
+			So(rotated(log.RotateOptions{MaxAge: 3 * time.Hour}), ShouldHaveLength, 1)
+			So(rotated(log.RotateOptions{MaxAge: time.Hour}), ShouldHaveLength, 2)
+		})
+
+		Convey("an existing log file of unknown age should be rotated by age", func() {
+			So(os.MkdirAll(filepath.Dir(filename), 0700), ShouldBeNil)
+			So(ioutil.WriteFile(filename, []byte("existing\n"), 0600), ShouldBeNil)
+			f, err := log.NewRotatingFile(filename, log.RotateOptions{MaxAge: time.Hour})
+			So(err, ShouldBeNil)
+			f.Write([]byte("new\n"))
+			So(f.Close(), ShouldBeNil)
+			files, err := f.Rotated()
+			So(err, ShouldBeNil)
+			So(files, ShouldHaveLength, 1)
+		})
+
+		Convey("rotated files should be compressed if requested", func() {
+			f, err := log.NewRotatingFile(filename, log.RotateOptions{Compress: true})
+			So(err, ShouldBeNil)
+			f.Write([]byte("compress me\n"))
+			So(f.Rotate(), ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			rotated, err := f.Rotated()
+			So(err, ShouldBeNil)
+			So(rotated, ShouldHaveLength, 1)
+			So(strings.HasSuffix(rotated[0], ".log.gz"), ShouldBeTrue)
+			gz, err := os.Open(rotated[0])
+			So(err, ShouldBeNil)
+			defer gz.Close()
+			zr, err := gzip.NewReader(gz)
+			So(err, ShouldBeNil)
+			data, err := ioutil.ReadAll(zr)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "compress me\n")
+		})
+
+		Convey("writing to a closed file should fail", func() {
+			f, err := log.NewRotatingFile(filename, log.RotateOptions{})
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			_, err = f.Write([]byte("lost\n"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
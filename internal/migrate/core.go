@@ -0,0 +1,132 @@
+package migrate
+
+// CoreModule is the name of the module holding the migrations of MiCasa's own tables
+const CoreModule = "core"
+
+// coreMigrations create the tables of the users, roles, sessions and API tokens. They have been part of a single
+// sequence before modules have been introduced - so they stay together to keep the existing databases valid. The
+// queries must not be changed - not even their indentation - as their checksums are stored in the databases.
+var coreMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create users table",
+		Queries: []string{
+			`CREATE TABLE Users (
+					userid	VARCHAR(32) NOT NULL,
+					name	VARCHAR(64) NOT NULL UNIQUE ON CONFLICT ABORT,
+					passwordHash	VARCHAR(128) NOT NULL DEFAULT '',
+					fullName	VARCHAR(128) NOT NULL DEFAULT '',
+					createdAt	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					updatedAt	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY(userid)
+				);`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS Users;`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add roles and permissions",
+		Queries: []string{
+			`CREATE TABLE Roles (
+					roleid	VARCHAR(32) NOT NULL,
+					name	VARCHAR(64) NOT NULL UNIQUE ON CONFLICT ABORT,
+					description	VARCHAR(256) NOT NULL DEFAULT '',
+					builtIn	INTEGER NOT NULL DEFAULT 0,
+					createdAt	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					updatedAt	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY(roleid)
+				);`,
+			`CREATE TABLE RolePermissions (
+					roleid	VARCHAR(32) NOT NULL,
+					permission	VARCHAR(128) NOT NULL,
+					PRIMARY KEY(roleid, permission)
+				);`,
+			`CREATE TABLE UserRoles (
+					userid	VARCHAR(32) NOT NULL,
+					roleid	VARCHAR(32) NOT NULL,
+					PRIMARY KEY(userid, roleid)
+				);`,
+			`CREATE TRIGGER DeleteUserRoles AFTER DELETE ON Users BEGIN
+					DELETE FROM UserRoles WHERE userid = OLD.userid;
+				END;`,
+			`CREATE TRIGGER DeleteRole AFTER DELETE ON Roles BEGIN
+					DELETE FROM RolePermissions WHERE roleid = OLD.roleid;
+					DELETE FROM UserRoles WHERE roleid = OLD.roleid;
+				END;`,
+			`INSERT INTO Roles(roleid, name, description, builtIn) VALUES
+					('admin', 'Administrator', 'Full access to MiCasa', 1),
+					('member', 'Member', 'Can view and control all devices', 1),
+					('guest', 'Guest', 'Can view all devices', 1);`,
+			`INSERT INTO RolePermissions(roleid, permission) VALUES
+					('admin', '*'),
+					('member', 'devices.view'),
+					('member', 'devices.control'),
+					('guest', 'devices.view');`,
+			// Existing users had full access before roles were introduced
+			`INSERT INTO UserRoles(userid, roleid) SELECT userid, 'admin' FROM Users;`,
+		},
+		Down: []string{
+			`DROP TRIGGER IF EXISTS DeleteRole;`,
+			`DROP TRIGGER IF EXISTS DeleteUserRoles;`,
+			`DROP TABLE IF EXISTS UserRoles;`,
+			`DROP TABLE IF EXISTS RolePermissions;`,
+			`DROP TABLE IF EXISTS Roles;`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "Add login sessions",
+		Queries: []string{
+			`CREATE TABLE Sessions (
+					sessionid	VARCHAR(32) NOT NULL,
+					userid	VARCHAR(32) NOT NULL,
+					tokenHash	VARCHAR(64) NOT NULL UNIQUE ON CONFLICT ABORT,
+					ip	VARCHAR(64) NOT NULL DEFAULT '',
+					userAgent	VARCHAR(256) NOT NULL DEFAULT '',
+					createdAt	DATETIME NOT NULL,
+					lastSeen	DATETIME NOT NULL,
+					expiresAt	DATETIME NOT NULL,
+					PRIMARY KEY(sessionid)
+				);`,
+			`CREATE INDEX SessionsByUser ON Sessions(userid);`,
+			`CREATE TRIGGER DeleteUserSessions AFTER DELETE ON Users BEGIN
+					DELETE FROM Sessions WHERE userid = OLD.userid;
+				END;`,
+		},
+		Down: []string{
+			`DROP TRIGGER IF EXISTS DeleteUserSessions;`,
+			`DROP TABLE IF EXISTS Sessions;`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "Add API tokens",
+		Queries: []string{
+			`CREATE TABLE ApiTokens (
+					tokenid	VARCHAR(32) NOT NULL,
+					userid	VARCHAR(32) NOT NULL,
+					name	VARCHAR(64) NOT NULL,
+					tokenHash	VARCHAR(64) NOT NULL UNIQUE ON CONFLICT ABORT,
+					scopes	TEXT NOT NULL DEFAULT '',
+					createdAt	DATETIME NOT NULL,
+					expiresAt	DATETIME,
+					lastUsed	DATETIME,
+					PRIMARY KEY(tokenid),
+					UNIQUE(userid, name) ON CONFLICT ABORT
+				);`,
+			`CREATE TRIGGER DeleteUserApiTokens AFTER DELETE ON Users BEGIN
+					DELETE FROM ApiTokens WHERE userid = OLD.userid;
+				END;`,
+		},
+		Down: []string{
+			`DROP TRIGGER IF EXISTS DeleteUserApiTokens;`,
+			`DROP TABLE IF EXISTS ApiTokens;`,
+		},
+	},
+}
+
+func init() {
+	Register(Module{Name: CoreModule, Migrations: coreMigrations})
+}
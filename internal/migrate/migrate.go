@@ -1,88 +1,543 @@
-// Package migrate performs simple database migrations
+// Package migrate performs simple database migrations.
+//
+// The migrations are grouped into modules - each package owning tables registers its own module using Register,
+// usually inside its init() function. Modules are migrated after the modules they depend on.
 package migrate
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/derWhity/micasa/internal/log"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 )
 
-var migrations []dbMigration
-
-type dbMigration struct {
+// Migration migrates the database of a module to a certain version
+type Migration struct {
+	// The version of the module's schema after the migration - versions start at 1
 	Version uint
+	// A short description of what the migration does
+	Description string
+	// The queries migrating the database to this version
 	Queries []string
+	// An optional data migration executed after the queries - inside the same transaction
+	UpFunc func(tx *sqlx.Tx) error
+	// The queries reverting the changes of Queries - they have to work on a half-applied migration, too
+	Down []string
+	// An optional function reverting the changes of UpFunc - executed before the Down queries
+	DownFunc func(tx *sqlx.Tx) error
+}
+
+// Module is a named set of migrations
+type Module struct {
+	// The unique name of the module
+	Name string
+	// The names of the modules whose migrations have to be executed before the ones of this module
+	DependsOn []string
+	// The migrations of the module ordered by version
+	Migrations []Migration
+}
+
+// modules contains all registered modules by name
+var modules = map[string]*Module{}
+
+// Register registers the migrations of a module. It panics if the module is registered twice or its migrations are
+// not ordered by version.
+func Register(m Module) {
+	if m.Name == "" {
+		panic("migrate: Register called without module name")
+	}
+	if _, ok := modules[m.Name]; ok {
+		panic(fmt.Sprintf("migrate: module '%s' registered twice", m.Name))
+	}
+	var last uint
+	for _, mig := range m.Migrations {
+		if mig.Version <= last {
+			panic(fmt.Sprintf("migrate: migrations of module '%s' are not ordered by version", m.Name))
+		}
+		last = mig.Version
+	}
+	modules[m.Name] = &m
+}
+
+// executedMigration is the bookkeeping entry of a migration inside the Migrations table
+type executedMigration struct {
+	Module    string     `db:"module"`
+	Version   uint       `db:"version"`
+	Success   bool       `db:"success"`
+	Checksum  string     `db:"checksum"`
+	AppliedAt *time.Time `db:"appliedAt"`
+	// The execution time in milliseconds
+	Duration int64 `db:"duration"`
+}
+
+// Status describes the state of a single migration inside a database
+type Status struct {
+	// The module the migration belongs to
+	Module string `json:"module"`
+	// The version the migration migrates the module to
+	Version uint `json:"version"`
+	// A short description of what the migration does
+	Description string `json:"description,omitempty"`
+	// Set if the migration has been executed successfully
+	Applied bool `json:"applied"`
+	// Set if the migration has been executed, but failed
+	Failed bool `json:"failed"`
+	// Set if the migration has been changed after it has been applied
+	Modified bool `json:"modified"`
+	// Set if the migration can be rolled back
+	Reversible bool `json:"reversible"`
+	// The time the migration has been executed - omitted for pending migrations
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+	// The time it took to execute the migration
+	Duration time.Duration `json:"duration"`
+}
+
+// Checksum returns the SHA-256 checksum of the migration's queries - data migration functions are not covered
+func (mig *Migration) Checksum() string {
+	hash := sha256.New()
+	for _, query := range mig.Queries {
+		hash.Write([]byte(query))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// Execute runs the current DB migration on the given database
-func (mig *dbMigration) Execute(db *sqlx.DB, log log.Logger) error {
-	// Check if the migration has already run
-	query := `SELECT success FROM Migrations WHERE version = $1`
-	var success = false
-	err := db.QueryRow(query, mig.Version).Scan(&success)
+// reversible checks if the migration can be rolled back
+func (mig *Migration) reversible() bool {
+	return len(mig.Down) > 0 || mig.DownFunc != nil
+}
+
+// title returns the name of the migration used in log messages
+func (mig *Migration) title(module string) string {
+	if mig.Description == "" {
+		return fmt.Sprintf("%s #%d", module, mig.Version)
+	}
+	return fmt.Sprintf("%s #%d (%s)", module, mig.Version, mig.Description)
+}
+
+// runInTransaction executes the queries inside a single transaction. The optional functions are called before and
+// after the queries - e.g. for running a data migration and doing the bookkeeping. Nothing is changed if any of the
+// steps fails.
+func runInTransaction(db *sqlx.DB, log log.Logger, queries []string, before, after func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
 	if err != nil {
-		switch {
-		case err != sql.ErrNoRows:
-			log.Error("Failed to fetch version information", err)
+		return errors.Wrap(err, "Failed to start transaction")
+	}
+	if before != nil {
+		if err := before(tx); err != nil {
+			tx.Rollback()
 			return err
 		}
 	}
-	if !success {
-		// We need to execute this migration
-		log.Info(fmt.Sprintf("Executing DB migration #%d", mig.Version))
-		for i, query := range mig.Queries {
-			log.Info(fmt.Sprintf("Query %d of %d...", (i + 1), len(mig.Queries)))
-			if _, err := db.Exec(query); err != nil {
-				log.Error(fmt.Sprintf("Query #%d failed", (i+1)), err)
-				db.Exec(`REPLACE INTO Migrations(version, success) VALUES($1, 0)`, mig.Version)
-				return err
+	for i, query := range queries {
+		log.Info(fmt.Sprintf("Query %d of %d...", (i + 1), len(queries)))
+		if _, err := tx.Exec(query); err != nil {
+			log.Error(fmt.Sprintf("Query #%d failed", (i+1)), err)
+			tx.Rollback()
+			return err
+		}
+	}
+	if after != nil {
+		if err := after(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit transaction")
+}
+
+// execute runs the migration of the given module on the database
+func (mig *Migration) execute(db *sqlx.DB, log log.Logger, module string) error {
+	log.Info(fmt.Sprintf("Executing DB migration %s", mig.title(module)))
+	start := time.Now()
+	err := runInTransaction(db, log, mig.Queries, nil, func(tx *sqlx.Tx) error {
+		if mig.UpFunc != nil {
+			log.Info("Migrating data...")
+			if err := mig.UpFunc(tx); err != nil {
+				return errors.Wrap(err, "Data migration failed")
 			}
 		}
-		// Queries executed successfully - save our status
-		db.Exec(`REPLACE INTO Migrations(version, success) VALUES($1, 1)`, mig.Version)
+		_, err := tx.Exec(
+			`REPLACE INTO Migrations(module, version, success, checksum, appliedAt, duration)
+				VALUES($1, $2, 1, $3, $4, $5)`,
+			module,
+			mig.Version,
+			mig.Checksum(),
+			start.UTC().Truncate(time.Second),
+			time.Since(start).Nanoseconds()/int64(time.Millisecond),
+		)
+		return errors.Wrap(err, "Failed to update the migrations table")
+	})
+	if err != nil {
+		// The transaction has been rolled back - just remember that the migration has failed
+		if _, bookErr := db.Exec(
+			`REPLACE INTO Migrations(module, version, success, checksum, appliedAt) VALUES($1, $2, 0, $3, $4)`,
+			module,
+			mig.Version,
+			mig.Checksum(),
+			start.UTC().Truncate(time.Second),
+		); bookErr != nil {
+			log.Error(fmt.Sprintf("Failed to record the failure of migration %s", mig.title(module)), bookErr)
+		}
+		return err
 	}
 	return nil
 }
 
-// ExecuteMigrationsOnDb executes the database migrations on the given database instance
-func ExecuteMigrationsOnDb(db *sqlx.DB, log log.Logger) error {
-	// Create the migrations table if it does not exist, yet
+// revert rolls back the migration of the given module on the database
+func (mig *Migration) revert(db *sqlx.DB, log log.Logger, module string) error {
+	log.Info(fmt.Sprintf("Reverting DB migration %s", mig.title(module)))
+	var before func(tx *sqlx.Tx) error
+	if mig.DownFunc != nil {
+		before = func(tx *sqlx.Tx) error {
+			log.Info("Reverting data migration...")
+			return errors.Wrap(mig.DownFunc(tx), "Reverting the data migration failed")
+		}
+	}
+	return runInTransaction(db, log, mig.Down, before, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`DELETE FROM Migrations WHERE module = $1 AND version = $2`, module, mig.Version)
+		return errors.Wrap(err, "Failed to update the migrations table")
+	})
+}
+
+// printQueries writes the given queries to w instead of executing them
+func printQueries(w io.Writer, title string, queries []string, hasFunc bool) {
+	fmt.Fprintf(w, "-- %s\n", title)
+	for _, query := range queries {
+		query = strings.TrimSpace(query)
+		if !strings.HasSuffix(query, ";") {
+			query += ";"
+		}
+		fmt.Fprintln(w, query)
+	}
+	if hasFunc {
+		fmt.Fprintln(w, "-- (plus a data migration implemented in Go)")
+	}
+	fmt.Fprintln(w)
+}
+
+// orderedModules returns the registered modules in the order they have to be migrated - every module follows the
+// modules it depends on, otherwise they are ordered by name
+func orderedModules() ([]*Module, error) {
+	names := make([]string, 0, len(modules))
+	for name, m := range modules {
+		for _, dep := range m.DependsOn {
+			if _, ok := modules[dep]; !ok {
+				return nil, errors.Errorf("Module '%s' depends on the unknown module '%s'", name, dep)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*Module, 0, len(names))
+	done := map[string]bool{}
+	for len(res) < len(names) {
+		progress := false
+		for _, name := range names {
+			m := modules[name]
+			if done[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range m.DependsOn {
+				ready = ready && done[dep]
+			}
+			if ready {
+				res = append(res, m)
+				done[name] = true
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			return nil, errors.New("The dependencies between the migration modules are circular")
+		}
+	}
+	return res, nil
+}
+
+// dependsOn checks if module a depends on module b - directly or indirectly
+func dependsOn(a string, b string) bool {
+	for _, dep := range modules[a].DependsOn {
+		if dep == b || dependsOn(dep, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// createMigrationsTable creates the migrations table if it does not exist, yet - and upgrades tables created by
+// older versions
+func createMigrationsTable(db *sqlx.DB) error {
 	query := `CREATE TABLE IF NOT EXISTS Migrations (
+                module    VARCHAR(64) NOT NULL,
                 version   INTEGER NOT NULL,
                 success   INTEGER NOT NULL DEFAULT 0,
-                PRIMARY KEY(version)
+                checksum  VARCHAR(64) NOT NULL DEFAULT '',
+                appliedAt DATETIME,
+                duration  INTEGER NOT NULL DEFAULT 0,
+                PRIMARY KEY(module, version)
             )`
 	if _, err := db.Exec(query); err != nil {
-		log.Error("Failed to create migrations table", err)
+		return errors.Wrap(err, "Failed to create migrations table")
+	}
+	var columns []string
+	if err := db.Select(&columns, `SELECT name FROM pragma_table_info('Migrations')`); err != nil {
+		return errors.Wrap(err, "Failed to read the columns of the migrations table")
+	}
+	has := map[string]bool{}
+	for _, c := range columns {
+		has[c] = true
+	}
+	var upgrade []string
+	if !has["checksum"] {
+		upgrade = append(upgrade,
+			`ALTER TABLE Migrations ADD COLUMN checksum VARCHAR(64) NOT NULL DEFAULT ''`,
+			`ALTER TABLE Migrations ADD COLUMN appliedAt DATETIME`,
+			`ALTER TABLE Migrations ADD COLUMN duration INTEGER NOT NULL DEFAULT 0`,
+		)
+	}
+	if !has["module"] {
+		// The migrations of older versions all belong to the core module - as the primary key changes, the table
+		// has to be copied
+		upgrade = append(upgrade,
+			`ALTER TABLE Migrations RENAME TO MigrationsOld`,
+			query,
+			`INSERT INTO Migrations(module, version, success, checksum, appliedAt, duration)
+				SELECT '`+CoreModule+`', version, success, checksum, appliedAt, duration FROM MigrationsOld`,
+			`DROP TABLE MigrationsOld`,
+		)
+	}
+	if len(upgrade) == 0 {
+		return nil
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start transaction")
+	}
+	for _, query := range upgrade {
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "Failed to upgrade the migrations table")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "Failed to upgrade the migrations table")
+}
+
+// executedMigrations returns the bookkeeping entries of all migrations that have been executed by module and
+// version - without creating the migrations table
+func executedMigrations(db *sqlx.DB) (map[string]map[uint]executedMigration, error) {
+	var exists int
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'Migrations'`
+	if err := db.Get(&exists, query); err != nil {
+		return nil, errors.Wrap(err, "Failed to check for the migrations table")
+	}
+	res := map[string]map[uint]executedMigration{}
+	if exists == 0 {
+		return res, nil
+	}
+	var list []executedMigration
+	if err := db.Select(&list, `SELECT * FROM Migrations`); err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch version information")
+	}
+	for _, e := range list {
+		if e.Module == "" {
+			// Not upgraded yet
+			e.Module = CoreModule
+		}
+		if res[e.Module] == nil {
+			res[e.Module] = map[uint]executedMigration{}
+		}
+		res[e.Module][e.Version] = e
+	}
+	return res, nil
+}
+
+// verifyChecksums makes sure that none of the applied migrations has been changed afterwards. Migrations applied
+// before checksums have been introduced get the checksum of their current queries.
+func verifyChecksums(db *sqlx.DB, executed map[string]map[uint]executedMigration, dryRun bool) error {
+	for name, m := range modules {
+		for _, mig := range m.Migrations {
+			e, ok := executed[name][mig.Version]
+			if !ok || !e.Success {
+				continue
+			}
+			if e.Checksum == "" {
+				if dryRun {
+					continue
+				}
+				query := `UPDATE Migrations SET checksum = $1 WHERE module = $2 AND version = $3`
+				if _, err := db.Exec(query, mig.Checksum(), name, mig.Version); err != nil {
+					return errors.Wrap(err, "Failed to store the migration checksum")
+				}
+			} else if e.Checksum != mig.Checksum() {
+				return errors.Errorf(
+					"Migration %s has been changed after it has been applied - refusing to migrate the database",
+					mig.title(name),
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// LatestVersion returns the version of the newest migration of the given module - 0 if the module is unknown
+func LatestVersion(module string) uint {
+	m, ok := modules[module]
+	if !ok || len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// GetStatus returns the state of all known migrations inside the given database - the modules in the order they are
+// migrated, their migrations ordered by version
+func GetStatus(db *sqlx.DB) ([]Status, error) {
+	ordered, err := orderedModules()
+	if err != nil {
+		return nil, err
+	}
+	executed, err := executedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var res []Status
+	for _, m := range ordered {
+		for _, mig := range m.Migrations {
+			e, ok := executed[m.Name][mig.Version]
+			res = append(res, Status{
+				Module:      m.Name,
+				Version:     mig.Version,
+				Description: mig.Description,
+				Applied:     ok && e.Success,
+				Failed:      ok && !e.Success,
+				Modified:    ok && e.Success && e.Checksum != "" && e.Checksum != mig.Checksum(),
+				Reversible:  mig.reversible(),
+				AppliedAt:   e.AppliedAt,
+				Duration:    time.Duration(e.Duration) * time.Millisecond,
+			})
+		}
+	}
+	return res, nil
+}
+
+// MigrateUp executes the pending migrations. If a module is given, only this module and the modules it depends on
+// are migrated - the module itself up to and including the given version; 0 migrates to the latest version. Without
+// a module, all modules are migrated to their latest version.
+//
+// Each migration is executed inside a transaction; a failed migration is executed again. Migrating fails if an
+// applied migration has been changed afterwards. If dryRun is set, the SQL is written to it instead of being executed.
+func MigrateUp(db *sqlx.DB, log log.Logger, module string, to uint, dryRun io.Writer) error {
+	if module != "" {
+		if _, ok := modules[module]; !ok {
+			return errors.Errorf("Unknown migration module '%s'", module)
+		}
+		if to > LatestVersion(module) {
+			return errors.Errorf(
+				"Unknown migration version %d - the latest version of module '%s' is %d",
+				to, module, LatestVersion(module),
+			)
+		}
+	}
+	ordered, err := orderedModules()
+	if err != nil {
 		return err
 	}
-	for _, mig := range migrations {
-		if err := mig.Execute(db, log); err != nil {
-			log.Error(fmt.Sprintf("Failed to execute migration #%d", mig.Version), err)
+	if dryRun == nil {
+		if err := createMigrationsTable(db); err != nil {
+			log.Error("Failed to create migrations table", err)
 			return err
 		}
 	}
+	executed, err := executedMigrations(db)
+	if err != nil {
+		log.Error("Failed to fetch version information", err)
+		return err
+	}
+	if err := verifyChecksums(db, executed, dryRun != nil); err != nil {
+		log.Error("Failed to verify the applied migrations", err)
+		return err
+	}
+	for _, m := range ordered {
+		target := LatestVersion(m.Name)
+		if module != "" {
+			if m.Name == module && to > 0 {
+				target = to
+			} else if m.Name != module && !dependsOn(module, m.Name) {
+				continue
+			}
+		}
+		for _, mig := range m.Migrations {
+			if mig.Version > target || executed[m.Name][mig.Version].Success {
+				continue
+			}
+			if dryRun != nil {
+				printQueries(dryRun, fmt.Sprintf("Migration %s (up)", mig.title(m.Name)), mig.Queries, mig.UpFunc != nil)
+				continue
+			}
+			if err := mig.execute(db, log, m.Name); err != nil {
+				log.Error(fmt.Sprintf("Failed to execute migration %s", mig.title(m.Name)), err)
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// For now, the migrations are part of the package...
-func init() {
-	migrations = []dbMigration{
-		{
-			Version: 1,
-			Queries: []string{
-				`CREATE TABLE Users (
-					userid	VARCHAR(32) NOT NULL,
-					name	VARCHAR(64) NOT NULL UNIQUE ON CONFLICT ABORT,
-					passwordHash	VARCHAR(128) NOT NULL DEFAULT '',
-					fullName	VARCHAR(128) NOT NULL DEFAULT '',
-					createdAt	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-					updatedAt	DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-					PRIMARY KEY(userid)
-				);`,
-			},
-		},
+// MigrateDown rolls back all executed migrations of the module - including failed ones - newer than the given version,
+// starting with the newest one. Modules depending on the module have to be rolled back completely before. Each
+// migration is rolled back inside a transaction. If dryRun is set, the SQL is written to it instead of being executed.
+func MigrateDown(db *sqlx.DB, log log.Logger, module string, to uint, dryRun io.Writer) error {
+	m, ok := modules[module]
+	if !ok {
+		return errors.Errorf("Unknown migration module '%s'", module)
 	}
+	executed, err := executedMigrations(db)
+	if err != nil {
+		log.Error("Failed to fetch version information", err)
+		return err
+	}
+	var pending []Migration
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		mig := m.Migrations[i]
+		if _, ok := executed[module][mig.Version]; !ok || mig.Version <= to {
+			continue
+		}
+		if !mig.reversible() {
+			// Check this before touching the database - we do not want to stop halfway
+			return errors.Errorf("Migration %s cannot be rolled back", mig.title(module))
+		}
+		pending = append(pending, mig)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	for name := range modules {
+		if len(executed[name]) > 0 && dependsOn(name, module) {
+			return errors.Errorf("Module '%s' depends on module '%s' - it has to be rolled back first", name, module)
+		}
+	}
+	for _, mig := range pending {
+		if dryRun != nil {
+			printQueries(dryRun, fmt.Sprintf("Migration %s (down)", mig.title(module)), mig.Down, mig.DownFunc != nil)
+			continue
+		}
+		if err := mig.revert(db, log, module); err != nil {
+			log.Error(fmt.Sprintf("Failed to revert migration %s", mig.title(module)), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ExecuteMigrationsOnDb executes the database migrations of all registered modules on the given database instance
+func ExecuteMigrationsOnDb(db *sqlx.DB, log log.Logger) error {
+	return MigrateUp(db, log, "", 0, nil)
 }
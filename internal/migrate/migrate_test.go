@@ -0,0 +1,250 @@
+package migrate
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/fsutils"
+	"github.com/derWhity/micasa/internal/log"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3" // Just needed for the sqlite driver
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var testDbName = filepath.Join(os.TempDir(), uuid.NewV4().String(), "test.db")
+
+func setupTestDB(logger log.Logger) (*sqlx.DB, error) {
+	teardownTestDB(nil)
+	fsutils.CheckAndCreateDir(filepath.Dir(testDbName), logger)
+	return sqlx.Open("sqlite3", testDbName)
+}
+
+func teardownTestDB(db *sqlx.DB) {
+	if db != nil {
+		db.Close()
+	}
+	os.RemoveAll(filepath.Dir(testDbName))
+}
+
+// withModules replaces the registered modules by the given ones - the returned function restores them
+func withModules(mods ...Module) func() {
+	saved := modules
+	modules = map[string]*Module{}
+	for _, m := range mods {
+		Register(m)
+	}
+	return func() { modules = saved }
+}
+
+// tableExists checks if the given table exists in the database
+func tableExists(db *sqlx.DB, name string) bool {
+	var num int
+	err := db.Get(&num, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, name)
+	So(err, ShouldBeNil)
+	return num > 0
+}
+
+// appliedVersions returns the versions of all successfully applied migrations
+func appliedVersions(db *sqlx.DB) []uint {
+	status, err := GetStatus(db)
+	So(err, ShouldBeNil)
+	res := []uint{}
+	for _, s := range status {
+		if s.Applied {
+			res = append(res, s.Version)
+		}
+	}
+	return res
+}
+
+func TestMigrations(t *testing.T) {
+	Convey("Having an empty database", t, func() {
+		logger := log.New(kitlog.NewNopLogger(), log.LvlDebug)
+		db, err := setupTestDB(logger)
+		So(err, ShouldBeNil)
+
+		Convey("All migrations should be pending", func() {
+			status, err := GetStatus(db)
+			So(err, ShouldBeNil)
+			So(status, ShouldHaveLength, len(coreMigrations))
+			for _, s := range status {
+				So(s.Applied, ShouldBeFalse)
+				So(s.Failed, ShouldBeFalse)
+				So(s.Reversible, ShouldBeTrue)
+			}
+			So(tableExists(db, "Migrations"), ShouldBeFalse)
+		})
+
+		Convey("Migrating up to a given version should only apply the migrations up to this version", func() {
+			So(MigrateUp(db, logger, CoreModule, 2, nil), ShouldBeNil)
+			So(appliedVersions(db), ShouldResemble, []uint{1, 2})
+			So(tableExists(db, "Roles"), ShouldBeTrue)
+			So(tableExists(db, "Sessions"), ShouldBeFalse)
+
+			Convey("A dry-run should print the SQL of the pending migrations without executing it", func() {
+				var buf bytes.Buffer
+				So(MigrateUp(db, logger, CoreModule, 0, &buf), ShouldBeNil)
+				So(buf.String(), ShouldContainSubstring, "-- Migration core #3 (Add login sessions) (up)")
+				So(buf.String(), ShouldContainSubstring, "CREATE TABLE Sessions")
+				So(buf.String(), ShouldNotContainSubstring, "CREATE TABLE Roles")
+				So(appliedVersions(db), ShouldResemble, []uint{1, 2})
+			})
+		})
+
+		Convey("Migrating up to an unknown version should fail", func() {
+			So(MigrateUp(db, logger, CoreModule, LatestVersion(CoreModule)+1, nil), ShouldNotBeNil)
+			So(tableExists(db, "Users"), ShouldBeFalse)
+		})
+
+		Convey("Having all migrations applied", func() {
+			So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+			So(appliedVersions(db), ShouldHaveLength, len(coreMigrations))
+
+			Convey("Migrating down should revert the newer migrations", func() {
+				So(MigrateDown(db, logger, CoreModule, 2, nil), ShouldBeNil)
+				So(appliedVersions(db), ShouldResemble, []uint{1, 2})
+				So(tableExists(db, "Roles"), ShouldBeTrue)
+				So(tableExists(db, "Sessions"), ShouldBeFalse)
+				So(tableExists(db, "ApiTokens"), ShouldBeFalse)
+
+				Convey("and migrating up again should restore them", func() {
+					So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+					So(appliedVersions(db), ShouldHaveLength, len(coreMigrations))
+					So(tableExists(db, "ApiTokens"), ShouldBeTrue)
+				})
+			})
+
+			Convey("Migrating down to version 0 should remove everything", func() {
+				So(MigrateDown(db, logger, CoreModule, 0, nil), ShouldBeNil)
+				So(appliedVersions(db), ShouldBeEmpty)
+				So(tableExists(db, "Users"), ShouldBeFalse)
+			})
+
+			Convey("A dry-run should print the SQL in reverse order without executing it", func() {
+				var buf bytes.Buffer
+				So(MigrateDown(db, logger, CoreModule, 2, &buf), ShouldBeNil)
+				out := buf.String()
+				So(out, ShouldContainSubstring, "DROP TABLE IF EXISTS Sessions;")
+				So(bytes.Index(buf.Bytes(), []byte("#4")), ShouldBeLessThan, bytes.Index(buf.Bytes(), []byte("#3")))
+				So(tableExists(db, "Sessions"), ShouldBeTrue)
+			})
+
+			Convey("Migrating down should fail without changes if a migration cannot be rolled back", func() {
+				changed := append([]Migration{}, coreMigrations...)
+				changed[2].Down = nil
+				defer withModules(Module{Name: CoreModule, Migrations: changed})()
+				So(MigrateDown(db, logger, CoreModule, 0, nil), ShouldNotBeNil)
+				So(appliedVersions(db), ShouldHaveLength, len(coreMigrations))
+			})
+		})
+
+		Convey("Applying the migrations should store their checksum, execution time and duration", func() {
+			before := time.Now().UTC().Truncate(time.Second)
+			So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+			executed, err := executedMigrations(db)
+			So(err, ShouldBeNil)
+			So(executed[CoreModule], ShouldHaveLength, len(coreMigrations))
+			for _, mig := range coreMigrations {
+				e := executed[CoreModule][mig.Version]
+				So(e.Success, ShouldBeTrue)
+				So(e.Checksum, ShouldEqual, mig.Checksum())
+				So(e.AppliedAt, ShouldNotBeNil)
+				So(e.AppliedAt.Before(before), ShouldBeFalse)
+				So(e.Duration, ShouldBeGreaterThanOrEqualTo, 0)
+			}
+		})
+
+		Convey("Having a migration that fails halfway", func() {
+			defer withModules(Module{Name: CoreModule, Migrations: append(append([]Migration{}, coreMigrations...), Migration{
+				Version: LatestVersion(CoreModule) + 1,
+				Queries: []string{
+					`CREATE TABLE Broken (id INTEGER NOT NULL);`,
+					`INSERT INTO NotExisting(id) VALUES(1);`,
+				},
+				Down: []string{`DROP TABLE IF EXISTS Broken;`},
+			})})()
+
+			Convey("migrating should fail without leaving anything of the migration behind", func() {
+				So(ExecuteMigrationsOnDb(db, logger), ShouldNotBeNil)
+				So(tableExists(db, "Broken"), ShouldBeFalse)
+				So(appliedVersions(db), ShouldHaveLength, len(coreMigrations))
+				status, err := GetStatus(db)
+				So(err, ShouldBeNil)
+				So(status[len(status)-1].Failed, ShouldBeTrue)
+			})
+		})
+
+		Convey("Having a migration that has been changed after being applied", func() {
+			So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+			changed := append([]Migration{}, coreMigrations...)
+			changed[1].Queries = append([]string{`SELECT 1;`}, changed[1].Queries...)
+			defer withModules(Module{Name: CoreModule, Migrations: changed})()
+
+			Convey("the status should report it as modified", func() {
+				status, err := GetStatus(db)
+				So(err, ShouldBeNil)
+				So(status[0].Modified, ShouldBeFalse)
+				So(status[1].Modified, ShouldBeTrue)
+			})
+
+			Convey("migrating should be refused", func() {
+				So(ExecuteMigrationsOnDb(db, logger), ShouldNotBeNil)
+			})
+		})
+
+		Convey("Having a migrations table of an older version", func() {
+			So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+			_, err := db.Exec(`DROP TABLE Migrations`)
+			So(err, ShouldBeNil)
+			_, err = db.Exec(`CREATE TABLE Migrations (
+				version INTEGER NOT NULL, success INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(version)
+			)`)
+			So(err, ShouldBeNil)
+			_, err = db.Exec(`INSERT INTO Migrations(version, success) VALUES(1, 1), (2, 1), (3, 1), (4, 1)`)
+			So(err, ShouldBeNil)
+
+			Convey("migrating should upgrade the table and store the missing checksums", func() {
+				So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+				executed, err := executedMigrations(db)
+				So(err, ShouldBeNil)
+				So(executed[CoreModule][1].Checksum, ShouldEqual, coreMigrations[0].Checksum())
+				So(executed[CoreModule][1].AppliedAt, ShouldBeNil)
+			})
+		})
+
+		Convey("Having a half-applied migration", func() {
+			So(MigrateUp(db, logger, CoreModule, 2, nil), ShouldBeNil)
+			_, err := db.Exec(`CREATE TABLE Sessions (sessionid VARCHAR(32) NOT NULL)`)
+			So(err, ShouldBeNil)
+			_, err = db.Exec(`INSERT INTO Migrations(module, version, success) VALUES('core', 3, 0)`)
+			So(err, ShouldBeNil)
+
+			Convey("the status should report it as failed", func() {
+				status, err := GetStatus(db)
+				So(err, ShouldBeNil)
+				So(status[2].Failed, ShouldBeTrue)
+				So(status[2].Applied, ShouldBeFalse)
+			})
+
+			Convey("migrating up should fail again", func() {
+				So(ExecuteMigrationsOnDb(db, logger), ShouldNotBeNil)
+			})
+
+			Convey("migrating down should clean it up, so it can be applied again", func() {
+				So(MigrateDown(db, logger, CoreModule, 2, nil), ShouldBeNil)
+				So(tableExists(db, "Sessions"), ShouldBeFalse)
+				So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+				So(appliedVersions(db), ShouldHaveLength, len(coreMigrations))
+			})
+		})
+
+		Reset(func() {
+			teardownTestDB(db)
+		})
+	})
+}
@@ -0,0 +1,205 @@
+package migrate
+
+import (
+	"bytes"
+	"embed"
+	"testing"
+	"testing/fstest"
+
+	"github.com/derWhity/micasa/internal/log"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//go:embed testdata
+var testFiles embed.FS
+
+// statsModule is a module with a data migration depending on the devices module
+func statsModule(upErr error) Module {
+	return Module{
+		Name:      "a-stats",
+		DependsOn: []string{"devices"},
+		Migrations: []Migration{
+			{
+				Version:     1,
+				Description: "Count devices",
+				Queries:     []string{`CREATE TABLE Stats (name VARCHAR(64) NOT NULL, value INTEGER NOT NULL);`},
+				UpFunc: func(tx *sqlx.Tx) error {
+					if upErr != nil {
+						return upErr
+					}
+					_, err := tx.Exec(`INSERT INTO Stats(name, value) SELECT 'devices', COUNT(*) FROM Devices`)
+					return err
+				},
+				DownFunc: func(tx *sqlx.Tx) error {
+					_, err := tx.Exec(`DELETE FROM Stats`)
+					return err
+				},
+				Down: []string{`DROP TABLE IF EXISTS Stats;`},
+			},
+		},
+	}
+}
+
+func TestFromFS(t *testing.T) {
+	Convey("Loading migrations from embedded SQL files", t, func() {
+		migs, err := FromFS(testFiles, "testdata/devices")
+		So(err, ShouldBeNil)
+
+		Convey("should return the migrations ordered by version", func() {
+			So(migs, ShouldHaveLength, 2)
+			So(migs[0].Version, ShouldEqual, 1)
+			So(migs[0].Description, ShouldEqual, "create devices")
+			So(migs[0].Queries, ShouldHaveLength, 1)
+			So(migs[0].Queries[0], ShouldContainSubstring, "CREATE TABLE Devices")
+			So(migs[0].Down, ShouldResemble, []string{"DROP TABLE IF EXISTS Devices;\n"})
+			So(migs[1].Version, ShouldEqual, 2)
+			So(migs[1].Description, ShouldEqual, "add rooms")
+			So(migs[1].reversible(), ShouldBeFalse)
+		})
+	})
+
+	Convey("Loading migrations without .up.sql file should fail", t, func() {
+		_, err := FromFS(fstest.MapFS{
+			"sql/0001_test.down.sql": &fstest.MapFile{Data: []byte("DROP TABLE Test;")},
+		}, "sql")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Loading migrations from a missing directory should fail", t, func() {
+		_, err := FromFS(testFiles, "testdata/missing")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRegister(t *testing.T) {
+	Convey("Registering a module", t, func() {
+		defer withModules(Module{Name: CoreModule, Migrations: coreMigrations})()
+
+		Convey("twice should panic", func() {
+			So(func() { Register(Module{Name: CoreModule}) }, ShouldPanic)
+		})
+
+		Convey("without name should panic", func() {
+			So(func() { Register(Module{}) }, ShouldPanic)
+		})
+
+		Convey("with unordered migrations should panic", func() {
+			So(func() {
+				Register(Module{Name: "test", Migrations: []Migration{{Version: 2}, {Version: 1}}})
+			}, ShouldPanic)
+		})
+
+		Convey("depending on an unknown module should make migrating fail", func() {
+			Register(Module{Name: "test", DependsOn: []string{"unknown"}})
+			_, err := orderedModules()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("with circular dependencies should make migrating fail", func() {
+			Register(Module{Name: "a", DependsOn: []string{"b"}})
+			Register(Module{Name: "b", DependsOn: []string{"a"}})
+			_, err := orderedModules()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestModules(t *testing.T) {
+	Convey("Having a database and multiple modules depending on each other", t, func() {
+		logger := log.New(kitlog.NewNopLogger(), log.LvlDebug)
+		db, err := setupTestDB(logger)
+		So(err, ShouldBeNil)
+		restore := withModules(
+			Module{Name: CoreModule, Migrations: coreMigrations},
+			Module{
+				Name:       "devices",
+				DependsOn:  []string{CoreModule},
+				Migrations: MustFromFS(testFiles, "testdata/devices"),
+			},
+			statsModule(nil),
+		)
+
+		Convey("the modules should be ordered by their dependencies", func() {
+			ordered, err := orderedModules()
+			So(err, ShouldBeNil)
+			names := []string{}
+			for _, m := range ordered {
+				names = append(names, m.Name)
+			}
+			So(names, ShouldResemble, []string{CoreModule, "devices", "a-stats"})
+		})
+
+		Convey("migrating all modules should execute the SQL files and the data migrations", func() {
+			So(ExecuteMigrationsOnDb(db, logger), ShouldBeNil)
+			So(tableExists(db, "Users"), ShouldBeTrue)
+			var count int
+			So(db.Get(&count, `SELECT value FROM Stats WHERE name = 'devices'`), ShouldBeNil)
+			So(count, ShouldEqual, 2)
+			status, err := GetStatus(db)
+			So(err, ShouldBeNil)
+			So(status, ShouldHaveLength, len(coreMigrations)+3)
+			for _, s := range status {
+				So(s.Applied, ShouldBeTrue)
+			}
+
+			Convey("rolling back a module other modules depend on should be refused", func() {
+				So(MigrateDown(db, logger, "devices", 1, nil), ShouldNotBeNil)
+				So(tableExists(db, "Devices"), ShouldBeTrue)
+			})
+
+			Convey("rolling back a module with a data migration should revert it", func() {
+				So(MigrateDown(db, logger, "a-stats", 0, nil), ShouldBeNil)
+				So(tableExists(db, "Stats"), ShouldBeFalse)
+				So(tableExists(db, "Devices"), ShouldBeTrue)
+			})
+
+			Convey("rolling back a migration without down queries should fail", func() {
+				So(MigrateDown(db, logger, "a-stats", 0, nil), ShouldBeNil)
+				So(MigrateDown(db, logger, "devices", 0, nil), ShouldNotBeNil)
+				So(tableExists(db, "Devices"), ShouldBeTrue)
+			})
+		})
+
+		Convey("migrating a single module should only migrate it and the modules it depends on", func() {
+			So(MigrateUp(db, logger, "devices", 1, nil), ShouldBeNil)
+			So(tableExists(db, "Users"), ShouldBeTrue)
+			So(tableExists(db, "Devices"), ShouldBeTrue)
+			So(tableExists(db, "Stats"), ShouldBeFalse)
+			status, err := GetStatus(db)
+			So(err, ShouldBeNil)
+			So(status[len(coreMigrations)+1].Applied, ShouldBeFalse)
+		})
+
+		Convey("migrating an unknown module should fail", func() {
+			So(MigrateUp(db, logger, "unknown", 0, nil), ShouldNotBeNil)
+			So(MigrateDown(db, logger, "unknown", 0, nil), ShouldNotBeNil)
+		})
+
+		Convey("a dry-run should mention the data migrations", func() {
+			var buf bytes.Buffer
+			So(MigrateUp(db, logger, "", 0, &buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "-- Migration devices #1 (create devices) (up)")
+			So(buf.String(), ShouldContainSubstring, "-- (plus a data migration implemented in Go)")
+		})
+
+		Convey("a failing data migration should roll back the whole migration", func() {
+			restore()
+			restore = withModules(
+				Module{Name: CoreModule, Migrations: coreMigrations},
+				Module{Name: "devices", Migrations: MustFromFS(testFiles, "testdata/devices")},
+				statsModule(errors.New("Broken")),
+			)
+			So(ExecuteMigrationsOnDb(db, logger), ShouldNotBeNil)
+			So(tableExists(db, "Devices"), ShouldBeTrue)
+			So(tableExists(db, "Stats"), ShouldBeFalse)
+		})
+
+		Reset(func() {
+			restore()
+			teardownTestDB(db)
+		})
+	})
+}
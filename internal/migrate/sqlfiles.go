@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sqlFilePattern matches the names of migration files - e.g. "0001_create_devices.up.sql"
+var sqlFilePattern = regexp.MustCompile(`^(\d+)_([^.]+)\.(up|down)\.sql$`)
+
+// FromFS loads migrations from the .sql files inside a directory of the given file system - usually an embed.FS.
+//
+// The files have to be named "<version>_<description>.up.sql" - e.g. "0001_create_devices.up.sql". The optional file
+// "<version>_<description>.down.sql" rolls the migration back. Each file is executed as a single query, which may
+// consist of multiple statements. Other files inside the directory are ignored.
+func FromFS(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the migrations in '%s'", dir)
+	}
+	byVersion := map[uint]*Migration{}
+	for _, entry := range entries {
+		match := sqlFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil || version == 0 {
+			return nil, errors.Errorf("Invalid migration version in file name '%s'", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read migration file '%s'", entry.Name())
+		}
+		description := strings.Replace(match[2], "_", " ", -1)
+		mig, ok := byVersion[uint(version)]
+		if !ok {
+			mig = &Migration{Version: uint(version), Description: description}
+			byVersion[mig.Version] = mig
+		} else if mig.Description != description {
+			return nil, errors.Errorf("The migration files of version %d have different descriptions", version)
+		}
+		if match[3] == "up" {
+			mig.Queries = []string{string(content)}
+		} else {
+			mig.Down = []string{string(content)}
+		}
+	}
+	res := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if len(mig.Queries) == 0 {
+			return nil, errors.Errorf("Migration %d has no .up.sql file", mig.Version)
+		}
+		res = append(res, *mig)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// MustFromFS is like FromFS, but panics if the migrations cannot be loaded - it is meant for registering embedded
+// migrations inside init()
+func MustFromFS(fsys fs.FS, dir string) []Migration {
+	migs, err := FromFS(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return migs
+}
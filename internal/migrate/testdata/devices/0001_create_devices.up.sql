@@ -0,0 +1,5 @@
+CREATE TABLE Devices (
+	name	VARCHAR(64) NOT NULL,
+	PRIMARY KEY(name)
+);
+INSERT INTO Devices(name) VALUES('lamp'), ('heater');
@@ -0,0 +1 @@
+ALTER TABLE Devices ADD COLUMN room VARCHAR(64) NOT NULL DEFAULT '';
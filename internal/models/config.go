@@ -2,7 +2,9 @@ package models
 
 import (
 	"path"
+	"time"
 
+	"github.com/derWhity/micasa/internal/log"
 	"github.com/kardianos/osext"
 )
 
@@ -13,6 +15,132 @@ type Configuration struct {
 	DataDir string `json:"dataDir"`
 	// The IP address to listen at - including the port number
 	ListenAddress string `json:"listenAddress"`
+	// Connection settings for the FHEM server
+	Fhem FhemConfig `json:"fhem"`
+	// Settings for the login sessions of the web interface
+	Sessions SessionConfig `json:"sessions"`
+	// Settings for the backups of the database and the configuration file
+	Backup BackupConfig `json:"backup"`
+	// The number of previous versions of the configuration file to keep when it is changed - 0 keeps none
+	ConfigHistory int `json:"configHistory"`
+	// Clients allowed to access the API without logging in - or at all
+	Whitelist WhitelistConfig `json:"whitelist"`
+	// Settings for the log output of the server
+	Log LogConfig `json:"log"`
+}
+
+// FhemConfig defines how to connect to the telnet port of the FHEM server
+type FhemConfig struct {
+	// The address of FHEM's telnet port - including the port number
+	Address string `json:"address"`
+	// The password to send when FHEM asks for it - leave empty if the telnet port is not password protected
+	Password string `json:"password,omitempty"`
+	// Connect to FHEM using TLS (needs the SSL attribute to be set on the telnet device)
+	TLS bool `json:"tls"`
+	// Skip the verification of FHEM's TLS certificate - FHEM uses a self-signed certificate by default
+	TLSSkipVerify bool `json:"tlsSkipVerify"`
+	// Timeout in seconds for establishing the connection and for executing a single command
+	Timeout int `json:"timeout"`
+	// The maximum time in seconds to wait between two reconnection attempts
+	MaxReconnectDelay int `json:"maxReconnectDelay"`
+	// The inform mode used for receiving events: "timer" (events carry FHEM's timestamp) or "on"
+	InformMode string `json:"informMode"`
+}
+
+// SessionConfig defines how long login sessions are valid and how their cookies are sent
+type SessionConfig struct {
+	// The number of hours a session stays valid after it has last been used
+	Lifetime int `json:"lifetime"`
+	// Always mark the session cookie as secure - needed when MiCasa runs behind a reverse proxy terminating TLS.
+	// Cookies of requests received via TLS are always marked as secure.
+	SecureCookie bool `json:"secureCookie"`
+}
+
+// BackupConfig defines how often the server creates backups and how many of them are kept
+type BackupConfig struct {
+	// The number of hours between two scheduled backups - 0 disables scheduled backups
+	Interval int `json:"interval"`
+	// The number of backups to keep for each kind of backup (scheduled, before migrations, ...) - older ones are
+	// removed. 0 keeps all backups.
+	Keep int `json:"keep"`
+}
+
+// WhitelistConfig defines which clients may access the API without logging in and which clients may access it at
+// all. Addresses are given as single IP addresses ("192.168.1.10"), CIDR ranges ("192.168.1.0/24") or "lan" for all
+// loopback, private and link-local addresses.
+type WhitelistConfig struct {
+	// The whitelisted clients
+	Addresses []string `json:"addresses"`
+	// The name of the user whitelisted clients act as if they send no credentials - leave empty to require them to
+	// log in, too
+	User string `json:"user"`
+	// Reject all requests of clients which are not on the whitelist
+	Restrict bool `json:"restrict"`
+	// The reverse proxies whose X-Forwarded-For header is trusted to name the client
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// The destinations of the log output
+const (
+	// LogOutputStdout writes the log to the standard output
+	LogOutputStdout = "stdout"
+	// LogOutputFile writes the log to the log file
+	LogOutputFile = "file"
+	// LogOutputBoth writes the log to the standard output and the log file
+	LogOutputBoth = "both"
+)
+
+// LogConfig defines what the server logs and where the log is written to
+type LogConfig struct {
+	// The minimum level of the log entries written: "debug", "info", "warn", "error" or "crit"
+	Level string `json:"level"`
+	// The format of the log entries: "logfmt" or "json"
+	Format string `json:"format"`
+	// Where the log is written to: "stdout", "file" or "both"
+	Output string `json:"output"`
+	// The log file - relative paths are inside the data directory
+	File string `json:"file"`
+	// The size in megabytes the log file may grow to before it is rotated - 0 disables rotating by size
+	MaxSize int `json:"maxSize"`
+	// The number of hours after which the log file is rotated - 0 disables rotating by age
+	MaxAge int `json:"maxAge"`
+	// The number of rotated log files to keep - 0 keeps all of them
+	Keep int `json:"keep"`
+	// Compress the rotated log files using gzip
+	Compress bool `json:"compress"`
+	// The minimum levels of single components - overriding Level
+	Components LogComponentsConfig `json:"components"`
+	// The number of recent log entries kept in memory for the API
+	Buffer int `json:"buffer"`
+}
+
+// LogComponentsConfig defines the minimum log levels of the components of the server - components without level follow
+// the level of the log
+type LogComponentsConfig struct {
+	// The level of the FHEM connection
+	Fhem string `json:"fhem"`
+	// The level of the HTTP API server
+	HTTP string `json:"http"`
+	// The level of the database migrations
+	Migrate string `json:"migrate"`
+	// The level of the repositories
+	Repo string `json:"repo"`
+}
+
+// Levels returns the levels set - by the name of the component
+func (c LogComponentsConfig) Levels() map[string]string {
+	res := map[string]string{}
+	for component, lvl := range map[string]string{
+		log.ComponentFhem:    c.Fhem,
+		log.ComponentHTTP:    c.HTTP,
+		log.ComponentMigrate: c.Migrate,
+		log.ComponentRepo:    c.Repo,
+	} {
+		if lvl != "" {
+			res[component] = lvl
+		}
+	}
+	return res
 }
 
 // GetDefaultConfig returns the default configuration values for the application
@@ -24,5 +152,56 @@ func GetDefaultConfig() (*Configuration, error) {
 	return &Configuration{
 		DataDir:       path.Join(execDir, "data"),
 		ListenAddress: ":3000",
+		Fhem: FhemConfig{
+			Address:           "localhost:7072",
+			Timeout:           10,
+			MaxReconnectDelay: 60,
+			InformMode:        "timer",
+		},
+		Sessions: SessionConfig{
+			Lifetime: 30 * 24,
+		},
+		Backup: BackupConfig{
+			Interval: 24,
+			Keep:     7,
+		},
+		ConfigHistory: 10,
+		Whitelist: WhitelistConfig{
+			Addresses:      []string{},
+			TrustedProxies: []string{},
+		},
+		Log: LogConfig{
+			Level:    "info",
+			Format:   "logfmt",
+			Output:   LogOutputStdout,
+			File:     "logs/micasa.log",
+			MaxSize:  10,
+			MaxAge:   7 * 24,
+			Keep:     5,
+			Compress: true,
+			Buffer:   log.DefaultBufferSize,
+		},
 	}, nil
 }
+
+// ConfigVersion describes a version of the configuration file - the current one or a previous one kept in the history
+type ConfigVersion struct {
+	// The ID of the version - "current" for the configuration file in use
+	ID string `json:"id"`
+	// The time the version has been written
+	ModifiedAt time.Time `json:"modifiedAt"`
+	// The size of the file in bytes
+	Size int64 `json:"size"`
+	// Set for the configuration file in use
+	Current bool `json:"current"`
+}
+
+// ConfigChange describes a setting which differs between two configurations
+type ConfigChange struct {
+	// The JSON path of the setting
+	Path string `json:"path"`
+	// The value inside the first configuration
+	Old string `json:"old"`
+	// The value inside the second configuration
+	New string `json:"new"`
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Device is a FHEM device with its current state
+type Device struct {
+	// The unique device name
+	Name string `json:"name"`
+	// The FHEM module implementing the device (the TYPE internal)
+	Type string `json:"type"`
+	// The commands that can be sent to the device using `set`
+	PossibleSets []string `json:"possibleSets"`
+	// Internal values of the device - managed by FHEM
+	Internals map[string]string `json:"internals"`
+	// The current readings of the device
+	Readings map[string]Reading `json:"readings"`
+	// The attributes set for the device
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Reading is a single reading of a FHEM device
+type Reading struct {
+	// The current value
+	Value string `json:"value"`
+	// The time of the last update
+	Time time.Time `json:"time"`
+}
+
+// Rooms returns the rooms the device is assigned to using the `room` attribute
+func (d *Device) Rooms() []string {
+	var rooms []string
+	for _, room := range strings.Split(d.Attributes["room"], ",") {
+		if room = strings.TrimSpace(room); room != "" {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// InRoom checks if the device is assigned to the given room (case-insensitive)
+func (d *Device) InRoom(room string) bool {
+	for _, r := range d.Rooms() {
+		if strings.EqualFold(r, room) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy returns a deep copy of the device
+func (d *Device) Copy() *Device {
+	c := *d
+	c.PossibleSets = append([]string(nil), d.PossibleSets...)
+	c.Internals = make(map[string]string, len(d.Internals))
+	for k, v := range d.Internals {
+		c.Internals[k] = v
+	}
+	c.Readings = make(map[string]Reading, len(d.Readings))
+	for k, v := range d.Readings {
+		c.Readings[k] = v
+	}
+	c.Attributes = make(map[string]string, len(d.Attributes))
+	for k, v := range d.Attributes {
+		c.Attributes[k] = v
+	}
+	return &c
+}
+
+// SortDevicesByName sorts the given devices by their name
+func SortDevicesByName(devices []*Device) {
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+}
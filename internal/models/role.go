@@ -0,0 +1,173 @@
+package models
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// RoleID is a string-based role ID
+type RoleID string
+
+// The IDs of the built-in roles
+const (
+	// RoleAdmin is allowed to do everything
+	RoleAdmin RoleID = "admin"
+	// RoleMember is allowed to view and control all devices
+	RoleMember RoleID = "member"
+	// RoleGuest is allowed to view all devices
+	RoleGuest RoleID = "guest"
+)
+
+// Permission is a named permission which allows a user to perform a certain action. Permissions may be restricted to
+// a set of targets (e.g. devices) by appending a scope pattern separated by a colon - "devices.control:light_*" only
+// allows controlling devices whose name starts with "light_". The pattern may contain the wildcards `*` and `?`.
+type Permission string
+
+// The permissions known to MiCasa
+const (
+	// PermAll grants every permission
+	PermAll Permission = "*"
+	// PermDevicesView allows reading the device states
+	PermDevicesView Permission = "devices.view"
+	// PermDevicesControl allows sending commands to devices
+	PermDevicesControl Permission = "devices.control"
+	// PermUsersManage allows managing users and roles
+	PermUsersManage Permission = "users.manage"
+	// PermConfigManage allows reading and changing the application configuration
+	PermConfigManage Permission = "config.manage"
+)
+
+// KnownPermissions contains all permission names that can be assigned to roles
+var KnownPermissions = []Permission{
+	PermAll,
+	PermDevicesView,
+	PermDevicesControl,
+	PermUsersManage,
+	PermConfigManage,
+}
+
+// Name returns the name of the permission without its scope
+func (p Permission) Name() Permission {
+	if idx := strings.Index(string(p), ":"); idx >= 0 {
+		return p[:idx]
+	}
+	return p
+}
+
+// Scope returns the scope pattern of the permission - an empty scope is not restricted
+func (p Permission) Scope() string {
+	if idx := strings.Index(string(p), ":"); idx >= 0 {
+		return string(p[idx+1:])
+	}
+	return ""
+}
+
+// IsValid checks if the permission has a known name and a valid scope pattern
+func (p Permission) IsValid() bool {
+	known := false
+	for _, k := range KnownPermissions {
+		if p.Name() == k {
+			known = true
+			break
+		}
+	}
+	if !known || (p.Name() == PermAll && p.Scope() != "") {
+		return false
+	}
+	_, err := path.Match(p.Scope(), "")
+	return err == nil
+}
+
+// covers checks if the permission has the required name - regardless of its scope
+func (p Permission) covers(required Permission) bool {
+	return p.Name() == PermAll || p.Name() == required.Name()
+}
+
+// PermissionChecker checks if permissions have been granted
+type PermissionChecker interface {
+	// Has checks if the required permission has been granted for at least some targets
+	Has(required Permission) bool
+	// Allows checks if the required permission has been granted for the given target
+	Allows(required Permission, target string) bool
+}
+
+// Permissions is a set of permissions - e.g. all permissions a user has been granted by his/her roles
+type Permissions []Permission
+
+// Has checks if the set contains the required permission for at least some targets
+func (ps Permissions) Has(required Permission) bool {
+	for _, p := range ps {
+		if p.covers(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks if the set contains the required permission for the given target
+func (ps Permissions) Allows(required Permission, target string) bool {
+	for _, p := range ps {
+		if !p.covers(required) {
+			continue
+		}
+		scope := p.Scope()
+		if scope == "" {
+			return true
+		}
+		if ok, err := path.Match(scope, target); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Restrict returns a permission checker that only grants the permissions of the set that are covered by the given
+// scopes as well. An empty scope list does not restrict the set.
+func (ps Permissions) Restrict(scopes Permissions) PermissionChecker {
+	if len(scopes) == 0 {
+		return ps
+	}
+	return restrictedPermissions{permissions: ps, scopes: scopes}
+}
+
+// restrictedPermissions grants a permission only if both the permissions and the scopes grant it
+type restrictedPermissions struct {
+	permissions Permissions
+	scopes      Permissions
+}
+
+func (r restrictedPermissions) Has(required Permission) bool {
+	return r.permissions.Has(required) && r.scopes.Has(required)
+}
+
+func (r restrictedPermissions) Allows(required Permission, target string) bool {
+	return r.permissions.Allows(required, target) && r.scopes.Allows(required, target)
+}
+
+// Role is a named set of permissions that can be assigned to users
+type Role struct {
+	// Internal role ID
+	ID RoleID `db:"roleid"`
+	// The display name of the role
+	Name string `db:"name"`
+	// A description of what the role is meant for
+	Description string `db:"description"`
+	// Built-in roles cannot be deleted
+	BuiltIn bool `db:"builtIn"`
+	// The permissions granted by this role
+	Permissions Permissions `db:"-"`
+	// Creation time
+	CreatedAt time.Time `db:"createdAt"`
+	// Last update time
+	UpdatedAt time.Time `db:"updatedAt"`
+}
+
+// PermissionsOf returns the combined permissions of the given roles
+func PermissionsOf(roles []*Role) Permissions {
+	var res Permissions
+	for _, r := range roles {
+		res = append(res, r.Permissions...)
+	}
+	return res
+}
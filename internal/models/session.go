@@ -0,0 +1,68 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// secretBytes is the number of random bytes session and API tokens consist of
+const secretBytes = 32
+
+// SessionID is a string-based session ID
+type SessionID string
+
+// Session is a login session of a user. The client identifies the session using a random token that is handed out on
+// login - only the hash of this token is stored, so a leaked database does not allow taking over sessions.
+type Session struct {
+	// Internal session ID - this is the public handle used for listing and revoking sessions
+	ID SessionID `db:"sessionid"`
+	// The user owning the session
+	UserID UserID `db:"userid"`
+	// The SHA-256 hash of the session token
+	TokenHash string `db:"tokenHash"`
+	// The IP address the session has last been used from
+	IP string `db:"ip"`
+	// The user agent of the client that has last used the session
+	UserAgent string `db:"userAgent"`
+	// Creation time
+	CreatedAt time.Time `db:"createdAt"`
+	// The time the session has last been used
+	LastSeen time.Time `db:"lastSeen"`
+	// The time after which the session is no longer valid
+	ExpiresAt time.Time `db:"expiresAt"`
+}
+
+// newSecret creates a new random secret for identifying sessions and API tokens
+func newSecret() (string, error) {
+	buf := make([]byte, secretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Failed to read random data: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashSecret returns the hex-encoded SHA-256 hash of the given secret. Secrets are random and long enough to make a
+// plain hash sufficient - there is no need for a slow password hash here.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSessionToken creates a new random session token
+func NewSessionToken() (string, error) {
+	return newSecret()
+}
+
+// HashSessionToken returns the hash of the given session token as it is stored inside the session
+func HashSessionToken(token string) string {
+	return hashSecret(token)
+}
+
+// Expired checks if the session has expired at the given time
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
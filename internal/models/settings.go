@@ -0,0 +1,213 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EnvPrefix is the prefix of the environment variables overriding settings of the configuration
+	EnvPrefix = "MICASA_"
+	// SecretMask is shown instead of the values of secret settings
+	SecretMask = "********"
+)
+
+// ConfigSource tells where the value of a setting has come from
+type ConfigSource string
+
+// The sources of settings - in the order of their precedence
+const (
+	// SourceDefault is the built-in default value
+	SourceDefault ConfigSource = "default"
+	// SourceFile is the configuration file
+	SourceFile ConfigSource = "file"
+	// SourceEnv is an environment variable
+	SourceEnv ConfigSource = "env"
+	// SourceFlag is a command line flag
+	SourceFlag ConfigSource = "flag"
+)
+
+// ConfigSetting describes a single setting of the configuration
+type ConfigSetting struct {
+	// The JSON path of the setting - e.g. "fhem.address". It is also the name of the command line flag.
+	Path string
+	// The environment variable overriding the setting - e.g. "MICASA_FHEM_ADDRESS"
+	Env string
+	// Secret settings are not shown
+	Secret bool
+	index  []int
+	kind   reflect.Kind
+}
+
+// ConfigOverride replaces the value of a setting from the configuration file
+type ConfigOverride struct {
+	// The JSON path of the setting
+	Path string
+	// The value - parsed according to the type of the setting
+	Value string
+	// Where the value has come from
+	Source ConfigSource
+	// The name of the environment variable or flag - used for reporting problems
+	Name string
+}
+
+// The settings in the order they are defined in - collected once
+var configSettings = collectSettings("", reflect.TypeOf(Configuration{}), nil)
+
+// secretSettings are the settings whose values must not be shown
+var secretSettings = map[string]bool{"fhem.password": true}
+
+// collectSettings returns all settings of the given struct type
+func collectSettings(prefix string, t reflect.Type, index []int) []ConfigSetting {
+	var res []ConfigSetting
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := joinPath(prefix, name)
+		idx := append(append([]int{}, index...), i)
+		if f.Type.Kind() == reflect.Struct {
+			res = append(res, collectSettings(path, f.Type, idx)...)
+			continue
+		}
+		res = append(res, ConfigSetting{
+			Path:   path,
+			Env:    EnvPrefix + envName(path),
+			Secret: secretSettings[path],
+			index:  idx,
+			kind:   f.Type.Kind(),
+		})
+	}
+	return res
+}
+
+// envName converts a JSON path to the name of an environment variable - "fhem.maxReconnectDelay" becomes
+// "FHEM_MAX_RECONNECT_DELAY"
+func envName(path string) string {
+	var b strings.Builder
+	for i, r := range path {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && i > 0 && path[i-1] != '.':
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// ConfigSettings returns all settings of the configuration in the order they are defined in
+func ConfigSettings() []ConfigSetting {
+	return append([]ConfigSetting{}, configSettings...)
+}
+
+// LookupSetting returns the setting with the given JSON path
+func LookupSetting(path string) (ConfigSetting, bool) {
+	for _, s := range configSettings {
+		if s.Path == path {
+			return s, true
+		}
+	}
+	return ConfigSetting{}, false
+}
+
+// IsBool returns whether the setting is switched on or off
+func (s ConfigSetting) IsBool() bool {
+	return s.kind == reflect.Bool
+}
+
+// Get returns the value of the setting inside the given configuration - the items of lists are separated by commas
+func (s ConfigSetting) Get(c *Configuration) string {
+	v := reflect.ValueOf(c).Elem().FieldByIndex(s.index).Interface()
+	if list, ok := v.([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// Set parses the value and stores it in the given configuration - lists are given as comma separated values
+func (s ConfigSetting) Set(c *Configuration, value string) error {
+	f := reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+	switch s.kind {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.Errorf("Expecting a whole number instead of '%s'", value)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Errorf("Expecting true or false instead of '%s'", value)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return errors.Errorf("Settings of type %s cannot be overridden", f.Type())
+		}
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return errors.Errorf("Settings of type %s cannot be overridden", s.kind)
+	}
+	return nil
+}
+
+// ApplyOverrides replaces the settings of the configuration by the given values - later overrides win. Every problem
+// is reported as ValidationErrors.
+func (c *Configuration) ApplyOverrides(overrides []ConfigOverride) error {
+	var errs ValidationErrors
+	for _, o := range overrides {
+		s, ok := LookupSetting(o.Path)
+		if !ok {
+			errs.add(o.Path, "Unknown setting (%s)", o.Name)
+			continue
+		}
+		if err := s.Set(c, o.Value); err != nil {
+			errs.add(o.Path, "%s (%s)", err.Error(), o.Name)
+		}
+	}
+	return errs.err()
+}
+
+// DiffConfig returns the settings whose values differ between the two configurations - values of secret settings are
+// not shown
+func DiffConfig(old *Configuration, new *Configuration) []ConfigChange {
+	res := []ConfigChange{}
+	for _, s := range configSettings {
+		o, n := s.Get(old), s.Get(new)
+		if o == n {
+			continue
+		}
+		if s.Secret {
+			o, n = maskSecret(o), maskSecret(n)
+		}
+		res = append(res, ConfigChange{Path: s.Path, Old: o, New: n})
+	}
+	return res
+}
+
+// maskSecret hides the value of a secret setting - only showing whether it is set
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return SecretMask
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigSettings(t *testing.T) {
+	Convey("Every setting should be overridable", t, func() {
+		settings := ConfigSettings()
+		So(settings, ShouldNotBeEmpty)
+		So(settings[0].Path, ShouldEqual, "dataDir")
+		So(settings[0].Env, ShouldEqual, "MICASA_DATA_DIR")
+		s, ok := LookupSetting("fhem.maxReconnectDelay")
+		So(ok, ShouldBeTrue)
+		So(s.Env, ShouldEqual, "MICASA_FHEM_MAX_RECONNECT_DELAY")
+		s, ok = LookupSetting("fhem.password")
+		So(ok, ShouldBeTrue)
+		So(s.Secret, ShouldBeTrue)
+		_, ok = LookupSetting("fhem")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Having a configuration", t, func() {
+		conf := &Configuration{}
+
+		Convey("overrides should be parsed according to the type of the setting", func() {
+			err := conf.ApplyOverrides([]ConfigOverride{
+				{Path: "listenAddress", Value: ":4000", Source: SourceEnv},
+				{Path: "fhem.timeout", Value: "5", Source: SourceEnv},
+				{Path: "fhem.tls", Value: "true", Source: SourceFlag},
+				{Path: "listenAddress", Value: ":5000", Source: SourceFlag},
+			})
+			So(err, ShouldBeNil)
+			So(conf.ListenAddress, ShouldEqual, ":5000")
+			So(conf.Fhem.Timeout, ShouldEqual, 5)
+			So(conf.Fhem.TLS, ShouldBeTrue)
+			s, _ := LookupSetting("fhem.timeout")
+			So(s.Get(conf), ShouldEqual, "5")
+		})
+
+		Convey("lists should be given as comma separated values", func() {
+			err := conf.ApplyOverrides([]ConfigOverride{
+				{Path: "whitelist.addresses", Value: "192.168.1.0/24, 10.0.0.1,", Source: SourceEnv},
+			})
+			So(err, ShouldBeNil)
+			So(conf.Whitelist.Addresses, ShouldResemble, []string{"192.168.1.0/24", "10.0.0.1"})
+			s, _ := LookupSetting("whitelist.addresses")
+			So(s.Get(conf), ShouldEqual, "192.168.1.0/24,10.0.0.1")
+		})
+
+		Convey("invalid overrides should be reported with their origin", func() {
+			err := conf.ApplyOverrides([]ConfigOverride{
+				{Path: "fhem.timeout", Value: "soon", Name: "MICASA_FHEM_TIMEOUT"},
+				{Path: "fhem.colour", Value: "blue", Name: "-fhem.colour"},
+			})
+			So(err, ShouldNotBeNil)
+			So(paths(err), ShouldResemble, []string{"fhem.timeout", "fhem.colour"})
+			So(err.Error(), ShouldContainSubstring, "MICASA_FHEM_TIMEOUT")
+		})
+
+		Convey("the differences to another configuration should be listed without showing secrets", func() {
+			other := *conf
+			other.ListenAddress = ":4000"
+			other.Fhem.Password = "secret"
+			So(DiffConfig(conf, conf), ShouldBeEmpty)
+			So(DiffConfig(conf, &other), ShouldResemble, []ConfigChange{
+				{Path: "listenAddress", Old: "", New: ":4000"},
+				{Path: "fhem.password", Old: "", New: SecretMask},
+			})
+		})
+	})
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// apiTokenPrefix is prepended to all API tokens, so they can be recognized - e.g. by secret scanners
+const apiTokenPrefix = "micasa_"
+
+// APITokenID is a string-based API token ID
+type APITokenID string
+
+// APIToken is a personal access token of a user used by scripts and devices that cannot log in interactively. Like
+// session tokens, the token itself is only shown once on creation - only its hash is stored.
+type APIToken struct {
+	// Internal token ID - this is the public handle used for listing and revoking tokens
+	ID APITokenID `db:"tokenid"`
+	// The user owning the token - requests authenticated by the token act on behalf of this user
+	UserID UserID `db:"userid"`
+	// A name describing what the token is used for - unique per user
+	Name string `db:"name"`
+	// The SHA-256 hash of the token
+	TokenHash string `db:"tokenHash"`
+	// The permissions the token is restricted to - the token cannot do more than its user, even if the scopes say so.
+	// An empty list grants all permissions of the user.
+	Scopes Permissions `db:"-"`
+	// Creation time
+	CreatedAt time.Time `db:"createdAt"`
+	// The time after which the token is no longer valid - nil if the token does not expire
+	ExpiresAt *time.Time `db:"expiresAt"`
+	// The time the token has last been used - nil if it has never been used
+	LastUsed *time.Time `db:"lastUsed"`
+}
+
+// NewAPIToken creates a new random API token
+func NewAPIToken() (string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + secret, nil
+}
+
+// HashAPIToken returns the hash of the given API token as it is stored inside the token record
+func HashAPIToken(token string) string {
+	return hashSecret(token)
+}
+
+// Expired checks if the token has expired at the given time
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
@@ -10,7 +10,8 @@ import (
 // UserID is a string-based user ID
 type UserID string
 
-// User defines an user of the application and his/her permissions inside this application
+// User defines an user of the application. The permissions of the user inside this application are defined by the
+// roles assigned to him/her - see Role.
 type User struct {
 	// Internal user ID
 	ID UserID `db:"userid"`
@@ -0,0 +1,304 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/pkg/errors"
+)
+
+// ValidationError describes a single problem of the configuration
+type ValidationError struct {
+	// The JSON path of the setting - e.g. "fhem.address". Empty for problems of the whole document.
+	Path string `json:"path"`
+	// What is wrong with the setting
+	Message string `json:"message"`
+}
+
+// Error returns the problem prefixed by the path of the setting
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors is the list of all problems found in a configuration
+type ValidationErrors []ValidationError
+
+// Error returns all problems in a single line
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, v := range e {
+		msgs = append(msgs, v.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records a problem of the setting at the given path
+func (e *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the list as error - or nil if there are no problems
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ParseConfig decodes a JSON configuration document into the given configuration - settings missing from the document
+// keep their values. The paths of the settings contained in the document are returned. Unknown settings and settings
+// of the wrong type are reported as ValidationErrors containing every problem found - the values are not validated.
+func ParseConfig(data []byte, conf *Configuration) ([]string, error) {
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, ValidationErrors{{Message: describeSyntaxError(data, err)}}
+	}
+	if dec.More() {
+		return nil, ValidationErrors{{Message: "Unexpected data after the end of the configuration"}}
+	}
+	var errs ValidationErrors
+	set := []string{}
+	checkFields("", raw, reflect.TypeOf(*conf), &set, &errs)
+	// Settings of the wrong type are skipped by the decoder - they have been reported already
+	json.Unmarshal(data, conf)
+	return set, errs.err()
+}
+
+// describeSyntaxError adds the position of a syntax error to its message
+func describeSyntaxError(data []byte, err error) string {
+	if err == io.EOF {
+		return "The configuration is empty"
+	}
+	offset := int64(len(data))
+	if e, ok := err.(*json.SyntaxError); ok && e.Offset > 0 {
+		// The offset points behind the offending character
+		offset = e.Offset - 1
+	}
+	line, col := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("Invalid JSON at line %d, column %d: %v", line, col, err)
+}
+
+// checkFields compares the decoded JSON value with the type it is decoded into - reporting unknown settings and
+// values of the wrong type. The paths of the settings found are added to set.
+func checkFields(path string, raw interface{}, t reflect.Type, set *[]string, errs *ValidationErrors) {
+	if t.Kind() != reflect.Struct {
+		*set = append(*set, path)
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			errs.add(path, "Expecting an object")
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ft, ok := fields[key]
+			if !ok {
+				errs.add(joinPath(path, key), "Unknown setting")
+				continue
+			}
+			checkFields(joinPath(path, key), obj[key], ft, set, errs)
+		}
+	case reflect.String:
+		if _, ok := raw.(string); !ok {
+			errs.add(path, "Expecting a string")
+		}
+	case reflect.Bool:
+		if _, ok := raw.(bool); !ok {
+			errs.add(path, "Expecting true or false")
+		}
+	case reflect.Int:
+		n, ok := raw.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			errs.add(path, "Expecting a whole number")
+		}
+	case reflect.Slice:
+		// Lists of strings are the only lists of the configuration
+		list, ok := raw.([]interface{})
+		if !ok {
+			errs.add(path, "Expecting a list of strings")
+			return
+		}
+		for i, item := range list {
+			if _, ok := item.(string); !ok {
+				errs.add(path, "Expecting a string as item %d", i+1)
+			}
+		}
+	}
+}
+
+// joinPath appends a key to a JSON path
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Validate checks whether the configuration can be used to run the application. The result is nil or
+// ValidationErrors containing every problem found.
+func (c *Configuration) Validate() error {
+	return c.validate().err()
+}
+
+// validate returns all problems of the configuration
+func (c *Configuration) validate() ValidationErrors {
+	var errs ValidationErrors
+	if c.DataDir == "" {
+		errs.add("dataDir", "Must not be empty")
+	} else if err := checkWritableDir(c.DataDir); err != nil {
+		errs.add("dataDir", "%s", err.Error())
+	}
+	checkAddress("listenAddress", c.ListenAddress, true, &errs)
+	checkAddress("fhem.address", c.Fhem.Address, false, &errs)
+	if c.Fhem.Timeout <= 0 {
+		errs.add("fhem.timeout", "Must be greater than 0")
+	}
+	if c.Fhem.MaxReconnectDelay < 0 {
+		errs.add("fhem.maxReconnectDelay", "Must not be negative")
+	}
+	if c.Fhem.InformMode != "" && c.Fhem.InformMode != "timer" && c.Fhem.InformMode != "on" {
+		errs.add("fhem.informMode", "Unknown inform mode '%s' - expecting 'timer' or 'on'", c.Fhem.InformMode)
+	}
+	if c.Sessions.Lifetime <= 0 {
+		errs.add("sessions.lifetime", "Must be greater than 0")
+	}
+	if c.Backup.Interval < 0 {
+		errs.add("backup.interval", "Must not be negative")
+	}
+	if c.Backup.Keep < 0 {
+		errs.add("backup.keep", "Must not be negative")
+	}
+	if c.ConfigHistory < 0 {
+		errs.add("configHistory", "Must not be negative")
+	}
+	checkNetworks("whitelist.addresses", c.Whitelist.Addresses, &errs)
+	checkNetworks("whitelist.trustedProxies", c.Whitelist.TrustedProxies, &errs)
+	if c.Whitelist.Restrict && len(c.Whitelist.Addresses) == 0 {
+		errs.add("whitelist.restrict", "Would reject every request - whitelist.addresses is empty")
+	}
+	checkLevel("log.level", c.Log.Level, &errs)
+	components := c.Log.Components.Levels()
+	for _, component := range log.Components {
+		if lvl, ok := components[component]; ok {
+			checkLevel("log.components."+component, lvl, &errs)
+		}
+	}
+	if c.Log.Format != log.FormatLogfmt && c.Log.Format != log.FormatJSON {
+		errs.add("log.format", "Unknown log format '%s' - expecting 'logfmt' or 'json'", c.Log.Format)
+	}
+	switch c.Log.Output {
+	case LogOutputStdout:
+	case LogOutputFile, LogOutputBoth:
+		if c.Log.File == "" {
+			errs.add("log.file", "Must not be empty when writing the log to a file")
+		}
+	default:
+		errs.add("log.output", "Unknown log output '%s' - expecting 'stdout', 'file' or 'both'", c.Log.Output)
+	}
+	if c.Log.MaxSize < 0 {
+		errs.add("log.maxSize", "Must not be negative")
+	}
+	if c.Log.MaxAge < 0 {
+		errs.add("log.maxAge", "Must not be negative")
+	}
+	if c.Log.Keep < 0 {
+		errs.add("log.keep", "Must not be negative")
+	}
+	if c.Log.Buffer <= 0 {
+		errs.add("log.buffer", "Must be greater than 0")
+	}
+	return errs
+}
+
+// checkAddress checks a "host:port" address - the host may only be left out of addresses to listen at
+func checkAddress(path string, addr string, listen bool, errs *ValidationErrors) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.add(path, "Invalid address '%s' - expecting 'host:port'", addr)
+		return
+	}
+	if host == "" && !listen {
+		errs.add(path, "The host name is missing")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		errs.add(path, "Invalid port '%s'", port)
+	}
+}
+
+// checkLevel checks the name of a log level
+func checkLevel(path string, name string, errs *ValidationErrors) {
+	if _, err := log.ParseLevel(name); err != nil {
+		errs.add(path, "%s - expecting 'debug', 'info', 'warn', 'error' or 'crit'", err.Error())
+	}
+}
+
+// checkNetworks checks the entries of a list of IP addresses and CIDR ranges
+func checkNetworks(path string, entries []string, errs *ValidationErrors) {
+	for _, entry := range entries {
+		if _, err := ParseNetworks(entry); err != nil {
+			errs.add(path, "%s", err.Error())
+		}
+	}
+}
+
+// checkWritableDir checks whether files can be created inside the directory - or, if it does not exist yet, whether
+// it can be created
+func checkWritableDir(dir string) error {
+	// Find the directory which would contain the missing ones
+	existing := filepath.Clean(dir)
+	info, err := os.Stat(existing)
+	for os.IsNotExist(err) && filepath.Dir(existing) != existing {
+		existing = filepath.Dir(existing)
+		info, err = os.Stat(existing)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Cannot access '%s'", existing)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("'%s' is not a directory", existing)
+	}
+	f, err := ioutil.TempFile(existing, ".micasa-check-")
+	if err != nil {
+		return errors.Errorf("'%s' is not writable", existing)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// paths returns the paths of all problems found
+func paths(err error) []string {
+	res := []string{}
+	for _, e := range err.(ValidationErrors) {
+		res = append(res, e.Path)
+	}
+	return res
+}
+
+func TestParseConfig(t *testing.T) {
+	Convey("Having the default configuration", t, func() {
+		dir := filepath.Join(os.TempDir(), uuid.NewV4().String())
+		So(os.MkdirAll(dir, 0700), ShouldBeNil)
+		conf, err := GetDefaultConfig()
+		So(err, ShouldBeNil)
+		conf.DataDir = filepath.Join(dir, "data")
+
+		Convey("a valid document should be applied on top of it", func() {
+			set, err := ParseConfig([]byte(`{"listenAddress": "127.0.0.1:8080", "fhem": {"informMode": "on"}}`), conf)
+			So(err, ShouldBeNil)
+			So(set, ShouldResemble, []string{"fhem.informMode", "listenAddress"})
+			So(conf.Validate(), ShouldBeNil)
+			So(conf.ListenAddress, ShouldEqual, "127.0.0.1:8080")
+			So(conf.Fhem.InformMode, ShouldEqual, "on")
+			So(conf.Fhem.Address, ShouldEqual, "localhost:7072")
+		})
+
+		Convey("every problem should be reported with its path", func() {
+			_, err := ParseConfig([]byte(`{
+				"listenAdress": ":3000",
+				"listenAddress": "3000",
+				"fhem": {"address": ":7072", "timeout": "10", "tls": 1, "colour": "blue"},
+				"sessions": {"lifetime": 0},
+				"backup": {"keep": 1.5}
+			}`), conf)
+			So(err, ShouldNotBeNil)
+			So(paths(err), ShouldResemble, []string{"backup.keep", "fhem.colour", "fhem.timeout", "fhem.tls", "listenAdress"})
+			So(err.Error(), ShouldContainSubstring, "listenAdress: Unknown setting")
+			err = conf.Validate()
+			So(err, ShouldNotBeNil)
+			So(paths(err), ShouldResemble, []string{"listenAddress", "fhem.address", "sessions.lifetime"})
+		})
+
+		Convey("syntax errors should be reported with their position", func() {
+			_, err := ParseConfig([]byte("{\n  \"dataDir\": \"x\",\n}"), conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "Invalid JSON at line 3, column 1")
+			_, err = ParseConfig([]byte(``), conf)
+			So(err, ShouldNotBeNil)
+			_, err = ParseConfig([]byte(`{} {}`), conf)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("the entries of the whitelist should be checked", func() {
+			_, err := ParseConfig([]byte(`{"whitelist": {"addresses": ["lan", 7], "trustedProxies": "10.0.0.1"}}`), conf)
+			So(paths(err), ShouldResemble, []string{"whitelist.addresses", "whitelist.trustedProxies"})
+			conf.Whitelist.Addresses = []string{"lan", "10.0.0.1", "10.0.0.0/33", "fhem"}
+			conf.Whitelist.TrustedProxies = []string{"::1"}
+			So(paths(conf.Validate()), ShouldResemble, []string{"whitelist.addresses", "whitelist.addresses"})
+			conf.Whitelist = WhitelistConfig{Restrict: true}
+			So(paths(conf.Validate()), ShouldResemble, []string{"whitelist.restrict"})
+		})
+
+		Convey("the log settings should be checked", func() {
+			conf.Log = LogConfig{Level: "verbose", Format: "xml", Output: LogOutputFile, Buffer: 10}
+			So(paths(conf.Validate()), ShouldResemble, []string{"log.level", "log.format", "log.file"})
+			conf.Log = LogConfig{Level: "WARN", Format: "json", Output: "syslog", Buffer: 10}
+			So(paths(conf.Validate()), ShouldResemble, []string{"log.output"})
+			conf.Log = LogConfig{Level: "info", Format: "logfmt", Output: LogOutputStdout, MaxSize: -1,
+				Components: LogComponentsConfig{Fhem: "debug", HTTP: "loud"}}
+			So(paths(conf.Validate()), ShouldResemble, []string{"log.components.http", "log.maxSize", "log.buffer"})
+		})
+
+		Convey("a data directory that cannot be created should be rejected", func() {
+			file := filepath.Join(dir, "file")
+			So(ioutil.WriteFile(file, []byte{}, 0600), ShouldBeNil)
+			conf.DataDir = filepath.Join(file, "data")
+			So(paths(conf.Validate()), ShouldResemble, []string{"dataDir"})
+			conf.DataDir = file
+			So(paths(conf.Validate()), ShouldResemble, []string{"dataDir"})
+		})
+
+		Convey("a missing data directory inside a writable one should be accepted", func() {
+			conf.DataDir = filepath.Join(dir, "a", "b")
+			So(conf.Validate(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WhitelistLAN is the whitelist entry standing for all loopback, private and link-local addresses
+const WhitelistLAN = "lan"
+
+// lanNetworks are the networks WhitelistLAN stands for
+var lanNetworks = []*net.IPNet{
+	mustParseCIDR("127.0.0.0/8"),
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("169.254.0.0/16"),
+	mustParseCIDR("::1/128"),
+	mustParseCIDR("fc00::/7"),
+	mustParseCIDR("fe80::/10"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// ParseNetworks returns the networks an entry of the whitelist or the trusted proxies stands for - a single IP
+// address is returned as network containing only this address
+func ParseNetworks(entry string) ([]*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.EqualFold(entry, WhitelistLAN) {
+		return lanNetworks, nil
+	}
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Errorf("Invalid CIDR range '%s'", entry)
+		}
+		return []*net.IPNet{n}, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, errors.Errorf(
+			"Invalid address '%s' - expecting an IP address, a CIDR range or '%s'", entry, WhitelistLAN,
+		)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return []*net.IPNet{{IP: ip4, Mask: net.CIDRMask(32, 32)}}, nil
+	}
+	return []*net.IPNet{{IP: ip, Mask: net.CIDRMask(128, 128)}}, nil
+}
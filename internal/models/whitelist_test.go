@@ -0,0 +1,48 @@
+package models
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseNetworks(t *testing.T) {
+	Convey("Entries of the whitelist should be turned into networks", t, func() {
+		networks, err := ParseNetworks("192.168.1.10")
+		So(err, ShouldBeNil)
+		So(networks, ShouldHaveLength, 1)
+		So(networks[0].String(), ShouldEqual, "192.168.1.10/32")
+
+		networks, err = ParseNetworks(" 192.168.1.0/24 ")
+		So(err, ShouldBeNil)
+		So(networks[0].Contains(net.ParseIP("192.168.1.200")), ShouldBeTrue)
+		So(networks[0].Contains(net.ParseIP("192.168.2.1")), ShouldBeFalse)
+
+		networks, err = ParseNetworks("fe80::1")
+		So(err, ShouldBeNil)
+		So(networks[0].String(), ShouldEqual, "fe80::1/128")
+
+		networks, err = ParseNetworks("LAN")
+		So(err, ShouldBeNil)
+		contains := func(ip string) bool {
+			for _, n := range networks {
+				if n.Contains(net.ParseIP(ip)) {
+					return true
+				}
+			}
+			return false
+		}
+		So(contains("127.0.0.1"), ShouldBeTrue)
+		So(contains("172.20.1.1"), ShouldBeTrue)
+		So(contains("::1"), ShouldBeTrue)
+		So(contains("8.8.8.8"), ShouldBeFalse)
+	})
+
+	Convey("Invalid entries should be rejected", t, func() {
+		for _, entry := range []string{"", "fhem.local", "10.0.0.0/33", "300.1.1.1"} {
+			_, err := ParseNetworks(entry)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,249 @@
+// Package memory provides a device repository that keeps the state of all FHEM devices in memory.
+// The repository is seeded using FHEM's `jsonlist2` command and kept up to date using the FHEM event stream.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/fhem"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+)
+
+const (
+	// The device emitting FHEM's global events like DEFINED or DELETED
+	globalDevice = "global"
+	syncTimeout  = 60 * time.Second
+)
+
+// Lister is able to fetch devices from FHEM - this is usually the FHEM client
+type Lister interface {
+	JSONList2(ctx context.Context, devspec string) (*fhem.JSONList2, error)
+}
+
+// DeviceRepo is a device repository keeping the device states in memory
+type DeviceRepo struct {
+	mu      sync.RWMutex
+	devices map[string]*models.Device
+	// The number of complete synchronizations running
+	syncing int
+	// The events applied while synchronizing - they are applied to the new state again, as they may be missing from
+	// the state reported by FHEM
+	pending []events.Event
+	lister  Lister
+	logger  log.Logger
+	sub     *events.Subscription
+	wg      sync.WaitGroup
+}
+
+// New creates a new, empty device repository
+func New(lister Lister, logger log.Logger) *DeviceRepo {
+	return &DeviceRepo{
+		devices: make(map[string]*models.Device),
+		lister:  lister,
+		logger:  logger,
+	}
+}
+
+// Sync replaces the whole device state with the current state reported by FHEM. Events applied while waiting for
+// FHEM are applied to the new state again, so they are not lost.
+func (r *DeviceRepo) Sync(ctx context.Context) error {
+	r.mu.Lock()
+	r.syncing++
+	start := len(r.pending)
+	r.mu.Unlock()
+	list, err := r.lister.JSONList2(ctx, "")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() {
+		r.syncing--
+		if r.syncing == 0 {
+			r.pending = nil
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	devices := make(map[string]*models.Device, len(list.Results))
+	for _, d := range list.Results {
+		devices[d.Name] = d.Device()
+	}
+	for _, e := range r.pending[start:] {
+		if name := applyTo(devices, e); name != "" {
+			// The device may have been loaded into the previous state
+			r.syncAsync(name)
+		}
+	}
+	r.devices = devices
+	r.logger.Info(fmt.Sprintf("Synchronized the state of %d devices with FHEM", len(devices)))
+	return nil
+}
+
+// SyncDevice reloads the state of a single device from FHEM
+func (r *DeviceRepo) SyncDevice(ctx context.Context, name string) error {
+	list, err := r.lister.JSONList2(ctx, name)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range list.Results {
+		if d.Name == name {
+			r.devices[name] = d.Device()
+			return nil
+		}
+	}
+	delete(r.devices, name)
+	return nil
+}
+
+// Start keeps the repository up to date using the events published on the given bus
+func (r *DeviceRepo) Start(bus *events.Bus) {
+	r.sub = bus.Subscribe(events.Filter{}, 1024)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for e := range r.sub.C {
+			r.Apply(e)
+		}
+	}()
+}
+
+// Stop stops processing events
+func (r *DeviceRepo) Stop() {
+	if r.sub != nil {
+		r.sub.Unsubscribe()
+	}
+	r.wg.Wait()
+}
+
+// Apply updates the repository using the given FHEM event
+func (r *DeviceRepo) Apply(e events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.syncing > 0 {
+		r.pending = append(r.pending, e)
+	}
+	if name := applyTo(r.devices, e); name != "" {
+		r.syncAsync(name)
+	}
+}
+
+// applyTo updates the given devices using the FHEM event. The name of a device which has to be loaded from FHEM is
+// returned - or an empty string.
+func applyTo(devices map[string]*models.Device, e events.Event) string {
+	if e.Device == globalDevice {
+		return applyGlobal(devices, e)
+	}
+	dev, ok := devices[e.Device]
+	if !ok {
+		// The device has not been seen, yet - it will be picked up with the next sync
+		return ""
+	}
+	dev.Readings[e.Reading] = models.Reading{Value: e.Value, Time: e.Time}
+	return ""
+}
+
+// applyGlobal handles the structural changes announced by the global device
+func applyGlobal(devices map[string]*models.Device, e events.Event) string {
+	args := strings.Fields(e.Value)
+	if len(args) < 2 {
+		return ""
+	}
+	switch args[0] {
+	case "DEFINED", "MODIFIED":
+		return args[1]
+	case "DELETED":
+		delete(devices, args[1])
+	case "RENAMED":
+		if len(args) < 3 {
+			return ""
+		}
+		if dev, ok := devices[args[1]]; ok {
+			delete(devices, args[1])
+			dev.Name = args[2]
+			dev.Internals["NAME"] = args[2]
+			devices[args[2]] = dev
+		}
+	case "ATTR":
+		if len(args) < 3 {
+			return ""
+		}
+		if dev, ok := devices[args[1]]; ok {
+			dev.Attributes[args[2]] = strings.Join(args[3:], " ")
+		}
+	case "DELETEATTR":
+		if len(args) < 3 {
+			return ""
+		}
+		if dev, ok := devices[args[1]]; ok {
+			delete(dev.Attributes, args[2])
+		}
+	}
+	return ""
+}
+
+// syncAsync reloads the given device in the background to not block the event processing
+func (r *DeviceRepo) syncAsync(name string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+		defer cancel()
+		if err := r.SyncDevice(ctx, name); err != nil {
+			r.logger.Warn("Failed to load device from FHEM", log.FldError, err, log.FldDevice, name)
+		}
+	}()
+}
+
+// GetByName returns the device with the given name
+func (r *DeviceRepo) GetByName(name string) (*models.Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	dev, ok := r.devices[name]
+	if !ok {
+		return nil, repo.ErrNotExisting
+	}
+	return dev.Copy(), nil
+}
+
+// GetAll returns all known devices ordered by name
+func (r *DeviceRepo) GetAll() ([]*models.Device, error) {
+	return r.find(func(*models.Device) bool { return true }), nil
+}
+
+// FindByType returns all devices of the given TYPE
+func (r *DeviceRepo) FindByType(deviceType string) ([]*models.Device, error) {
+	return r.find(func(d *models.Device) bool { return d.Type == deviceType }), nil
+}
+
+// FindByRoom returns all devices assigned to the given room
+func (r *DeviceRepo) FindByRoom(room string) ([]*models.Device, error) {
+	return r.find(func(d *models.Device) bool { return d.InRoom(room) }), nil
+}
+
+// FindByReading returns all devices providing a reading with the given name
+func (r *DeviceRepo) FindByReading(reading string) ([]*models.Device, error) {
+	return r.find(func(d *models.Device) bool {
+		_, ok := d.Readings[reading]
+		return ok
+	}), nil
+}
+
+// find returns copies of all devices matching the given predicate ordered by name
+func (r *DeviceRepo) find(match func(*models.Device) bool) []*models.Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := []*models.Device{}
+	for _, d := range r.devices {
+		if match(d) {
+			res = append(res, d.Copy())
+		}
+	}
+	models.SortDevicesByName(res)
+	return res
+}
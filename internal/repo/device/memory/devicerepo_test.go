@@ -0,0 +1,179 @@
+package memory_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/fhem"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/derWhity/micasa/internal/repo/device/memory"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeLister returns a fixed jsonlist2 output
+type fakeLister struct {
+	list string
+	// Called after FHEM has "answered" - e.g. for simulating events arriving in the meantime
+	answered func()
+}
+
+func (l *fakeLister) JSONList2(ctx context.Context, devspec string) (*fhem.JSONList2, error) {
+	res, err := fhem.ParseJSONList2(l.list)
+	if l.answered != nil {
+		l.answered()
+	}
+	if err != nil || devspec == "" {
+		return res, err
+	}
+	var filtered []fhem.JSONDevice
+	for _, d := range res.Results {
+		if d.Name == devspec {
+			filtered = append(filtered, d)
+		}
+	}
+	res.Results = filtered
+	return res, nil
+}
+
+const testList = `{
+  "Arg":"",
+  "Results": [
+  {
+    "Name":"lamp",
+    "PossibleSets":"on off pct:slider,0,1,100",
+    "Internals": { "NAME": "lamp", "TYPE": "dummy" },
+    "Readings": { "state": { "Value":"on", "Time":"2017-11-29 20:15:00" } },
+    "Attributes": { "room": "Living,Kitchen" }
+  },
+  {
+    "Name":"thermostat",
+    "PossibleSets":"desired-temp",
+    "Internals": { "NAME": "thermostat", "TYPE": "CUL_HM" },
+    "Readings": {
+      "state": { "Value":"ok", "Time":"2017-11-29 20:15:00" },
+      "measured-temp": { "Value":"21.5", "Time":"2017-11-29 20:15:00" }
+    },
+    "Attributes": { "room": "Living" }
+  }  ],
+  "totalResultsReturned":2
+}`
+
+func names(devices []*models.Device) []string {
+	var res []string
+	for _, d := range devices {
+		res = append(res, d.Name)
+	}
+	return res
+}
+
+func TestDeviceRepo(t *testing.T) {
+	Convey("Having a device repo synchronized with FHEM", t, func() {
+		lister := &fakeLister{list: testList}
+		r := memory.New(lister, log.New(kitlog.NewNopLogger(), log.LvlDebug))
+		So(r.Sync(context.Background()), ShouldBeNil)
+
+		Convey("Devices should be found by name", func() {
+			dev, err := r.GetByName("lamp")
+			So(err, ShouldBeNil)
+			So(dev.Type, ShouldEqual, "dummy")
+			So(dev.PossibleSets, ShouldResemble, []string{"on", "off", "pct"})
+			So(dev.Readings["state"].Value, ShouldEqual, "on")
+			So(dev.Rooms(), ShouldResemble, []string{"Living", "Kitchen"})
+
+			_, err = r.GetByName("unknown")
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Devices should be found by type, room and reading", func() {
+			all, err := r.GetAll()
+			So(err, ShouldBeNil)
+			So(names(all), ShouldResemble, []string{"lamp", "thermostat"})
+			res, err := r.FindByType("CUL_HM")
+			So(err, ShouldBeNil)
+			So(names(res), ShouldResemble, []string{"thermostat"})
+			res, err = r.FindByRoom("kitchen")
+			So(err, ShouldBeNil)
+			So(names(res), ShouldResemble, []string{"lamp"})
+			res, err = r.FindByRoom("Living")
+			So(err, ShouldBeNil)
+			So(names(res), ShouldResemble, []string{"lamp", "thermostat"})
+			res, err = r.FindByReading("measured-temp")
+			So(err, ShouldBeNil)
+			So(names(res), ShouldResemble, []string{"thermostat"})
+		})
+
+		Convey("Returned devices should be copies", func() {
+			dev, _ := r.GetByName("lamp")
+			dev.Readings["state"] = dev.Readings["bogus"]
+			dev2, _ := r.GetByName("lamp")
+			So(dev2.Readings["state"].Value, ShouldEqual, "on")
+		})
+
+		Convey("Events should update the readings", func() {
+			now := time.Now()
+			r.Apply(events.Event{Device: "lamp", Reading: "state", Value: "off", Time: now})
+			r.Apply(events.Event{Device: "thermostat", Reading: "battery", Value: "low", Time: now})
+			r.Apply(events.Event{Device: "unknown", Reading: "state", Value: "on", Time: now})
+			dev, _ := r.GetByName("lamp")
+			So(dev.Readings["state"], ShouldResemble, models.Reading{Value: "off", Time: now})
+			dev, _ = r.GetByName("thermostat")
+			So(dev.Readings["battery"].Value, ShouldEqual, "low")
+			_, err := r.GetByName("unknown")
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Events applied while synchronizing should not be lost", func() {
+			lister.answered = func() {
+				r.Apply(events.Event{Device: "lamp", Reading: "state", Value: "off", Time: time.Now()})
+				r.Apply(events.Event{Device: "global", Reading: "state", Value: "ATTR thermostat room Bath"})
+			}
+			So(r.Sync(context.Background()), ShouldBeNil)
+			lister.answered = nil
+			dev, _ := r.GetByName("lamp")
+			So(dev.Readings["state"].Value, ShouldEqual, "off")
+			dev, _ = r.GetByName("thermostat")
+			So(dev.Attributes["room"], ShouldEqual, "Bath")
+
+			// The events are only applied again by the synchronization running while they have arrived
+			r.Apply(events.Event{Device: "lamp", Reading: "state", Value: "on", Time: time.Now()})
+			So(r.Sync(context.Background()), ShouldBeNil)
+			dev, _ = r.GetByName("lamp")
+			So(dev.Readings["state"].Value, ShouldEqual, "on")
+		})
+
+		Convey("Global events should update the device structure", func() {
+			r.Apply(events.Event{Device: "global", Reading: "state", Value: "ATTR lamp room Bath Room"})
+			dev, _ := r.GetByName("lamp")
+			So(dev.Attributes["room"], ShouldEqual, "Bath Room")
+
+			r.Apply(events.Event{Device: "global", Reading: "state", Value: "DELETEATTR lamp room"})
+			dev, _ = r.GetByName("lamp")
+			So(dev.Attributes, ShouldNotContainKey, "room")
+
+			r.Apply(events.Event{Device: "global", Reading: "state", Value: "RENAMED lamp light"})
+			_, err := r.GetByName("lamp")
+			So(err, ShouldEqual, repo.ErrNotExisting)
+			dev, err = r.GetByName("light")
+			So(err, ShouldBeNil)
+			So(dev.Name, ShouldEqual, "light")
+
+			r.Apply(events.Event{Device: "global", Reading: "state", Value: "DELETED light"})
+			_, err = r.GetByName("light")
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Events received from the bus should be applied", func() {
+			bus := events.NewBus(log.New(kitlog.NewNopLogger(), log.LvlDebug))
+			r.Start(bus)
+			bus.Publish(events.Event{Device: "lamp", Reading: "state", Value: "off"})
+			r.Stop()
+			dev, _ := r.GetByName("lamp")
+			So(dev.Readings["state"].Value, ShouldEqual, "off")
+		})
+	})
+}
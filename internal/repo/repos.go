@@ -4,6 +4,7 @@ package repo
 
 import (
 	"errors"
+	"time"
 
 	"github.com/derWhity/micasa/internal/models"
 )
@@ -15,8 +16,24 @@ var (
 	// ErrNotExisting is an error that is returned when a repo is asked to return a specific item, but the item does
 	// not exist inside the repo
 	ErrNotExisting = errors.New("Record does not exist")
+	// ErrInvalidSortField is an error that is returned when the results of a search should be sorted by a field the
+	// repo does not support sorting by
+	ErrInvalidSortField = errors.New("Invalid sort field")
+	// ErrInvalidPermission is an error that is returned when a role should be stored with an unknown or malformed
+	// permission
+	ErrInvalidPermission = errors.New("Invalid permission")
+	// ErrBuiltIn is an error that is returned when trying to delete a built-in record
+	ErrBuiltIn = errors.New("Built-in records cannot be deleted")
 )
 
+// SortOrder defines how to sort the results of a search
+type SortOrder struct {
+	// The name of the field to sort by
+	Field string
+	// Sort in descending order
+	Descending bool
+}
+
 // UserRepo defines a repository that is able to store, query for and authenticate users
 type UserRepo interface {
 	// Create creates a new user
@@ -27,10 +44,86 @@ type UserRepo interface {
 	Delete(id models.UserID) error
 	// GetByID returns the user with the given ID
 	GetByID(id models.UserID) (*models.User, error)
+	// GetByName returns the user with the given (case-insensitive) user name
+	GetByName(name string) (*models.User, error)
 	// GetByCredentials returns the user which has the given username and password - this is used for login
 	GetByCredentials(username string, password string) (*models.User, error)
-	// Find searches for users matching the given search string - supports pagination
-	Find(search string, offset uint, limit uint) ([]*models.User, error)
+	// Find searches for users whose name or full name contains the given search string (case-insensitive) - supports
+	// pagination. A limit of 0 returns all matching users. The users are ordered by name unless sort orders are given;
+	// supported fields are "name", "fullName", "createdAt" and "updatedAt".
+	Find(search string, offset uint, limit uint, sort ...SortOrder) ([]*models.User, error)
+	// Count returns the total number of users matching the given search string
+	Count(search string) (uint, error)
 	// Check if the user exists
 	Exists(id models.UserID) (bool, error)
 }
+
+// RoleRepo defines a repository that stores roles and their assignment to users
+type RoleRepo interface {
+	// Create creates a new role
+	Create(r *models.Role) error
+	// Update updates an existing role including its permissions
+	Update(r *models.Role) error
+	// Delete removes a role and all of its assignments - built-in roles cannot be deleted
+	Delete(id models.RoleID) error
+	// GetByID returns the role with the given ID
+	GetByID(id models.RoleID) (*models.Role, error)
+	// GetAll returns all roles ordered by name
+	GetAll() ([]*models.Role, error)
+	// GetByUser returns the roles assigned to the given user
+	GetByUser(userID models.UserID) ([]*models.Role, error)
+	// Assign assigns the role to the given user
+	Assign(userID models.UserID, roleID models.RoleID) error
+	// Unassign removes the role from the given user
+	Unassign(userID models.UserID, roleID models.RoleID) error
+}
+
+// SessionRepo defines a repository that stores the login sessions of users
+type SessionRepo interface {
+	// Create stores a new session
+	Create(s *models.Session) error
+	// Touch updates the last-seen time, expiry time, IP address and user agent of an existing session
+	Touch(s *models.Session) error
+	// Delete removes a session - the session is no longer usable afterwards
+	Delete(id models.SessionID) error
+	// DeleteByUser removes all sessions of the given user
+	DeleteByUser(userID models.UserID) error
+	// DeleteExpired removes all sessions that have expired before the given time and returns their number
+	DeleteExpired(now time.Time) (uint, error)
+	// GetByID returns the session with the given ID
+	GetByID(id models.SessionID) (*models.Session, error)
+	// GetByTokenHash returns the session identified by the given token hash
+	GetByTokenHash(hash string) (*models.Session, error)
+	// GetByUser returns all sessions of the given user which have not expired yet - the most recently used first
+	GetByUser(userID models.UserID, now time.Time) ([]*models.Session, error)
+}
+
+// APITokenRepo defines a repository that stores the personal API tokens of users
+type APITokenRepo interface {
+	// Create stores a new API token - the token's scopes must be valid permissions
+	Create(t *models.APIToken) error
+	// Touch sets the last-used time of the token
+	Touch(id models.APITokenID, lastUsed time.Time) error
+	// Delete removes a token - the token is no longer usable afterwards
+	Delete(id models.APITokenID) error
+	// GetByID returns the token with the given ID
+	GetByID(id models.APITokenID) (*models.APIToken, error)
+	// GetByTokenHash returns the token identified by the given token hash
+	GetByTokenHash(hash string) (*models.APIToken, error)
+	// GetByUser returns all tokens of the given user ordered by name - including the expired ones
+	GetByUser(userID models.UserID) ([]*models.APIToken, error)
+}
+
+// DeviceRepo defines a repository that provides the current state of the FHEM devices
+type DeviceRepo interface {
+	// GetByName returns the device with the given name
+	GetByName(name string) (*models.Device, error)
+	// GetAll returns all known devices ordered by name
+	GetAll() ([]*models.Device, error)
+	// FindByType returns all devices of the given TYPE
+	FindByType(deviceType string) ([]*models.Device, error)
+	// FindByRoom returns all devices assigned to the given room
+	FindByRoom(room string) ([]*models.Device, error)
+	// FindByReading returns all devices providing a reading with the given name
+	FindByReading(reading string) ([]*models.Device, error)
+}
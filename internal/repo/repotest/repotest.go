@@ -0,0 +1,54 @@
+// Package repotest contains helpers for testing the repositories against a real SQLite database
+package repotest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/derWhity/micasa/internal/fsutils"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/migrate"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3" // Just needed for the sqlite driver
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// dbName is the file of the test database - inside a directory of its own which is removed on teardown
+var dbName = filepath.Join(os.TempDir(), uuid.NewV4().String(), "test.db")
+
+// SetupDB creates an empty test database with all migrations applied. A test database left behind by a previous
+// test is removed first.
+func SetupDB(logger log.Logger) (*sqlx.DB, error) {
+	if err := TeardownDB(nil, logger); err != nil {
+		return nil, err
+	}
+	fsutils.CheckAndCreateDir(filepath.Dir(dbName), logger)
+	db, err := sqlx.Open("sqlite3", dbName)
+	if err != nil {
+		return nil, err
+	}
+	// Perform DB migrations
+	if err = migrate.ExecuteMigrationsOnDb(db, logger); err != nil {
+		logger.Crit("Database migration has failed", log.FldError, err)
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// TeardownDB closes the test database - if given - and deletes it
+func TeardownDB(db *sqlx.DB, logger log.Logger) error {
+	if db != nil {
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	dir := filepath.Dir(dbName)
+	logger.Info(fmt.Sprintf("Deleting test DB directory '%s'", dir))
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "Failed to delete temporary test DB dir")
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Package sqlite provides a role repository that reads and writes roles and their assignments from/to a SQLite
+// database
+package sqlite
+
+import (
+	"strings"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	duplicateErrorPrefix = "UNIQUE constraint failed"
+	noResultError        = "sql: no rows in result set"
+	insertQuery          = `INSERT INTO Roles(roleid, name, description) VALUES(?, ?, ?)`
+	deleteQuery          = `DELETE FROM Roles WHERE roleid = ?`
+	selectQuery          = `SELECT
+								roleid, name, description, builtIn, createdAt, updatedAt
+							FROM
+								Roles`
+	getByIDQuery   = selectQuery + ` WHERE roleid = ?`
+	getAllQuery    = selectQuery + ` ORDER BY name, roleid`
+	getByUserQuery = selectQuery + ` WHERE roleid IN (SELECT roleid FROM UserRoles WHERE userid = ?) ORDER BY name, roleid`
+	updateQuery    = `UPDATE
+							Roles
+						SET
+							name = ?,
+							description = ?,
+							updatedAt = CURRENT_TIMESTAMP
+						WHERE
+							roleid = ?`
+	permissionsQuery      = `SELECT roleid, permission FROM RolePermissions ORDER BY permission`
+	deletePermissionQuery = `DELETE FROM RolePermissions WHERE roleid = ?`
+	insertPermissionQuery = `INSERT INTO RolePermissions(roleid, permission) VALUES(?, ?)`
+	assignQuery           = `INSERT OR IGNORE INTO UserRoles(userid, roleid) VALUES(?, ?)`
+	unassignQuery         = `DELETE FROM UserRoles WHERE userid = ? AND roleid = ?`
+	userExistsQuery       = `SELECT COUNT(*) AS count FROM Users WHERE userid = ?`
+)
+
+// RoleRepo provides a role storage based on a SQLite database
+type RoleRepo struct {
+	db *sqlx.DB
+}
+
+// New creates a new role repository instance
+func New(db *sqlx.DB) *RoleRepo {
+	return &RoleRepo{
+		db: db,
+	}
+}
+
+func handleSqliteError(err error, defaultMessage string) error {
+	if strings.HasPrefix(err.Error(), duplicateErrorPrefix) {
+		return repo.ErrDuplicate
+	}
+	if err.Error() == noResultError {
+		return repo.ErrNotExisting
+	}
+	return errors.Wrap(err, defaultMessage)
+}
+
+func validatePermissions(perms models.Permissions) error {
+	for _, p := range perms {
+		if !p.IsValid() {
+			return repo.ErrInvalidPermission
+		}
+	}
+	return nil
+}
+
+// writePermissions replaces the permissions of the role inside the given transaction
+func writePermissions(tx *sqlx.Tx, r *models.Role) error {
+	if _, err := tx.Exec(deletePermissionQuery, string(r.ID)); err != nil {
+		return handleSqliteError(err, "Failed to remove role permissions")
+	}
+	seen := make(map[models.Permission]bool)
+	for _, p := range r.Permissions {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if _, err := tx.Exec(insertPermissionQuery, string(r.ID), string(p)); err != nil {
+			return handleSqliteError(err, "Failed to insert role permission")
+		}
+	}
+	return nil
+}
+
+// loadPermissions fills the permissions of the given roles
+func (r *RoleRepo) loadPermissions(roles []*models.Role) error {
+	rows, err := r.db.Query(permissionsQuery)
+	if err != nil {
+		return handleSqliteError(err, "Failed to load role permissions")
+	}
+	defer rows.Close()
+	byID := make(map[models.RoleID]*models.Role, len(roles))
+	for _, role := range roles {
+		role.Permissions = models.Permissions{}
+		byID[role.ID] = role
+	}
+	for rows.Next() {
+		var id, perm string
+		if err := rows.Scan(&id, &perm); err != nil {
+			return handleSqliteError(err, "Failed to read role permission")
+		}
+		if role, ok := byID[models.RoleID(id)]; ok {
+			role.Permissions = append(role.Permissions, models.Permission(perm))
+		}
+	}
+	return rows.Err()
+}
+
+// Create creates a new role
+func (r *RoleRepo) Create(role *models.Role) error {
+	if err := validatePermissions(role.Permissions); err != nil {
+		return err
+	}
+	role.ID = models.RoleID(uuid.NewV4().String())
+	role.BuiltIn = false
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(insertQuery, string(role.ID), role.Name, role.Description); err != nil {
+		return handleSqliteError(err, "Failed to insert role")
+	}
+	if err := writePermissions(tx, role); err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit role")
+}
+
+// Update updates an existing role including its permissions
+func (r *RoleRepo) Update(role *models.Role) error {
+	if err := validatePermissions(role.Permissions); err != nil {
+		return err
+	}
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(updateQuery, role.Name, role.Description, string(role.ID))
+	if err != nil {
+		return handleSqliteError(err, "Failed to update role")
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return repo.ErrNotExisting
+	}
+	if err := writePermissions(tx, role); err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit role")
+}
+
+// Delete removes a role and all of its assignments - built-in roles cannot be deleted
+func (r *RoleRepo) Delete(id models.RoleID) error {
+	role, err := r.GetByID(id)
+	if err != nil {
+		if err == repo.ErrNotExisting {
+			return nil
+		}
+		return err
+	}
+	if role.BuiltIn {
+		return repo.ErrBuiltIn
+	}
+	if _, err := r.db.Exec(deleteQuery, string(id)); err != nil {
+		return errors.Wrapf(err, "Failed to delete role with ID '%s'", id)
+	}
+	return nil
+}
+
+// GetByID returns the role with the given ID
+func (r *RoleRepo) GetByID(id models.RoleID) (*models.Role, error) {
+	var role models.Role
+	if err := r.db.Get(&role, getByIDQuery, string(id)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve role from database")
+	}
+	if err := r.loadPermissions([]*models.Role{&role}); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// GetAll returns all roles ordered by name
+func (r *RoleRepo) GetAll() ([]*models.Role, error) {
+	roles := []*models.Role{}
+	if err := r.db.Select(&roles, getAllQuery); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve roles from database")
+	}
+	if err := r.loadPermissions(roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetByUser returns the roles assigned to the given user
+func (r *RoleRepo) GetByUser(userID models.UserID) ([]*models.Role, error) {
+	roles := []*models.Role{}
+	if err := r.db.Select(&roles, getByUserQuery, string(userID)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve roles from database")
+	}
+	if err := r.loadPermissions(roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// Assign assigns the role to the given user
+func (r *RoleRepo) Assign(userID models.UserID, roleID models.RoleID) error {
+	var num int64
+	if err := r.db.Get(&num, userExistsQuery, string(userID)); err != nil {
+		return handleSqliteError(err, "Failed to check for user existence")
+	}
+	if num == 0 {
+		return repo.ErrNotExisting
+	}
+	if _, err := r.GetByID(roleID); err != nil {
+		return err
+	}
+	if _, err := r.db.Exec(assignQuery, string(userID), string(roleID)); err != nil {
+		return handleSqliteError(err, "Failed to assign role")
+	}
+	return nil
+}
+
+// Unassign removes the role from the given user
+func (r *RoleRepo) Unassign(userID models.UserID, roleID models.RoleID) error {
+	if _, err := r.db.Exec(unassignQuery, string(userID), string(roleID)); err != nil {
+		return errors.Wrapf(err, "Failed to remove role '%s' from user '%s'", roleID, userID)
+	}
+	return nil
+}
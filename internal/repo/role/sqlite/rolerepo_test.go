@@ -0,0 +1,129 @@
+package sqlite_test
+
+import (
+	"testing"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/derWhity/micasa/internal/repo/repotest"
+	"github.com/derWhity/micasa/internal/repo/role/sqlite"
+	usersqlite "github.com/derWhity/micasa/internal/repo/user/sqlite"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func roleIDs(roles []*models.Role) []models.RoleID {
+	var ids []models.RoleID
+	for _, r := range roles {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestRoleRepo(t *testing.T) {
+	Convey("Having a test database instance with a RoleRepo", t, func() {
+		logger := log.New(kitlog.NewNopLogger(), log.LvlDebug)
+		db, err := repotest.SetupDB(logger)
+		So(err, ShouldBeNil)
+		r := sqlite.New(db)
+		users := usersqlite.New(db)
+		user := models.User{Name: "amy", FullName: "Amy Pond"}
+		So(users.Create(&user), ShouldBeNil)
+
+		Convey("The built-in roles should exist", func() {
+			roles, err := r.GetAll()
+			So(err, ShouldBeNil)
+			So(roleIDs(roles), ShouldResemble, []models.RoleID{models.RoleAdmin, models.RoleGuest, models.RoleMember})
+			for _, role := range roles {
+				So(role.BuiltIn, ShouldBeTrue)
+			}
+			admin, err := r.GetByID(models.RoleAdmin)
+			So(err, ShouldBeNil)
+			So(admin.Permissions, ShouldResemble, models.Permissions{models.PermAll})
+			member, err := r.GetByID(models.RoleMember)
+			So(err, ShouldBeNil)
+			So(member.Permissions, ShouldResemble, models.Permissions{models.PermDevicesControl, models.PermDevicesView})
+		})
+
+		Convey("Creating and updating roles should store their permissions", func() {
+			role := models.Role{
+				ID:          "kids",
+				Name:        "Kids",
+				BuiltIn:     true,
+				Permissions: models.Permissions{"devices.control:light_*", models.PermDevicesView},
+			}
+			So(r.Create(&role), ShouldBeNil)
+			So(role.ID, ShouldNotEqual, "kids")
+			So(role.BuiltIn, ShouldBeFalse)
+
+			stored, err := r.GetByID(role.ID)
+			So(err, ShouldBeNil)
+			So(stored.Name, ShouldEqual, "Kids")
+			So(stored.Permissions, ShouldResemble, role.Permissions)
+
+			role.Description = "Switching lights only"
+			role.Permissions = models.Permissions{"devices.control:light_*"}
+			So(r.Update(&role), ShouldBeNil)
+			stored, err = r.GetByID(role.ID)
+			So(err, ShouldBeNil)
+			So(stored.Description, ShouldEqual, "Switching lights only")
+			So(stored.Permissions, ShouldResemble, role.Permissions)
+
+			So(r.Create(&models.Role{Name: "Kids"}), ShouldEqual, repo.ErrDuplicate)
+			So(r.Update(&models.Role{ID: "unknown", Name: "Unknown"}), ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Invalid permissions should be rejected", func() {
+			So(r.Create(&models.Role{Name: "Bad", Permissions: models.Permissions{"devices.explode"}}), ShouldEqual, repo.ErrInvalidPermission)
+			So(r.Create(&models.Role{Name: "Bad", Permissions: models.Permissions{"*:lamp"}}), ShouldEqual, repo.ErrInvalidPermission)
+			So(r.Create(&models.Role{Name: "Bad", Permissions: models.Permissions{"devices.view:["}}), ShouldEqual, repo.ErrInvalidPermission)
+			roles, err := r.GetAll()
+			So(err, ShouldBeNil)
+			So(roles, ShouldHaveLength, 3)
+		})
+
+		Convey("Built-in roles should not be deletable", func() {
+			So(r.Delete(models.RoleAdmin), ShouldEqual, repo.ErrBuiltIn)
+			_, err := r.GetByID(models.RoleAdmin)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Roles should be assignable to users", func() {
+			So(r.Assign(user.ID, models.RoleGuest), ShouldBeNil)
+			So(r.Assign(user.ID, models.RoleGuest), ShouldBeNil)
+			So(r.Assign(user.ID, models.RoleMember), ShouldBeNil)
+			So(r.Assign("unknown", models.RoleGuest), ShouldEqual, repo.ErrNotExisting)
+			So(r.Assign(user.ID, "unknown"), ShouldEqual, repo.ErrNotExisting)
+
+			roles, err := r.GetByUser(user.ID)
+			So(err, ShouldBeNil)
+			So(roleIDs(roles), ShouldResemble, []models.RoleID{models.RoleGuest, models.RoleMember})
+
+			So(r.Unassign(user.ID, models.RoleGuest), ShouldBeNil)
+			roles, err = r.GetByUser(user.ID)
+			So(err, ShouldBeNil)
+			So(roleIDs(roles), ShouldResemble, []models.RoleID{models.RoleMember})
+		})
+
+		Convey("Deleting roles or users should remove their assignments", func() {
+			role := models.Role{Name: "Kids"}
+			So(r.Create(&role), ShouldBeNil)
+			So(r.Assign(user.ID, role.ID), ShouldBeNil)
+			So(r.Delete(role.ID), ShouldBeNil)
+			roles, err := r.GetByUser(user.ID)
+			So(err, ShouldBeNil)
+			So(roles, ShouldBeEmpty)
+
+			So(r.Assign(user.ID, models.RoleGuest), ShouldBeNil)
+			So(users.Delete(user.ID), ShouldBeNil)
+			var num int
+			So(db.Get(&num, "SELECT COUNT(*) FROM UserRoles"), ShouldBeNil)
+			So(num, ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			repotest.TeardownDB(db, logger)
+		})
+	})
+}
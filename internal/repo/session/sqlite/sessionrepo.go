@@ -0,0 +1,161 @@
+// Package sqlite provides a session repository that reads and writes login sessions from/to a SQLite database
+package sqlite
+
+import (
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	duplicateErrorPrefix = "UNIQUE constraint failed"
+	noResultError        = "sql: no rows in result set"
+	insertQuery          = `INSERT INTO Sessions(
+								sessionid, userid, tokenHash, ip, userAgent, createdAt, lastSeen, expiresAt
+							) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+	touchQuery = `UPDATE
+					Sessions
+				SET
+					ip = ?,
+					userAgent = ?,
+					lastSeen = ?,
+					expiresAt = ?
+				WHERE
+					sessionid = ?`
+	deleteQuery        = `DELETE FROM Sessions WHERE sessionid = ?`
+	deleteByUserQuery  = `DELETE FROM Sessions WHERE userid = ?`
+	deleteExpiredQuery = `DELETE FROM Sessions WHERE expiresAt <= ?`
+	selectQuery        = `SELECT
+							sessionid, userid, tokenHash, ip, userAgent, createdAt, lastSeen, expiresAt
+						FROM
+							Sessions`
+	getByIDQuery        = selectQuery + ` WHERE sessionid = ?`
+	getByTokenHashQuery = selectQuery + ` WHERE tokenHash = ?`
+	getByUserQuery      = selectQuery + ` WHERE userid = ? AND expiresAt > ? ORDER BY lastSeen DESC, sessionid`
+)
+
+// SessionRepo provides a session storage based on a SQLite database
+type SessionRepo struct {
+	db *sqlx.DB
+}
+
+// New creates a new session repository instance
+func New(db *sqlx.DB) *SessionRepo {
+	return &SessionRepo{
+		db: db,
+	}
+}
+
+func handleSqliteError(err error, defaultMessage string) error {
+	if strings.HasPrefix(err.Error(), duplicateErrorPrefix) {
+		return repo.ErrDuplicate
+	}
+	if err.Error() == noResultError {
+		return repo.ErrNotExisting
+	}
+	return errors.Wrap(err, defaultMessage)
+}
+
+// dbTime normalizes the given time for storing it - all times are stored in UTC with a precision of one second, so
+// they can be compared as strings inside the database
+func dbTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// Create stores a new session
+func (r *SessionRepo) Create(s *models.Session) error {
+	s.ID = models.SessionID(uuid.NewV4().String())
+	s.CreatedAt = dbTime(s.CreatedAt)
+	s.LastSeen = dbTime(s.LastSeen)
+	s.ExpiresAt = dbTime(s.ExpiresAt)
+	_, err := r.db.Exec(
+		insertQuery,
+		string(s.ID),
+		string(s.UserID),
+		s.TokenHash,
+		s.IP,
+		s.UserAgent,
+		s.CreatedAt,
+		s.LastSeen,
+		s.ExpiresAt,
+	)
+	if err != nil {
+		return handleSqliteError(err, "Failed to insert session")
+	}
+	return nil
+}
+
+// Touch updates the last-seen time, expiry time, IP address and user agent of an existing session
+func (r *SessionRepo) Touch(s *models.Session) error {
+	s.LastSeen = dbTime(s.LastSeen)
+	s.ExpiresAt = dbTime(s.ExpiresAt)
+	res, err := r.db.Exec(touchQuery, s.IP, s.UserAgent, s.LastSeen, s.ExpiresAt, string(s.ID))
+	if err != nil {
+		return handleSqliteError(err, "Failed to update session")
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return repo.ErrNotExisting
+	}
+	return nil
+}
+
+// Delete removes a session - the session is no longer usable afterwards
+func (r *SessionRepo) Delete(id models.SessionID) error {
+	if _, err := r.db.Exec(deleteQuery, string(id)); err != nil {
+		return errors.Wrapf(err, "Failed to delete session with ID '%s'", id)
+	}
+	return nil
+}
+
+// DeleteByUser removes all sessions of the given user
+func (r *SessionRepo) DeleteByUser(userID models.UserID) error {
+	if _, err := r.db.Exec(deleteByUserQuery, string(userID)); err != nil {
+		return errors.Wrapf(err, "Failed to delete the sessions of user '%s'", userID)
+	}
+	return nil
+}
+
+// DeleteExpired removes all sessions that have expired before the given time and returns their number
+func (r *SessionRepo) DeleteExpired(now time.Time) (uint, error) {
+	res, err := r.db.Exec(deleteExpiredQuery, dbTime(now))
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to delete expired sessions")
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to determine the number of deleted sessions")
+	}
+	return uint(num), nil
+}
+
+// GetByID returns the session with the given ID
+func (r *SessionRepo) GetByID(id models.SessionID) (*models.Session, error) {
+	var s models.Session
+	if err := r.db.Get(&s, getByIDQuery, string(id)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve session from database")
+	}
+	return &s, nil
+}
+
+// GetByTokenHash returns the session identified by the given token hash
+func (r *SessionRepo) GetByTokenHash(hash string) (*models.Session, error) {
+	var s models.Session
+	if err := r.db.Get(&s, getByTokenHashQuery, hash); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve session from database")
+	}
+	return &s, nil
+}
+
+// GetByUser returns all sessions of the given user which have not expired yet - the most recently used first
+func (r *SessionRepo) GetByUser(userID models.UserID, now time.Time) ([]*models.Session, error) {
+	sessions := []*models.Session{}
+	if err := r.db.Select(&sessions, getByUserQuery, string(userID), dbTime(now)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve sessions from database")
+	}
+	return sessions, nil
+}
@@ -0,0 +1,128 @@
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/derWhity/micasa/internal/repo/repotest"
+	"github.com/derWhity/micasa/internal/repo/session/sqlite"
+	usersqlite "github.com/derWhity/micasa/internal/repo/user/sqlite"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessionRepo(t *testing.T) {
+	Convey("Having a test database instance with a SessionRepo", t, func() {
+		logger := log.New(kitlog.NewNopLogger(), log.LvlDebug)
+		db, err := repotest.SetupDB(logger)
+		So(err, ShouldBeNil)
+		r := sqlite.New(db)
+		users := usersqlite.New(db)
+		user := models.User{Name: "amy", FullName: "Amy Pond"}
+		So(users.Create(&user), ShouldBeNil)
+		now := time.Date(2017, 11, 29, 20, 15, 0, 0, time.Local)
+
+		newSession := func(token string, lastSeen time.Time, lifetime time.Duration) *models.Session {
+			s := &models.Session{
+				UserID:    user.ID,
+				TokenHash: models.HashSessionToken(token),
+				IP:        "192.168.1.10",
+				UserAgent: "Test/1.0",
+				CreatedAt: lastSeen,
+				LastSeen:  lastSeen,
+				ExpiresAt: lastSeen.Add(lifetime),
+			}
+			So(r.Create(s), ShouldBeNil)
+			return s
+		}
+
+		Convey("Created sessions should be retrievable by ID and token", func() {
+			s := newSession("tardis", now, time.Hour)
+			So(s.ID, ShouldNotBeEmpty)
+
+			stored, err := r.GetByID(s.ID)
+			So(err, ShouldBeNil)
+			So(stored.UserID, ShouldEqual, user.ID)
+			So(stored.IP, ShouldEqual, "192.168.1.10")
+			So(stored.UserAgent, ShouldEqual, "Test/1.0")
+			So(stored.ExpiresAt.Equal(now.Add(time.Hour)), ShouldBeTrue)
+
+			stored, err = r.GetByTokenHash(models.HashSessionToken("tardis"))
+			So(err, ShouldBeNil)
+			So(stored.ID, ShouldEqual, s.ID)
+
+			_, err = r.GetByTokenHash(models.HashSessionToken("dalek"))
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Touching a session should update its usage data", func() {
+			s := newSession("tardis", now, time.Hour)
+			s.LastSeen = now.Add(30 * time.Minute)
+			s.ExpiresAt = s.LastSeen.Add(time.Hour)
+			s.IP = "10.0.0.1"
+			So(r.Touch(s), ShouldBeNil)
+
+			stored, err := r.GetByID(s.ID)
+			So(err, ShouldBeNil)
+			So(stored.IP, ShouldEqual, "10.0.0.1")
+			So(stored.LastSeen.Equal(now.Add(30*time.Minute)), ShouldBeTrue)
+			So(stored.CreatedAt.Equal(now), ShouldBeTrue)
+
+			So(r.Touch(&models.Session{ID: "unknown"}), ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Listing the sessions of a user should skip expired ones", func() {
+			older := newSession("tardis", now.Add(-time.Hour), 2*time.Hour)
+			newer := newSession("police box", now, time.Hour)
+			newSession("expired", now.Add(-2*time.Hour), time.Hour)
+
+			sessions, err := r.GetByUser(user.ID, now)
+			So(err, ShouldBeNil)
+			So(sessions, ShouldHaveLength, 2)
+			So(sessions[0].ID, ShouldEqual, newer.ID)
+			So(sessions[1].ID, ShouldEqual, older.ID)
+
+			sessions, err = r.GetByUser("unknown", now)
+			So(err, ShouldBeNil)
+			So(sessions, ShouldBeEmpty)
+		})
+
+		Convey("Expired sessions should be removable", func() {
+			s := newSession("tardis", now, time.Hour)
+			newSession("expired", now.Add(-2*time.Hour), time.Hour)
+			num, err := r.DeleteExpired(now)
+			So(err, ShouldBeNil)
+			So(num, ShouldEqual, 1)
+			_, err = r.GetByID(s.ID)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Deleting sessions should revoke them", func() {
+			s := newSession("tardis", now, time.Hour)
+			other := newSession("police box", now, time.Hour)
+			So(r.Delete(s.ID), ShouldBeNil)
+			_, err := r.GetByID(s.ID)
+			So(err, ShouldEqual, repo.ErrNotExisting)
+			_, err = r.GetByID(other.ID)
+			So(err, ShouldBeNil)
+
+			So(r.DeleteByUser(user.ID), ShouldBeNil)
+			_, err = r.GetByID(other.ID)
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Deleting a user should remove his/her sessions", func() {
+			s := newSession("tardis", now, time.Hour)
+			So(users.Delete(user.ID), ShouldBeNil)
+			_, err := r.GetByID(s.ID)
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Reset(func() {
+			repotest.TeardownDB(db, logger)
+		})
+	})
+}
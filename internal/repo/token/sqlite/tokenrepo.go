@@ -0,0 +1,155 @@
+// Package sqlite provides an API token repository that reads and writes personal API tokens from/to a SQLite database
+package sqlite
+
+import (
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	duplicateErrorPrefix = "UNIQUE constraint failed"
+	noResultError        = "sql: no rows in result set"
+	insertQuery          = `INSERT INTO ApiTokens(
+								tokenid, userid, name, tokenHash, scopes, createdAt, expiresAt
+							) VALUES(?, ?, ?, ?, ?, ?, ?)`
+	touchQuery  = `UPDATE ApiTokens SET lastUsed = ? WHERE tokenid = ?`
+	deleteQuery = `DELETE FROM ApiTokens WHERE tokenid = ?`
+	selectQuery = `SELECT
+						tokenid, userid, name, tokenHash, scopes, createdAt, expiresAt, lastUsed
+					FROM
+						ApiTokens`
+	getByIDQuery        = selectQuery + ` WHERE tokenid = ?`
+	getByTokenHashQuery = selectQuery + ` WHERE tokenHash = ?`
+	getByUserQuery      = selectQuery + ` WHERE userid = ? ORDER BY name, tokenid`
+)
+
+// tokenRow is the database representation of an API token - the scopes are stored as space-separated list
+type tokenRow struct {
+	models.APIToken
+	ScopeList string `db:"scopes"`
+}
+
+func (r *tokenRow) token() *models.APIToken {
+	t := r.APIToken
+	t.Scopes = models.Permissions{}
+	for _, s := range strings.Fields(r.ScopeList) {
+		t.Scopes = append(t.Scopes, models.Permission(s))
+	}
+	return &t
+}
+
+// TokenRepo provides an API token storage based on a SQLite database
+type TokenRepo struct {
+	db *sqlx.DB
+}
+
+// New creates a new API token repository instance
+func New(db *sqlx.DB) *TokenRepo {
+	return &TokenRepo{
+		db: db,
+	}
+}
+
+func handleSqliteError(err error, defaultMessage string) error {
+	if strings.HasPrefix(err.Error(), duplicateErrorPrefix) {
+		return repo.ErrDuplicate
+	}
+	if err.Error() == noResultError {
+		return repo.ErrNotExisting
+	}
+	return errors.Wrap(err, defaultMessage)
+}
+
+// dbTime normalizes the given time for storing it - all times are stored in UTC with a precision of one second
+func dbTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// Create stores a new API token - the token's scopes must be valid permissions
+func (r *TokenRepo) Create(t *models.APIToken) error {
+	scopes := make([]string, 0, len(t.Scopes))
+	for _, s := range t.Scopes {
+		if !s.IsValid() {
+			return repo.ErrInvalidPermission
+		}
+		scopes = append(scopes, string(s))
+	}
+	t.ID = models.APITokenID(uuid.NewV4().String())
+	t.CreatedAt = dbTime(t.CreatedAt)
+	if t.ExpiresAt != nil {
+		expires := dbTime(*t.ExpiresAt)
+		t.ExpiresAt = &expires
+	}
+	t.LastUsed = nil
+	_, err := r.db.Exec(
+		insertQuery,
+		string(t.ID),
+		string(t.UserID),
+		t.Name,
+		t.TokenHash,
+		strings.Join(scopes, " "),
+		t.CreatedAt,
+		t.ExpiresAt,
+	)
+	if err != nil {
+		return handleSqliteError(err, "Failed to insert API token")
+	}
+	return nil
+}
+
+// Touch sets the last-used time of the token
+func (r *TokenRepo) Touch(id models.APITokenID, lastUsed time.Time) error {
+	res, err := r.db.Exec(touchQuery, dbTime(lastUsed), string(id))
+	if err != nil {
+		return handleSqliteError(err, "Failed to update API token")
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return repo.ErrNotExisting
+	}
+	return nil
+}
+
+// Delete removes a token - the token is no longer usable afterwards
+func (r *TokenRepo) Delete(id models.APITokenID) error {
+	if _, err := r.db.Exec(deleteQuery, string(id)); err != nil {
+		return errors.Wrapf(err, "Failed to delete API token with ID '%s'", id)
+	}
+	return nil
+}
+
+// GetByID returns the token with the given ID
+func (r *TokenRepo) GetByID(id models.APITokenID) (*models.APIToken, error) {
+	var row tokenRow
+	if err := r.db.Get(&row, getByIDQuery, string(id)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve API token from database")
+	}
+	return row.token(), nil
+}
+
+// GetByTokenHash returns the token identified by the given token hash
+func (r *TokenRepo) GetByTokenHash(hash string) (*models.APIToken, error) {
+	var row tokenRow
+	if err := r.db.Get(&row, getByTokenHashQuery, hash); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve API token from database")
+	}
+	return row.token(), nil
+}
+
+// GetByUser returns all tokens of the given user ordered by name - including the expired ones
+func (r *TokenRepo) GetByUser(userID models.UserID) ([]*models.APIToken, error) {
+	rows := []*tokenRow{}
+	if err := r.db.Select(&rows, getByUserQuery, string(userID)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve API tokens from database")
+	}
+	tokens := make([]*models.APIToken, 0, len(rows))
+	for _, row := range rows {
+		tokens = append(tokens, row.token())
+	}
+	return tokens, nil
+}
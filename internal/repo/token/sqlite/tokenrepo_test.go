@@ -0,0 +1,101 @@
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/derWhity/micasa/internal/repo/repotest"
+	"github.com/derWhity/micasa/internal/repo/token/sqlite"
+	usersqlite "github.com/derWhity/micasa/internal/repo/user/sqlite"
+	kitlog "github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenRepo(t *testing.T) {
+	Convey("Having a test database instance with a TokenRepo", t, func() {
+		logger := log.New(kitlog.NewNopLogger(), log.LvlDebug)
+		db, err := repotest.SetupDB(logger)
+		So(err, ShouldBeNil)
+		r := sqlite.New(db)
+		users := usersqlite.New(db)
+		user := models.User{Name: "amy", FullName: "Amy Pond"}
+		So(users.Create(&user), ShouldBeNil)
+		now := time.Date(2017, 11, 29, 20, 15, 0, 0, time.UTC)
+
+		Convey("Created tokens should be retrievable by ID, hash and user", func() {
+			expires := now.Add(24 * time.Hour)
+			token := models.APIToken{
+				UserID:    user.ID,
+				Name:      "Wall panel",
+				TokenHash: models.HashAPIToken("micasa_tardis"),
+				Scopes:    models.Permissions{models.PermDevicesView, "devices.control:light_*"},
+				CreatedAt: now,
+				ExpiresAt: &expires,
+			}
+			So(r.Create(&token), ShouldBeNil)
+			So(token.ID, ShouldNotBeEmpty)
+
+			stored, err := r.GetByID(token.ID)
+			So(err, ShouldBeNil)
+			So(stored.Name, ShouldEqual, "Wall panel")
+			So(stored.Scopes, ShouldResemble, token.Scopes)
+			So(stored.ExpiresAt.Equal(expires), ShouldBeTrue)
+			So(stored.LastUsed, ShouldBeNil)
+
+			stored, err = r.GetByTokenHash(models.HashAPIToken("micasa_tardis"))
+			So(err, ShouldBeNil)
+			So(stored.ID, ShouldEqual, token.ID)
+
+			script := models.APIToken{UserID: user.ID, Name: "Backup script", TokenHash: "abc", CreatedAt: now}
+			So(r.Create(&script), ShouldBeNil)
+			tokens, err := r.GetByUser(user.ID)
+			So(err, ShouldBeNil)
+			So(tokens, ShouldHaveLength, 2)
+			So(tokens[0].Name, ShouldEqual, "Backup script")
+			So(tokens[0].ExpiresAt, ShouldBeNil)
+			So(tokens[0].Scopes, ShouldBeEmpty)
+		})
+
+		Convey("Token names should be unique per user", func() {
+			So(r.Create(&models.APIToken{UserID: user.ID, Name: "Panel", TokenHash: "a", CreatedAt: now}), ShouldBeNil)
+			So(r.Create(&models.APIToken{UserID: user.ID, Name: "Panel", TokenHash: "b", CreatedAt: now}), ShouldEqual, repo.ErrDuplicate)
+			So(r.Create(&models.APIToken{UserID: "other", Name: "Panel", TokenHash: "c", CreatedAt: now}), ShouldBeNil)
+		})
+
+		Convey("Invalid scopes should be rejected", func() {
+			token := models.APIToken{UserID: user.ID, Name: "Bad", TokenHash: "a", Scopes: models.Permissions{"lights.explode"}}
+			So(r.Create(&token), ShouldEqual, repo.ErrInvalidPermission)
+		})
+
+		Convey("Using a token should update its last-used time", func() {
+			token := models.APIToken{UserID: user.ID, Name: "Panel", TokenHash: "a", CreatedAt: now}
+			So(r.Create(&token), ShouldBeNil)
+			So(r.Touch(token.ID, now.Add(time.Hour)), ShouldBeNil)
+			stored, err := r.GetByID(token.ID)
+			So(err, ShouldBeNil)
+			So(stored.LastUsed, ShouldNotBeNil)
+			So(stored.LastUsed.Equal(now.Add(time.Hour)), ShouldBeTrue)
+			So(r.Touch("unknown", now), ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Convey("Deleting tokens or their users should revoke them", func() {
+			token := models.APIToken{UserID: user.ID, Name: "Panel", TokenHash: "a", CreatedAt: now}
+			So(r.Create(&token), ShouldBeNil)
+			So(r.Delete(token.ID), ShouldBeNil)
+			_, err := r.GetByID(token.ID)
+			So(err, ShouldEqual, repo.ErrNotExisting)
+
+			So(r.Create(&token), ShouldBeNil)
+			So(users.Delete(user.ID), ShouldBeNil)
+			_, err = r.GetByID(token.ID)
+			So(err, ShouldEqual, repo.ErrNotExisting)
+		})
+
+		Reset(func() {
+			repotest.TeardownDB(db, logger)
+		})
+	})
+}
@@ -30,6 +30,21 @@ const (
 							Users
 						WHERE
 							name = ?`
+	findQuery = `SELECT
+					userid, name, passwordHash, fullName, createdAt, updatedAt
+				FROM
+					Users
+				WHERE
+					name LIKE ? ESCAPE '\' OR fullName LIKE ? ESCAPE '\'
+				ORDER BY
+					%s
+				LIMIT ? OFFSET ?`
+	countQuery = `SELECT
+					COUNT(*) AS count
+				FROM
+					Users
+				WHERE
+					name LIKE ? ESCAPE '\' OR fullName LIKE ? ESCAPE '\'`
 	updateQuery = `UPDATE
 						Users
 					SET
@@ -41,6 +56,14 @@ const (
 						userid = ?`
 )
 
+// The fields the search results can be sorted by - mapped to their database columns
+var sortColumns = map[string]string{
+	"name":      "name",
+	"fullName":  "fullName COLLATE NOCASE",
+	"createdAt": "createdAt",
+	"updatedAt": "updatedAt",
+}
+
 // UserRepo provides a simple in-memory user storage
 type UserRepo struct {
 	db *sqlx.DB
@@ -96,7 +119,7 @@ func (r *UserRepo) Update(u *models.User) error {
 // Delete removes an existing user from the user storage
 func (r *UserRepo) Delete(id models.UserID) error {
 	if _, err := r.db.Exec(deleteQuery, string(id)); err != nil {
-		return errors.Wrapf(err, "Failed to delete user with ID #%d", id)
+		return errors.Wrapf(err, "Failed to delete user with ID '%s'", id)
 	}
 	return nil
 }
@@ -119,6 +142,15 @@ func (r *UserRepo) GetByID(id models.UserID) (*models.User, error) {
 	return &user, nil
 }
 
+// GetByName returns the user with the given (case-insensitive) user name
+func (r *UserRepo) GetByName(name string) (*models.User, error) {
+	var user models.User
+	if err := r.db.Get(&user, getByNameQuery, strings.ToLower(name)); err != nil {
+		return nil, handleSqliteError(err, "Failed to retrieve user from database")
+	}
+	return &user, nil
+}
+
 // GetByCredentials returns the user which has the given username and password - this is used for login
 func (r *UserRepo) GetByCredentials(username string, password string) (*models.User, error) {
 	var user models.User
@@ -131,7 +163,56 @@ func (r *UserRepo) GetByCredentials(username string, password string) (*models.U
 	return &user, nil
 }
 
-// Find searches for users matching the given search string - supports pagination
-func (r *UserRepo) Find(search string, offset uint, limit uint) ([]*models.User, error) {
-	return nil, fmt.Errorf("Not implemented")
+// likePattern creates a LIKE pattern matching all values containing the search string
+func likePattern(search string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(search) + "%"
+}
+
+// orderBy creates the ORDER BY clause for the given sort orders - the user ID is always added to get a stable order
+func orderBy(sort []repo.SortOrder) (string, error) {
+	if len(sort) == 0 {
+		sort = []repo.SortOrder{{Field: "name"}}
+	}
+	var parts []string
+	for _, o := range sort {
+		col, ok := sortColumns[o.Field]
+		if !ok {
+			return "", repo.ErrInvalidSortField
+		}
+		if o.Descending {
+			col += " DESC"
+		}
+		parts = append(parts, col)
+	}
+	return strings.Join(append(parts, "userid"), ", "), nil
+}
+
+// Find searches for users whose name or full name contains the given search string - supports pagination
+func (r *UserRepo) Find(search string, offset uint, limit uint, sort ...repo.SortOrder) ([]*models.User, error) {
+	order, err := orderBy(sort)
+	if err != nil {
+		return nil, err
+	}
+	// A negative limit removes the upper bound in SQLite
+	sqlLimit := int64(limit)
+	if limit == 0 {
+		sqlLimit = -1
+	}
+	pattern := likePattern(search)
+	users := []*models.User{}
+	if err := r.db.Select(&users, fmt.Sprintf(findQuery, order), pattern, pattern, sqlLimit, offset); err != nil {
+		return nil, handleSqliteError(err, "Failed to search for users")
+	}
+	return users, nil
+}
+
+// Count returns the total number of users matching the given search string
+func (r *UserRepo) Count(search string) (uint, error) {
+	var num uint
+	pattern := likePattern(search)
+	if err := r.db.Get(&num, countQuery, pattern, pattern); err != nil {
+		return 0, handleSqliteError(err, "Failed to count users")
+	}
+	return num, nil
 }
@@ -307,6 +307,44 @@ func TestGetByID(t *testing.T) {
 	})
 }
 
+func TestGetByName(t *testing.T) {
+	Convey("Having a test database instance", t, func() {
+		logger := createTestLogger(t)
+		db, err := setupTestDB(logger)
+		So(err, ShouldBeNil)
+
+		Convey("Having a UserRepo instance", func() {
+			r := sqlite.New(db)
+			So(r, ShouldNotBeNil)
+
+			Convey("Having users in the database", func() {
+				So(createTestUsers(r), ShouldBeNil)
+
+				Convey("Searching for existing user names should find the users regardless of case", func() {
+					for _, user := range testUsers {
+						result, err := r.GetByName(strings.ToUpper(user.Name))
+						So(err, ShouldBeNil)
+						compareUsers(user, *result, testPassword)
+					}
+				})
+
+				Convey("Searching for non-existing user names should yield an ErrNotExisting error", func() {
+					result, err := r.GetByName("nothere")
+					So(err, ShouldEqual, repo.ErrNotExisting)
+					So(result, ShouldBeNil)
+				})
+			})
+		})
+
+		Reset(func() {
+			if err := teardownTestDB(db, logger); err != nil {
+				panic(err)
+			}
+		})
+
+	})
+}
+
 func TestGetByCredentials(t *testing.T) {
 	Convey("Having a test database instance", t, func() {
 		logger := createTestLogger(t)
@@ -355,8 +393,99 @@ func TestGetByCredentials(t *testing.T) {
 	})
 }
 
+func userNames(users []*models.User) []string {
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
 func TestFind(t *testing.T) {
-	t.Skip("Not implemented")
+	Convey("Having a test database instance", t, func() {
+		logger := createTestLogger(t)
+		db, err := setupTestDB(logger)
+		So(err, ShouldBeNil)
+
+		Convey("Having a UserRepo instance", func() {
+			r := sqlite.New(db)
+			So(r, ShouldNotBeNil)
+
+			Convey("Having users in the database", func() {
+				So(createTestUsers(r), ShouldBeNil)
+
+				Convey("Searching with an empty string should return all users ordered by name", func() {
+					result, err := r.Find("", 0, 0)
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{
+						"amy", "badwolf", "boe", "clara", "doctor", "donna", "k9", "knightmare", "rory", "tardis",
+					})
+					count, err := r.Count("")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, len(testUsers))
+				})
+
+				Convey("Searching should match name and full name case-insensitively", func() {
+					result, err := r.Find("O", 0, 0)
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{
+						"amy", "badwolf", "boe", "clara", "doctor", "donna", "rory", "tardis",
+					})
+					result, err = r.Find("smith", 0, 0)
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{"doctor"})
+					count, err := r.Count("SMITH")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 1)
+				})
+
+				Convey("LIKE wildcards in the search string should be matched literally", func() {
+					result, err := r.Find("%", 0, 0)
+					So(err, ShouldBeNil)
+					So(result, ShouldBeEmpty)
+					count, err := r.Count("_")
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 0)
+				})
+
+				Convey("Results should be paginated", func() {
+					result, err := r.Find("", 0, 3)
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{"amy", "badwolf", "boe"})
+					result, err = r.Find("", 3, 3)
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{"clara", "doctor", "donna"})
+					result, err = r.Find("", 9, 3)
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{"tardis"})
+					result, err = r.Find("", 20, 3)
+					So(err, ShouldBeNil)
+					So(result, ShouldBeEmpty)
+				})
+
+				Convey("Results should be sortable", func() {
+					result, err := r.Find("", 0, 3, repo.SortOrder{Field: "fullName"})
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{"amy", "knightmare", "clara"})
+					result, err = r.Find("", 0, 2, repo.SortOrder{Field: "name", Descending: true})
+					So(err, ShouldBeNil)
+					So(userNames(result), ShouldResemble, []string{"tardis", "rory"})
+				})
+
+				Convey("Sorting by unknown fields should fail", func() {
+					result, err := r.Find("", 0, 0, repo.SortOrder{Field: "passwordHash"})
+					So(err, ShouldEqual, repo.ErrInvalidSortField)
+					So(result, ShouldBeNil)
+				})
+			})
+		})
+
+		Reset(func() {
+			if err := teardownTestDB(db, logger); err != nil {
+				panic(err)
+			}
+		})
+	})
 }
 
 func TestExists(t *testing.T) {
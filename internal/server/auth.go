@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	authRealm = "MiCasa"
+	// sessionCookie is the name of the cookie carrying the session token
+	sessionCookie = "micasa_session"
+	// sessionTouchInterval defines how often the last-seen time of a session or API token is written to the database
+	sessionTouchInterval = time.Minute
+	// bearerPrefix introduces an API token inside the Authorization header
+	bearerPrefix = "Bearer "
+)
+
+type contextKey int
+
+const (
+	ctxKeyIdentity contextKey = iota
+	ctxKeyPermissions
+)
+
+var (
+	// ErrUnauthorized is returned when a request needs authentication but carries no valid credentials
+	ErrUnauthorized = NewStatusError(http.StatusUnauthorized, "Authentication required")
+	// ErrForbidden is returned when the authenticated user lacks the permission needed for the request
+	ErrForbidden = NewStatusError(http.StatusForbidden, "Permission denied")
+)
+
+// identity describes who has sent a request and how he/she has been authenticated
+type identity struct {
+	user *models.User
+	// The login session used by the request - nil if the request has not been authenticated by the session cookie
+	session *models.Session
+	// The API token used by the request - nil if the request has not been authenticated by an API token
+	token *models.APIToken
+	// Set if the client has not sent credentials, but is on the whitelist
+	whitelisted bool
+}
+
+// identityFromContext returns the identity authenticated for the current request - or an empty one if there is none
+func identityFromContext(ctx context.Context) *identity {
+	if id, ok := ctx.Value(ctxKeyIdentity).(*identity); ok {
+		return id
+	}
+	return &identity{}
+}
+
+// userFromContext returns the user authenticated for the current request - or nil if there is none
+func userFromContext(ctx context.Context) *models.User {
+	return identityFromContext(ctx).user
+}
+
+// sessionFromContext returns the login session used by the current request - or nil if the request has been
+// authenticated otherwise
+func sessionFromContext(ctx context.Context) *models.Session {
+	return identityFromContext(ctx).session
+}
+
+// tokenFromContext returns the API token used by the current request - or nil if the request has been authenticated
+// otherwise
+func tokenFromContext(ctx context.Context) *models.APIToken {
+	return identityFromContext(ctx).token
+}
+
+// permissionsFromContext returns the permissions granted to the current request
+func permissionsFromContext(ctx context.Context) models.PermissionChecker {
+	if p, ok := ctx.Value(ctxKeyPermissions).(models.PermissionChecker); ok {
+		return p
+	}
+	return models.Permissions{}
+}
+
+// allowed checks if the user of the current request has the given permission for the given target
+func allowed(r *http.Request, perm models.Permission, target string) bool {
+	return permissionsFromContext(r.Context()).Allows(perm, target)
+}
+
+// authenticate identifies the user sending the request by an API token, the session cookie or by HTTP Basic
+// authentication - in this order. Whitelisted clients sending no credentials at all are identified as the user
+// configured for them. It returns ErrUnauthorized if the request carries no valid credentials.
+func (s *Server) authenticate(r *http.Request) (*identity, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearerPrefix) && s.deps.Tokens != nil {
+		return s.authenticateToken(strings.TrimSpace(strings.TrimPrefix(auth, bearerPrefix)))
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil && s.deps.Sessions != nil {
+		return s.authenticateSession(r, cookie.Value)
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return s.authenticateWhitelisted(r)
+	}
+	user, err := s.deps.Users.GetByCredentials(name, password)
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			s.logger.Info("Login failed", log.FldUser, name, log.FldRemote, s.clientIP(r))
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	return &identity{user: user}, nil
+}
+
+// userByID loads the user owning a session or token - a missing user results in ErrUnauthorized
+func (s *Server) userByID(id models.UserID) (*models.User, error) {
+	user, err := s.deps.Users.GetByID(id)
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// authenticateSession identifies the user by the given session token and keeps track of the session's usage
+func (s *Server) authenticateSession(r *http.Request, token string) (*identity, error) {
+	sess, err := s.deps.Sessions.GetByTokenHash(models.HashSessionToken(token))
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if sess.Expired(now) {
+		if err := s.deps.Sessions.Delete(sess.ID); err != nil {
+			s.logger.Error("Failed to delete expired session", err, log.FldSession, sess.ID)
+		}
+		return nil, ErrUnauthorized
+	}
+	user, err := s.userByID(sess.UserID)
+	if err != nil {
+		return nil, err
+	}
+	ip, agent := s.clientIP(r), r.UserAgent()
+	if now.Sub(sess.LastSeen) >= sessionTouchInterval || sess.IP != ip || sess.UserAgent != agent {
+		sess.LastSeen = now
+		sess.ExpiresAt = now.Add(s.sessionLifetime())
+		sess.IP = ip
+		sess.UserAgent = agent
+		if err := s.deps.Sessions.Touch(sess); err != nil {
+			// Not being able to track the usage is no reason to reject the request
+			s.logger.Error("Failed to update session", err, log.FldSession, sess.ID)
+		}
+	}
+	return &identity{user: user, session: sess}, nil
+}
+
+// authenticateToken identifies the user by the given API token and keeps track of the token's usage
+func (s *Server) authenticateToken(secret string) (*identity, error) {
+	token, err := s.deps.Tokens.GetByTokenHash(models.HashAPIToken(secret))
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if token.Expired(now) {
+		return nil, ErrUnauthorized
+	}
+	user, err := s.userByID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) >= sessionTouchInterval {
+		token.LastUsed = &now
+		if err := s.deps.Tokens.Touch(token.ID, now); err != nil {
+			// Not being able to track the usage is no reason to reject the request
+			s.logger.Error("Failed to update API token", err, log.FldUser, user.Name)
+		}
+	}
+	return &identity{user: user, token: token}, nil
+}
+
+// requireUser is a middleware that rejects all requests not carrying valid credentials
+func (s *Server) requireUser(next http.Handler) http.Handler {
+	return s.handle(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := s.authenticate(r)
+		if err != nil {
+			if err == ErrUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`"`)
+			}
+			return err
+		}
+		roles, err := s.deps.Roles.GetByUser(id.user.ID)
+		if err != nil {
+			return err
+		}
+		// Requests using an API token cannot do more than the token's scopes allow
+		var perms models.PermissionChecker = models.PermissionsOf(roles)
+		if id.token != nil {
+			perms = models.PermissionsOf(roles).Restrict(id.token.Scopes)
+		}
+		ctx := context.WithValue(r.Context(), ctxKeyIdentity, id)
+		ctx = context.WithValue(ctx, ctxKeyPermissions, perms)
+		next.ServeHTTP(w, r.WithContext(ctx))
+		return nil
+	})
+}
+
+// requirePermission creates a middleware that rejects all requests of users lacking the given permission. Users
+// having the permission for some targets only are let through - the handler has to check the target itself.
+// The middleware has to be used behind requireUser.
+func (s *Server) requirePermission(perm models.Permission) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return s.handle(func(w http.ResponseWriter, r *http.Request) error {
+			if !permissionsFromContext(r.Context()).Has(perm) {
+				return ErrForbidden
+			}
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+// requireCredentials is a middleware that rejects all requests authenticated by an API token or by the whitelist. It
+// protects the management of credentials, so a token restricted by its scopes cannot create a less restricted one and
+// whitelisted clients cannot create credentials usable from everywhere.
+// The middleware has to be used behind requireUser.
+func (s *Server) requireCredentials(next http.Handler) http.Handler {
+	return s.handle(func(w http.ResponseWriter, r *http.Request) error {
+		id := identityFromContext(r.Context())
+		if id.token != nil {
+			return NewStatusError(http.StatusForbidden, "Not allowed for API tokens")
+		}
+		if id.whitelisted {
+			return NewStatusError(http.StatusForbidden, "Not allowed without logging in")
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// currentVersion is the version ID of the configuration file in use
+const currentVersion = "current"
+
+// ConfigHistory gives access to the current and the previous versions of the configuration file
+type ConfigHistory interface {
+	// Versions returns all versions of the configuration file - the newest first
+	Versions() ([]models.ConfigVersion, error)
+	// Diff returns the settings which differ between two versions
+	Diff(from string, to string) ([]models.ConfigChange, error)
+	// Rollback replaces the configuration file by a previous version and applies it
+	Rollback(version string) error
+}
+
+// ConfigVersionListResponse is the response of GET /api/config/versions
+type ConfigVersionListResponse struct {
+	// The versions - the current one first, followed by the previous ones ordered from new to old
+	Versions []models.ConfigVersion `json:"versions"`
+	// The number of versions returned
+	Total int `json:"total"`
+}
+
+// ConfigDiffResponse lists the settings which differ between two versions of the configuration file
+type ConfigDiffResponse struct {
+	// The version compared
+	From string `json:"from"`
+	// The version compared to
+	To string `json:"to"`
+	// The settings which differ - secret values are masked
+	Changes []models.ConfigChange `json:"changes"`
+}
+
+// RollbackRequest is the request body of POST /api/config/rollback
+type RollbackRequest struct {
+	// The ID of the version to restore
+	Version string `json:"version"`
+}
+
+// registerConfigRoutes registers the endpoints for managing the configuration at the given router
+func (s *Server) registerConfigRoutes(r *mux.Router) {
+	if s.deps.Config == nil {
+		return
+	}
+	manage := func(h apiHandler) http.Handler {
+		return s.requirePermission(models.PermConfigManage)(s.handle(h))
+	}
+	r.Handle("/config/versions", manage(s.listConfigVersions)).Methods(http.MethodGet)
+	r.Handle("/config/diff", manage(s.diffConfig)).Methods(http.MethodGet)
+	r.Handle("/config/rollback", manage(s.rollbackConfig)).Methods(http.MethodPost)
+}
+
+// listConfigVersions returns the versions of the configuration file
+func (s *Server) listConfigVersions(w http.ResponseWriter, r *http.Request) error {
+	versions, err := s.deps.Config.Versions()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, ConfigVersionListResponse{Versions: versions, Total: len(versions)})
+}
+
+// diffConfig compares the versions given by the query parameters `from` and `to` - `to` defaults to the current
+// version
+func (s *Server) diffConfig(w http.ResponseWriter, r *http.Request) error {
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		return NewStatusError(http.StatusBadRequest, "The version to compare is missing")
+	}
+	if to == "" {
+		to = currentVersion
+	}
+	changes, err := s.deps.Config.Diff(from, to)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, ConfigDiffResponse{From: from, To: to, Changes: changes})
+}
+
+// rollbackConfig restores a previous version of the configuration file - the response lists the settings changed
+func (s *Server) rollbackConfig(w http.ResponseWriter, r *http.Request) error {
+	var req RollbackRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Version == "" || req.Version == currentVersion {
+		return NewStatusError(http.StatusBadRequest, "The version to roll back to is missing")
+	}
+	changes, err := s.deps.Config.Diff(currentVersion, req.Version)
+	if err != nil {
+		return err
+	}
+	if err := s.deps.Config.Rollback(req.Version); err != nil {
+		return err
+	}
+	s.logger.Info(
+		fmt.Sprintf("Configuration has been rolled back to version '%s'", req.Version),
+		log.FldUser, userFromContext(r.Context()).Name,
+	)
+	return writeJSON(w, http.StatusOK, ConfigDiffResponse{From: currentVersion, To: req.Version, Changes: changes})
+}
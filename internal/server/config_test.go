@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeConfigHistory knows the current and a single previous version
+type fakeConfigHistory struct {
+	rolledBack []string
+}
+
+func (h *fakeConfigHistory) Versions() ([]models.ConfigVersion, error) {
+	return []models.ConfigVersion{
+		{ID: currentVersion, ModifiedAt: time.Now(), Size: 42, Current: true},
+		{ID: "20261017-020304.567", ModifiedAt: time.Now().Add(-time.Hour), Size: 40},
+	}, nil
+}
+
+func (h *fakeConfigHistory) check(version string) error {
+	if version != currentVersion && version != "20261017-020304.567" {
+		return errors.Wrapf(repo.ErrNotExisting, "Unknown version '%s'", version)
+	}
+	return nil
+}
+
+func (h *fakeConfigHistory) Diff(from string, to string) ([]models.ConfigChange, error) {
+	if err := h.check(from); err != nil {
+		return nil, err
+	}
+	if err := h.check(to); err != nil {
+		return nil, err
+	}
+	if from == to {
+		return []models.ConfigChange{}, nil
+	}
+	return []models.ConfigChange{{Path: "listenAddress", Old: ":3000", New: ":4000"}}, nil
+}
+
+func (h *fakeConfigHistory) Rollback(version string) error {
+	if err := h.check(version); err != nil {
+		return err
+	}
+	h.rolledBack = append(h.rolledBack, version)
+	return nil
+}
+
+func TestConfigEndpoints(t *testing.T) {
+	Convey("Having a server managing the configuration", t, func() {
+		history := &fakeConfigHistory{}
+		roles := newFakeRoleRepo()
+		s := New("", Dependencies{
+			Users:  newFakeUserRepo(),
+			Roles:  roles,
+			Config: history,
+		}, createTestLogger())
+
+		request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			if body != nil {
+				json.NewEncoder(&buf).Encode(body)
+			}
+			req := httptest.NewRequest(method, path, &buf)
+			req.SetBasicAuth(testUser, testPassword)
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("the versions should be listed", func() {
+			rec := request(http.MethodGet, "/api/config/versions", nil)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res ConfigVersionListResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Total, ShouldEqual, 2)
+			So(res.Versions[0].Current, ShouldBeTrue)
+		})
+
+		Convey("a previous version should be compared to the current one", func() {
+			rec := request(http.MethodGet, "/api/config/diff?from=20261017-020304.567", nil)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res ConfigDiffResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.To, ShouldEqual, currentVersion)
+			So(res.Changes, ShouldHaveLength, 1)
+
+			So(request(http.MethodGet, "/api/config/diff", nil).Code, ShouldEqual, http.StatusBadRequest)
+			So(request(http.MethodGet, "/api/config/diff?from=unknown", nil).Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("rolling back should restore the version given", func() {
+			rec := request(http.MethodPost, "/api/config/rollback", RollbackRequest{Version: "20261017-020304.567"})
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res ConfigDiffResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Changes, ShouldHaveLength, 1)
+			So(history.rolledBack, ShouldResemble, []string{"20261017-020304.567"})
+		})
+
+		Convey("invalid rollbacks should be rejected", func() {
+			rec := request(http.MethodPost, "/api/config/rollback", RollbackRequest{})
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			rec = request(http.MethodPost, "/api/config/rollback", RollbackRequest{Version: "unknown"})
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			So(history.rolledBack, ShouldBeEmpty)
+		})
+
+		Convey("users without permission should be rejected", func() {
+			roles.permissions = models.Permissions{models.PermDevicesView}
+			So(request(http.MethodGet, "/api/config/versions", nil).Code, ShouldEqual, http.StatusForbidden)
+			rec := request(http.MethodPost, "/api/config/rollback", RollbackRequest{Version: "20261017-020304.567"})
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+			So(history.rolledBack, ShouldBeEmpty)
+		})
+	})
+}
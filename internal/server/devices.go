@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/fhem"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const commandTimeout = 30 * time.Second
+
+// setSpecialChars may not appear in set commands and their arguments - FHEM separates commands by `;` and runs
+// `{...}` as Perl code, so they would allow running arbitrary commands
+const setSpecialChars = " \t\r\n;{}"
+
+// Commander sends commands to FHEM devices
+type Commander interface {
+	// Set executes a `set` command on the given device specification
+	Set(ctx context.Context, devspec string, args ...string) error
+}
+
+// DeviceResponse is the JSON representation of a FHEM device
+type DeviceResponse struct {
+	// The unique name of the device
+	Name string `json:"name"`
+	// The display name of the device (the `alias` attribute) - empty if not set
+	Alias string `json:"alias,omitempty"`
+	// The FHEM module implementing the device
+	Type string `json:"type"`
+	// The rooms the device is assigned to
+	Rooms []string `json:"rooms"`
+	// The value of the device's `state` reading
+	State string `json:"state"`
+	// The commands accepted by POST /api/devices/{name}/set
+	PossibleSets []string `json:"possibleSets"`
+	// The current readings of the device
+	Readings map[string]ReadingResponse `json:"readings"`
+	// The attributes of the device - only returned when requesting a single device
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// The internal values of the device - only returned when requesting a single device
+	Internals map[string]string `json:"internals,omitempty"`
+}
+
+// ReadingResponse is the JSON representation of a single reading
+type ReadingResponse struct {
+	// The current value of the reading
+	Value string `json:"value"`
+	// The time of the last update of the reading
+	Time time.Time `json:"time"`
+}
+
+// DeviceListResponse is the response of GET /api/devices
+type DeviceListResponse struct {
+	// The devices matching the filter
+	Devices []DeviceResponse `json:"devices"`
+	// The number of devices returned
+	Total int `json:"total"`
+}
+
+// SetRequest is the request body of POST /api/devices/{name}/set
+type SetRequest struct {
+	// The command to send - e.g. "on" or "desired-temp"
+	Command string `json:"command"`
+	// Optional arguments of the command - e.g. ["21.5"]
+	Args []string `json:"args,omitempty"`
+}
+
+// newDeviceResponse converts the device model into its JSON representation
+func newDeviceResponse(d *models.Device, details bool) DeviceResponse {
+	res := DeviceResponse{
+		Name:         d.Name,
+		Alias:        d.Attributes["alias"],
+		Type:         d.Type,
+		Rooms:        d.Rooms(),
+		State:        d.Readings["state"].Value,
+		PossibleSets: d.PossibleSets,
+		Readings:     make(map[string]ReadingResponse, len(d.Readings)),
+	}
+	if res.Rooms == nil {
+		res.Rooms = []string{}
+	}
+	if res.PossibleSets == nil {
+		res.PossibleSets = []string{}
+	}
+	for k, v := range d.Readings {
+		res.Readings[k] = ReadingResponse{Value: v.Value, Time: v.Time}
+	}
+	if details {
+		res.Attributes = d.Attributes
+		res.Internals = d.Internals
+	}
+	return res
+}
+
+// registerDeviceRoutes registers the device endpoints at the given router
+func (s *Server) registerDeviceRoutes(r *mux.Router) {
+	view := s.requirePermission(models.PermDevicesView)
+	control := s.requirePermission(models.PermDevicesControl)
+	r.Handle("/devices", view(s.handle(s.listDevices))).Methods(http.MethodGet)
+	r.Handle("/devices/{name}", view(s.handle(s.getDevice))).Methods(http.MethodGet)
+	r.Handle("/devices/{name}/set", control(s.handle(s.setDevice))).Methods(http.MethodPost)
+}
+
+// listDevices returns all devices - optionally filtered by the query parameters `type`, `room` and `reading`
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	devType, room, reading := query.Get("type"), query.Get("room"), query.Get("reading")
+	var devices []*models.Device
+	var err error
+	switch {
+	case room != "":
+		devices, err = s.deps.Devices.FindByRoom(room)
+	case devType != "":
+		devices, err = s.deps.Devices.FindByType(devType)
+	case reading != "":
+		devices, err = s.deps.Devices.FindByReading(reading)
+	default:
+		devices, err = s.deps.Devices.GetAll()
+	}
+	if err != nil {
+		return err
+	}
+	res := DeviceListResponse{Devices: []DeviceResponse{}}
+	for _, d := range devices {
+		if !allowed(r, models.PermDevicesView, d.Name) {
+			continue
+		}
+		if devType != "" && d.Type != devType {
+			continue
+		}
+		if _, ok := d.Readings[reading]; reading != "" && !ok {
+			continue
+		}
+		res.Devices = append(res.Devices, newDeviceResponse(d, false))
+	}
+	res.Total = len(res.Devices)
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// getDevice returns a single device including its attributes and internals
+func (s *Server) getDevice(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+	if !allowed(r, models.PermDevicesView, name) {
+		return ErrForbidden
+	}
+	dev, err := s.deps.Devices.GetByName(name)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, newDeviceResponse(dev, true))
+}
+
+// setDevice sends a `set` command to the device
+func (s *Server) setDevice(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+	if !allowed(r, models.PermDevicesControl, name) {
+		return ErrForbidden
+	}
+	dev, err := s.deps.Devices.GetByName(name)
+	if err != nil {
+		return err
+	}
+	var req SetRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Command == "" || strings.ContainsAny(req.Command, setSpecialChars) {
+		return NewStatusError(http.StatusBadRequest, "Invalid command")
+	}
+	for _, arg := range req.Args {
+		if strings.ContainsAny(arg, setSpecialChars) {
+			return NewStatusError(
+				http.StatusBadRequest,
+				"Command arguments must not contain whitespace, line breaks, ';', '{' or '}'",
+			)
+		}
+	}
+	if len(dev.PossibleSets) > 0 && !containsString(dev.PossibleSets, req.Command) {
+		return NewStatusError(http.StatusBadRequest, "Command not supported by the device")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+	defer cancel()
+	args := append([]string{req.Command}, req.Args...)
+	s.logger.Info(
+		"Sending command to device",
+		log.FldDevice, dev.Name,
+		log.FldCommand, strings.Join(args, " "),
+		log.FldUser, userFromContext(r.Context()).Name,
+	)
+	if err := s.deps.Commander.Set(ctx, dev.Name, args...); err != nil {
+		if e, ok := errors.Cause(err).(*fhem.CommandError); ok {
+			return NewStatusError(http.StatusBadRequest, e.Message)
+		}
+		s.logger.Error("Failed to send command to FHEM", err, log.FldDevice, dev.Name)
+		return NewStatusError(http.StatusBadGateway, "FHEM is not reachable")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
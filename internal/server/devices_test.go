@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/derWhity/micasa/internal/fhem"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testUser     = "amy"
+	testPassword = "fishcustard"
+)
+
+// fakeUserRepo knows a single user
+type fakeUserRepo struct {
+	repo.UserRepo
+	user models.User
+}
+
+func newFakeUserRepo() *fakeUserRepo {
+	r := &fakeUserRepo{user: models.User{ID: "user-1", Name: testUser, FullName: "Amy Pond"}}
+	r.user.SetPassword(testPassword)
+	return r
+}
+
+func (r *fakeUserRepo) GetByCredentials(username string, password string) (*models.User, error) {
+	if username != r.user.Name || r.user.CheckPassword(password) != nil {
+		return nil, repo.ErrNotExisting
+	}
+	u := r.user
+	return &u, nil
+}
+
+func (r *fakeUserRepo) GetByID(id models.UserID) (*models.User, error) {
+	if id != r.user.ID {
+		return nil, repo.ErrNotExisting
+	}
+	u := r.user
+	return &u, nil
+}
+
+func (r *fakeUserRepo) GetByName(name string) (*models.User, error) {
+	if name != r.user.Name {
+		return nil, repo.ErrNotExisting
+	}
+	u := r.user
+	return &u, nil
+}
+
+func (r *fakeUserRepo) Exists(id models.UserID) (bool, error) {
+	return id == r.user.ID, nil
+}
+
+// fakeRoleRepo grants the same permissions to every user
+type fakeRoleRepo struct {
+	repo.RoleRepo
+	permissions models.Permissions
+}
+
+func newFakeRoleRepo(perms ...models.Permission) *fakeRoleRepo {
+	if len(perms) == 0 {
+		perms = []models.Permission{models.PermAll}
+	}
+	return &fakeRoleRepo{permissions: perms}
+}
+
+func (r *fakeRoleRepo) GetByUser(userID models.UserID) ([]*models.Role, error) {
+	return []*models.Role{{ID: "test", Name: "Test", Permissions: r.permissions}}, nil
+}
+
+// fakeDeviceRepo serves a fixed set of devices
+type fakeDeviceRepo struct {
+	repo.DeviceRepo
+	devices []*models.Device
+}
+
+func (r *fakeDeviceRepo) GetByName(name string) (*models.Device, error) {
+	for _, d := range r.devices {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return nil, repo.ErrNotExisting
+}
+
+func (r *fakeDeviceRepo) GetAll() ([]*models.Device, error) {
+	return r.devices, nil
+}
+
+func (r *fakeDeviceRepo) FindByRoom(room string) ([]*models.Device, error) {
+	var res []*models.Device
+	for _, d := range r.devices {
+		if d.InRoom(room) {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// fakeCommander records the commands sent
+type fakeCommander struct {
+	commands []string
+	err      error
+}
+
+func (c *fakeCommander) Set(ctx context.Context, devspec string, args ...string) error {
+	c.commands = append(c.commands, devspec+" "+strings.Join(args, " "))
+	return c.err
+}
+
+func newTestDevices() *fakeDeviceRepo {
+	return &fakeDeviceRepo{devices: []*models.Device{
+		{
+			Name:         "lamp",
+			Type:         "dummy",
+			PossibleSets: []string{"on", "off"},
+			Internals:    map[string]string{"NAME": "lamp"},
+			Readings:     map[string]models.Reading{"state": {Value: "on"}},
+			Attributes:   map[string]string{"room": "Living", "alias": "Floor lamp"},
+		},
+		{
+			Name:       "heater",
+			Type:       "CUL_HM",
+			Readings:   map[string]models.Reading{"state": {Value: "ok"}},
+			Attributes: map[string]string{"room": "Bath"},
+		},
+	}}
+}
+
+func TestDeviceEndpoints(t *testing.T) {
+	Convey("Having a server with devices", t, func() {
+		commander := &fakeCommander{}
+		roles := newFakeRoleRepo()
+		s := New("", Dependencies{
+			Users:     newFakeUserRepo(),
+			Roles:     roles,
+			Devices:   newTestDevices(),
+			Commander: commander,
+		}, createTestLogger())
+
+		request := func(method, path string, body interface{}, auth bool) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			if body != nil {
+				json.NewEncoder(&buf).Encode(body)
+			}
+			req := httptest.NewRequest(method, path, &buf)
+			if auth {
+				req.SetBasicAuth(testUser, testPassword)
+			}
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("Requests without valid credentials should be rejected", func() {
+			rec := request(http.MethodGet, "/api/devices", nil, false)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rec.Header().Get("WWW-Authenticate"), ShouldContainSubstring, "Basic")
+
+			req := httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+			req.SetBasicAuth(testUser, "wrong")
+			rec = httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Listing devices should return all devices", func() {
+			rec := request(http.MethodGet, "/api/devices", nil, true)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res DeviceListResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Total, ShouldEqual, 2)
+			So(res.Devices[0].Name, ShouldEqual, "lamp")
+			So(res.Devices[0].Alias, ShouldEqual, "Floor lamp")
+			So(res.Devices[0].State, ShouldEqual, "on")
+			So(res.Devices[0].Attributes, ShouldBeNil)
+		})
+
+		Convey("Listing devices should support filtering", func() {
+			rec := request(http.MethodGet, "/api/devices?room=bath", nil, true)
+			var res DeviceListResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Total, ShouldEqual, 1)
+			So(res.Devices[0].Name, ShouldEqual, "heater")
+		})
+
+		Convey("Single devices should be returned with details", func() {
+			rec := request(http.MethodGet, "/api/devices/lamp", nil, true)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res DeviceResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Attributes["room"], ShouldEqual, "Living")
+			So(res.Internals["NAME"], ShouldEqual, "lamp")
+
+			rec = request(http.MethodGet, "/api/devices/unknown", nil, true)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Set commands should be sent to FHEM", func() {
+			rec := request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "off"}, true)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			rec = request(http.MethodPost, "/api/devices/heater/set", SetRequest{Command: "desired-temp", Args: []string{"21.5"}}, true)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			So(commander.commands, ShouldResemble, []string{"lamp off", "heater desired-temp 21.5"})
+		})
+
+		Convey("Invalid set commands should be rejected", func() {
+			rec := request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "explode"}, true)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			rec = request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "on\nshutdown"}, true)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			rec = request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "on", Args: []string{"\nshutdown"}}, true)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			for _, arg := range []string{"; shutdown", ";shutdown", "{system('rm -rf /')}", "1 2", "x}"} {
+				req := SetRequest{Command: "desired-temp", Args: []string{arg}}
+				rec = request(http.MethodPost, "/api/devices/heater/set", req, true)
+				So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			}
+			So(commander.commands, ShouldBeEmpty)
+		})
+
+		Convey("Users without permission should be rejected", func() {
+			roles.permissions = models.Permissions{models.PermDevicesView}
+			rec := request(http.MethodGet, "/api/devices", nil, true)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			rec = request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "off"}, true)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+
+			roles.permissions = models.Permissions{}
+			rec = request(http.MethodGet, "/api/devices", nil, true)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+			So(commander.commands, ShouldBeEmpty)
+		})
+
+		Convey("Scoped permissions should only apply to matching devices", func() {
+			roles.permissions = models.Permissions{"devices.view", "devices.control:la*"}
+			rec := request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "off"}, true)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			rec = request(http.MethodPost, "/api/devices/heater/set", SetRequest{Command: "desired-temp", Args: []string{"30"}}, true)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+			So(commander.commands, ShouldResemble, []string{"lamp off"})
+
+			roles.permissions = models.Permissions{"devices.view:heater"}
+			rec = request(http.MethodGet, "/api/devices", nil, true)
+			var res DeviceListResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Total, ShouldEqual, 1)
+			So(res.Devices[0].Name, ShouldEqual, "heater")
+			rec = request(http.MethodGet, "/api/devices/lamp", nil, true)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("FHEM errors should be reported to the client", func() {
+			commander.err = &fhem.CommandError{Command: "set lamp on", Message: "Lamp is broken"}
+			rec := request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "on"}, true)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(rec).Error, ShouldEqual, "Lamp is broken")
+
+			commander.err = fhem.ErrClosed
+			rec = request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "on"}, true)
+			So(rec.Code, ShouldEqual, http.StatusBadGateway)
+		})
+	})
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// WSTypeLogEntry is the type of the messages of the log tail carrying a log entry
+const WSTypeLogEntry = "entry"
+
+// LogLevels gives access to the minimum levels of the log output while the server is running
+type LogLevels interface {
+	// Level returns the minimum level of the log
+	Level() int
+	// SetLevel changes the minimum level of the log
+	SetLevel(lvl int)
+	// ComponentLevels returns the levels set for components - by the name of the component
+	ComponentLevels() map[string]int
+	// SetComponentLevel changes the minimum level of a component - overriding the level of the log
+	SetComponentLevel(component string, lvl int)
+	// ResetComponentLevel makes a component follow the level of the log again
+	ResetComponentLevel(component string)
+}
+
+// LogBuffer keeps the recent log entries
+type LogBuffer interface {
+	// Entries returns the most recent entries matching the filter - from the oldest to the newest. At most limit
+	// entries are returned; 0 returns all of them.
+	Entries(filter log.EntryFilter, limit int) []log.Entry
+	// Subscribe registers a subscriber for the entries matching the filter which are logged from now on
+	Subscribe(filter log.EntryFilter, bufferSize int) *log.Subscription
+}
+
+// ComponentLogLevel is the minimum log level of a single component
+type ComponentLogLevel struct {
+	// The name of the component - e.g. "fhem"
+	Component string `json:"component"`
+	// The minimum level of the log entries of the component written
+	Level string `json:"level"`
+	// Whether the component follows the level of the log
+	Inherited bool `json:"inherited"`
+}
+
+// LogLevelsResponse is the response of the /api/log/levels endpoints
+type LogLevelsResponse struct {
+	// The minimum level of the log
+	Level string `json:"level"`
+	// The levels of all components
+	Components []ComponentLogLevel `json:"components"`
+}
+
+// LogEntriesResponse is the response of GET /api/log/entries
+type LogEntriesResponse struct {
+	// The entries - from the oldest to the newest
+	Entries []log.Entry `json:"entries"`
+	// The number of entries returned
+	Total int `json:"total"`
+}
+
+// LogTailMessage is a message sent to the clients of the log tail
+type LogTailMessage struct {
+	Type string `json:"type"`
+	// The log entry - for messages of type "entry"
+	Entry *log.Entry `json:"entry,omitempty"`
+	// The number of entries dropped - for messages of type "overflow"
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// LogLevelRequest is the request body for changing a log level
+type LogLevelRequest struct {
+	// The new level: "debug", "info", "warn", "error" or "crit"
+	Level string `json:"level"`
+}
+
+// registerLogRoutes registers the endpoints for reading the log and changing the log levels at the given router
+func (s *Server) registerLogRoutes(r *mux.Router) {
+	manage := func(h apiHandler) http.Handler {
+		return s.requirePermission(models.PermConfigManage)(s.handle(h))
+	}
+	if s.deps.LogLevels != nil {
+		r.Handle("/log/levels", manage(s.getLogLevels)).Methods(http.MethodGet)
+		r.Handle("/log/levels", manage(s.setLogLevel)).Methods(http.MethodPut)
+		r.Handle("/log/levels/{component}", manage(s.setComponentLogLevel)).Methods(http.MethodPut)
+		r.Handle("/log/levels/{component}", manage(s.resetComponentLogLevel)).Methods(http.MethodDelete)
+	}
+	if s.deps.LogBuffer != nil {
+		r.Handle("/log/entries", manage(s.listLogEntries)).Methods(http.MethodGet)
+		r.Handle("/log/tail", manage(s.tailLog)).Methods(http.MethodGet)
+	}
+}
+
+// logLevels returns the current levels of the log and of all components
+func (s *Server) logLevels() LogLevelsResponse {
+	lvl := s.deps.LogLevels.Level()
+	components := s.deps.LogLevels.ComponentLevels()
+	res := LogLevelsResponse{Level: log.LevelName(lvl), Components: []ComponentLogLevel{}}
+	for _, component := range log.Components {
+		c, ok := components[component]
+		if !ok {
+			c = lvl
+		}
+		res.Components = append(res.Components, ComponentLogLevel{
+			Component: component,
+			Level:     log.LevelName(c),
+			Inherited: !ok,
+		})
+	}
+	return res
+}
+
+// readLogLevel reads the level to set from the request body
+func readLogLevel(r *http.Request) (int, error) {
+	var req LogLevelRequest
+	if err := readJSON(r, &req); err != nil {
+		return 0, err
+	}
+	lvl, err := log.ParseLevel(req.Level)
+	if err != nil {
+		return 0, NewStatusError(http.StatusBadRequest, err.Error())
+	}
+	return lvl, nil
+}
+
+// logComponent returns the component given by the URL - unknown components are rejected
+func logComponent(r *http.Request) (string, error) {
+	component := mux.Vars(r)["component"]
+	for _, c := range log.Components {
+		if c == component {
+			return component, nil
+		}
+	}
+	return "", NewStatusError(http.StatusNotFound, fmt.Sprintf("Unknown log component '%s'", component))
+}
+
+// getLogLevels returns the levels of the log and of all components
+func (s *Server) getLogLevels(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, s.logLevels())
+}
+
+// setLogLevel changes the level of the log - components with own levels are not affected
+func (s *Server) setLogLevel(w http.ResponseWriter, r *http.Request) error {
+	lvl, err := readLogLevel(r)
+	if err != nil {
+		return err
+	}
+	s.deps.LogLevels.SetLevel(lvl)
+	s.logger.Info(
+		fmt.Sprintf("Log level has been changed to '%s'", log.LevelName(lvl)),
+		log.FldUser, userFromContext(r.Context()).Name,
+	)
+	return writeJSON(w, http.StatusOK, s.logLevels())
+}
+
+// setComponentLogLevel changes the level of a single component
+func (s *Server) setComponentLogLevel(w http.ResponseWriter, r *http.Request) error {
+	component, err := logComponent(r)
+	if err != nil {
+		return err
+	}
+	lvl, err := readLogLevel(r)
+	if err != nil {
+		return err
+	}
+	s.deps.LogLevels.SetComponentLevel(component, lvl)
+	s.logger.Info(
+		fmt.Sprintf("Log level of '%s' has been changed to '%s'", component, log.LevelName(lvl)),
+		log.FldUser, userFromContext(r.Context()).Name,
+	)
+	return writeJSON(w, http.StatusOK, s.logLevels())
+}
+
+// resetComponentLogLevel makes a component follow the level of the log again
+func (s *Server) resetComponentLogLevel(w http.ResponseWriter, r *http.Request) error {
+	component, err := logComponent(r)
+	if err != nil {
+		return err
+	}
+	s.deps.LogLevels.ResetComponentLevel(component)
+	s.logger.Info(
+		fmt.Sprintf("Log level of '%s' has been reset", component),
+		log.FldUser, userFromContext(r.Context()).Name,
+	)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// readEntryFilter reads the filter for log entries from the query parameters `level`, `component` and `user` - the
+// latter takes the name of the user, not the ID
+func readEntryFilter(r *http.Request) (log.EntryFilter, error) {
+	query := r.URL.Query()
+	filter := log.EntryFilter{Component: query.Get("component"), User: query.Get("user")}
+	if name := query.Get("level"); name != "" {
+		lvl, err := log.ParseLevel(name)
+		if err != nil {
+			return filter, NewStatusError(http.StatusBadRequest, err.Error())
+		}
+		filter.MinLevel = lvl
+	}
+	return filter, nil
+}
+
+// listLogEntries returns the recent log entries matching the query parameters `level`, `component` and `user` (the
+// user name) - `limit` restricts the number of entries returned
+func (s *Server) listLogEntries(w http.ResponseWriter, r *http.Request) error {
+	filter, err := readEntryFilter(r)
+	if err != nil {
+		return err
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return NewStatusError(http.StatusBadRequest, "The limit has to be a positive number")
+		}
+	}
+	entries := s.deps.LogBuffer.Entries(filter, limit)
+	return writeJSON(w, http.StatusOK, LogEntriesResponse{Entries: entries, Total: len(entries)})
+}
+
+// tailLog upgrades the connection to a WebSocket connection pushing the log entries matching the query parameters
+// `level`, `component` and `user` (the user name) to the client as soon as they are logged
+func (s *Server) tailLog(w http.ResponseWriter, r *http.Request) error {
+	filter, err := readEntryFilter(r)
+	if err != nil {
+		return err
+	}
+	// Subscribing first makes sure that the client receives every entry logged once the connection is established
+	sub := s.deps.LogBuffer.Subscribe(filter, wsBufferSize)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		sub.Unsubscribe()
+		// The upgrader has already sent an error response
+		return nil
+	}
+	logger := s.logger.With(log.FldUser, userFromContext(r.Context()).Name, log.FldRemote, s.clientIP(r))
+	logger.Info("Log tail client connected")
+	defer logger.Info("Log tail client disconnected")
+	// The client does not send anything - reading is needed for processing the pongs and noticing the client leaving
+	go func() {
+		defer sub.Unsubscribe()
+		conn.SetReadLimit(wsMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	defer conn.Close()
+	write := func(msg LogTailMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(msg)
+	}
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return nil
+			}
+			if dropped := sub.Dropped(); dropped > reported {
+				// Tell the client about the gap before continuing with the current entries
+				if err := write(LogTailMessage{Type: WSTypeOverflow, Dropped: dropped - reported}); err != nil {
+					return nil
+				}
+				reported = dropped
+			}
+			if err := write(LogTailMessage{Type: WSTypeLogEntry, Entry: &e}); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogEndpoints(t *testing.T) {
+	Convey("Having a server managing the log levels", t, func() {
+		out := log.NewOutput(kitlog.NewNopLogger(), log.LvlInfo)
+		out.SetComponentLevel(log.ComponentHTTP, log.LvlWarn)
+		roles := newFakeRoleRepo()
+		s := New("", Dependencies{
+			Users:     newFakeUserRepo(),
+			Roles:     roles,
+			LogLevels: out,
+		}, createTestLogger())
+
+		request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			if body != nil {
+				json.NewEncoder(&buf).Encode(body)
+			}
+			req := httptest.NewRequest(method, path, &buf)
+			req.SetBasicAuth(testUser, testPassword)
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+		levels := func(rec *httptest.ResponseRecorder) LogLevelsResponse {
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res LogLevelsResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			return res
+		}
+
+		Convey("the levels of all components should be listed", func() {
+			res := levels(request(http.MethodGet, "/api/log/levels", nil))
+			So(res.Level, ShouldEqual, "info")
+			So(res.Components, ShouldHaveLength, len(log.Components))
+			So(res.Components[0], ShouldResemble, ComponentLogLevel{Component: "fhem", Level: "info", Inherited: true})
+			So(res.Components[1], ShouldResemble, ComponentLogLevel{Component: "http", Level: "warn"})
+		})
+
+		Convey("the level of a component should be changed", func() {
+			res := levels(request(http.MethodPut, "/api/log/levels/fhem", LogLevelRequest{Level: "debug"}))
+			So(res.Components[0], ShouldResemble, ComponentLogLevel{Component: "fhem", Level: "debug"})
+			So(out.Enabled(log.ComponentFhem, log.LvlDebug), ShouldBeTrue)
+			So(out.Enabled("", log.LvlDebug), ShouldBeFalse)
+
+			rec := request(http.MethodDelete, "/api/log/levels/http", nil)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			So(out.ComponentLevels(), ShouldResemble, map[string]int{log.ComponentFhem: log.LvlDebug})
+		})
+
+		Convey("the level of the log should be changed", func() {
+			res := levels(request(http.MethodPut, "/api/log/levels", LogLevelRequest{Level: "error"}))
+			So(res.Level, ShouldEqual, "error")
+			So(res.Components[0].Level, ShouldEqual, "error")
+			So(res.Components[1].Level, ShouldEqual, "warn")
+			So(out.Level(), ShouldEqual, log.LvlError)
+		})
+
+		Convey("invalid changes should be rejected", func() {
+			rec := request(http.MethodPut, "/api/log/levels/fhem", LogLevelRequest{Level: "verbose"})
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			rec = request(http.MethodPut, "/api/log/levels/database", LogLevelRequest{Level: "debug"})
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			So(request(http.MethodDelete, "/api/log/levels/database", nil).Code, ShouldEqual, http.StatusNotFound)
+			So(out.Level(), ShouldEqual, log.LvlInfo)
+		})
+
+		Convey("users without permission should be rejected", func() {
+			roles.permissions = models.Permissions{models.PermDevicesView}
+			So(request(http.MethodGet, "/api/log/levels", nil).Code, ShouldEqual, http.StatusForbidden)
+			rec := request(http.MethodPut, "/api/log/levels/fhem", LogLevelRequest{Level: "debug"})
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+			So(out.ComponentLevels(), ShouldResemble, map[string]int{log.ComponentHTTP: log.LvlWarn})
+		})
+	})
+}
+
+func TestLogEntryEndpoints(t *testing.T) {
+	Convey("Having a server keeping the recent log entries", t, func() {
+		buf := log.NewBuffer(10)
+		logger := log.New(buf, log.LvlDebug)
+		fhem := logger.Named(log.ComponentFhem)
+		s := New("", Dependencies{
+			Users:     newFakeUserRepo(),
+			Roles:     newFakeRoleRepo(),
+			LogBuffer: buf,
+		}, createTestLogger())
+		logger.Info("Started")
+		fhem.Warn("Connection lost", log.FldUser, "amy")
+
+		entries := func(query string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/api/log/entries"+query, nil)
+			req.SetBasicAuth(testUser, testPassword)
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("the entries should be filtered", func() {
+			for _, query := range []string{"?level=warn", "?component=fhem", "?user=amy", "?limit=1"} {
+				rec := entries(query)
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				var res LogEntriesResponse
+				So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+				So(res.Total, ShouldEqual, 1)
+				So(res.Entries[0].Message, ShouldEqual, "Connection lost")
+			}
+			So(entries("?level=verbose").Code, ShouldEqual, http.StatusBadRequest)
+			So(entries("?limit=-1").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("the tail should push the matching entries logged afterwards", func() {
+			ts := httptest.NewServer(s.Router())
+			defer ts.Close()
+			header := http.Header{}
+			header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(testUser+":"+testPassword)))
+			url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/log/tail?component=fhem"
+			conn, _, err := websocket.DefaultDialer.Dial(url, header)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			logger.Info("Ignored")
+			fhem.Debug("Tailed")
+			var msg LogTailMessage
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			So(conn.ReadJSON(&msg), ShouldBeNil)
+			So(msg.Type, ShouldEqual, WSTypeLogEntry)
+			So(msg.Entry.Component, ShouldEqual, log.ComponentFhem)
+			So(msg.Entry.Message, ShouldEqual, "Tailed")
+		})
+	})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/pkg/errors"
+)
+
+// StatusError is an error that carries the HTTP status code which should be sent to the client
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+// Error returns the error message
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// NewStatusError creates a new error that will be reported to the client with the given status code
+func NewStatusError(code int, message string) error {
+	return &StatusError{Code: code, Message: message}
+}
+
+// ErrorResponse is the JSON document sent to the client when a request fails
+type ErrorResponse struct {
+	// The HTTP status code of the response
+	Status int `json:"status"`
+	// A human-readable description of the error
+	Error string `json:"error"`
+}
+
+// apiHandler is a HTTP handler function that may fail - the returned error is sent to the client as JSON document
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// ServeHTTP implements http.Handler
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// statusForError determines the HTTP status code and the client-facing message for the given error
+func statusForError(err error) (int, string) {
+	cause := errors.Cause(err)
+	switch cause {
+	case repo.ErrNotExisting:
+		return http.StatusNotFound, cause.Error()
+	case repo.ErrDuplicate:
+		return http.StatusConflict, cause.Error()
+	case repo.ErrInvalidPermission, repo.ErrInvalidSortField:
+		return http.StatusBadRequest, cause.Error()
+	}
+	if e, ok := cause.(*StatusError); ok {
+		return e.Code, e.Message
+	}
+	if e, ok := cause.(models.ValidationErrors); ok {
+		return http.StatusBadRequest, e.Error()
+	}
+	// Do not leak internal error details to the client
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+}
+
+// isServerError checks if the error results in a 5xx status code
+func isServerError(err error) bool {
+	status, _ := statusForError(err)
+	return status >= http.StatusInternalServerError
+}
+
+// writeError sends the given error to the client as JSON document
+func writeError(w http.ResponseWriter, err error) {
+	status, msg := statusForError(err)
+	writeJSON(w, status, ErrorResponse{Status: status, Error: msg})
+}
+
+// writeJSON sends the given data to the client as JSON document using the given status code
+func writeJSON(w http.ResponseWriter, status int, data interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(data)
+}
+
+// readJSON decodes the JSON request body into the given target
+func readJSON(r *http.Request, target interface{}) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		return NewStatusError(http.StatusBadRequest, "Malformed JSON request body")
+	}
+	return nil
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) error {
+	return NewStatusError(http.StatusNotFound, "No such endpoint")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) error {
+	return NewStatusError(http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// health reports that the server is up and running
+func health(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
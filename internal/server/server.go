@@ -0,0 +1,226 @@
+// Package server provides the HTTP API server of MiCasa
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	// APIPrefix is the path prefix all API endpoints are registered under
+	APIPrefix = "/api"
+
+	readTimeout  = 15 * time.Second
+	writeTimeout = 15 * time.Second
+	idleTimeout  = 60 * time.Second
+)
+
+// Dependencies are the repositories, services and settings used by the API handlers
+type Dependencies struct {
+	// Users is used for authenticating the API clients
+	Users repo.UserRepo
+	// Sessions stores the login sessions - logging in is not possible without it
+	Sessions repo.SessionRepo
+	// SessionConfig defines the lifetime and cookie settings of the login sessions
+	SessionConfig models.SessionConfig
+	// Tokens stores the personal API tokens - bearer authentication is not possible without it
+	Tokens repo.APITokenRepo
+	// Roles provides the permissions of the authenticated users
+	Roles repo.RoleRepo
+	// Devices provides the current state of the FHEM devices
+	Devices repo.DeviceRepo
+	// Commander sends commands to FHEM
+	Commander Commander
+	// Bus distributes the events received from FHEM
+	Bus *events.Bus
+	// Config provides the versions of the configuration file - the configuration cannot be managed without it
+	Config ConfigHistory
+	// Whitelist looks up the whitelisted clients and the trusted proxies - without it, there is no whitelist and
+	// clients are identified by their remote address
+	Whitelist Whitelist
+	// WhitelistConfig defines how whitelisted clients are treated
+	WhitelistConfig models.WhitelistConfig
+	// LogLevels allows changing the log levels at runtime - they cannot be changed without it
+	LogLevels LogLevels
+	// LogBuffer provides the recent log entries - the log cannot be read via the API without it
+	LogBuffer LogBuffer
+}
+
+// Server is the HTTP server serving the MiCasa API
+type Server struct {
+	router   *mux.Router
+	api      *mux.Router
+	srv      *http.Server
+	listener net.Listener
+	deps     Dependencies
+	logger   log.Logger
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Guards the settings which may be changed while the server is running
+	mu sync.RWMutex
+}
+
+// New creates a new HTTP server instance that will listen at the given address once started
+func New(addr string, deps Dependencies, logger log.Logger) *Server {
+	router := mux.NewRouter()
+	router.NotFoundHandler = apiHandler(notFound)
+	router.MethodNotAllowedHandler = apiHandler(methodNotAllowed)
+	s := &Server{
+		router: router,
+		api:    router.PathPrefix(APIPrefix).Subrouter(),
+		deps:   deps,
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+	s.api.Use(s.restrictClients)
+	// Public endpoints
+	s.api.Handle("/health", s.handle(health)).Methods(http.MethodGet)
+	s.registerLoginRoutes(s.api)
+	// Endpoints that need an authenticated user
+	protected := s.api.NewRoute().Subrouter()
+	protected.Use(s.requireUser)
+	s.registerSessionRoutes(protected)
+	s.registerTokenRoutes(protected)
+	s.registerDeviceRoutes(protected)
+	s.registerWebSocketRoutes(protected)
+	s.registerConfigRoutes(protected)
+	s.registerLogRoutes(protected)
+	s.srv = &http.Server{
+		Addr:         addr,
+		Handler:      s.logRequests(s.recoverPanics(router)),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+	return s
+}
+
+// Router returns the main router of the server for registering additional handlers
+func (s *Server) Router() *mux.Router {
+	return s.router
+}
+
+// APIRouter returns the router all API endpoints are registered at
+func (s *Server) APIRouter() *mux.Router {
+	return s.api
+}
+
+// Addr returns the address the server is listening at - this is the configured address as long as the server has
+// not been started
+func (s *Server) Addr() string {
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+	return s.srv.Addr
+}
+
+// Start opens the listening socket and starts serving requests in the background.
+// Errors occurring while binding to the address are returned directly.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "Start: Cannot listen at '%s'", s.srv.Addr)
+	}
+	s.listener = l
+	s.logger.Info("HTTP server is listening", log.FldAddress, s.Addr())
+	if s.deps.Sessions != nil {
+		go s.cleanupSessions()
+	}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("HTTP server has stopped unexpectedly", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the server, waiting for active requests to finish until the given context expires. It may
+// be called more than once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Info("Shutting down HTTP server...")
+	s.stopOnce.Do(func() { close(s.stop) })
+	if err := s.srv.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "Shutdown: Failed to stop the HTTP server gracefully")
+	}
+	s.logger.Info("HTTP server stopped")
+	return nil
+}
+
+// handle turns the given API handler into a http.Handler that logs internal errors before reporting them to the client
+func (s *Server) handle(h apiHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err == nil {
+			return
+		}
+		// Status errors are intended for the client - everything else is unexpected and worth logging
+		if _, ok := errors.Cause(err).(*StatusError); !ok && isServerError(err) {
+			s.logger.Error("Request failed", err, log.FldMethod, r.Method, log.FldPath, r.URL.Path)
+		}
+		writeError(w, err)
+	})
+}
+
+// -- Middleware -------------------------------------------------------------------------------------------------------
+
+// statusRecorder is a response writer that remembers the status code sent to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack implements http.Hijacker - needed for WebSocket connections
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking is not supported by the response writer")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// logRequests logs every request handled by the server
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		s.logger.Debug(
+			"Handled request",
+			log.FldMethod, r.Method,
+			log.FldPath, r.URL.Path,
+			log.FldStatus, rec.status,
+			log.FldDuration, time.Since(start),
+			log.FldRemote, s.clientIP(r),
+		)
+	})
+}
+
+// recoverPanics makes sure that a panicking handler does not take down the whole application
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				s.logger.Error("Recovered from panic in HTTP handler", errors.Errorf("%v", rec), log.FldPath, r.URL.Path)
+				writeError(w, errors.New("Internal server error"))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
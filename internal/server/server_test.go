@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/repo"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func createTestLogger() log.Logger {
+	return log.New(kitlog.NewNopLogger(), log.LvlDebug)
+}
+
+func decodeError(rec *httptest.ResponseRecorder) ErrorResponse {
+	var resp ErrorResponse
+	So(json.NewDecoder(rec.Body).Decode(&resp), ShouldBeNil)
+	return resp
+}
+
+func TestWriteError(t *testing.T) {
+	Convey("Writing errors to the client", t, func() {
+		rec := httptest.NewRecorder()
+
+		Convey("ErrNotExisting should be reported as 404", func() {
+			writeError(rec, errors.Wrap(repo.ErrNotExisting, "Failed to load"))
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			So(rec.Header().Get("Content-Type"), ShouldStartWith, "application/json")
+			resp := decodeError(rec)
+			So(resp.Status, ShouldEqual, http.StatusNotFound)
+			So(resp.Error, ShouldEqual, repo.ErrNotExisting.Error())
+		})
+
+		Convey("ErrDuplicate should be reported as 409", func() {
+			writeError(rec, repo.ErrDuplicate)
+			So(rec.Code, ShouldEqual, http.StatusConflict)
+			So(decodeError(rec).Status, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Status errors should be reported with their own status code", func() {
+			writeError(rec, NewStatusError(http.StatusBadRequest, "Nope"))
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(rec).Error, ShouldEqual, "Nope")
+		})
+
+		Convey("Other errors should be reported as 500 without leaking details", func() {
+			writeError(rec, errors.New("secret internals"))
+			So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+			So(decodeError(rec).Error, ShouldNotContainSubstring, "secret")
+		})
+	})
+}
+
+func TestServer(t *testing.T) {
+	Convey("Having a running server", t, func() {
+		s := New("127.0.0.1:0", Dependencies{}, createTestLogger())
+		s.APIRouter().Handle("/panic", s.handle(func(w http.ResponseWriter, r *http.Request) error {
+			panic("Don't panic")
+		}))
+		So(s.Start(), ShouldBeNil)
+		baseURL := "http://" + s.Addr()
+
+		Convey("The health endpoint should respond", func() {
+			resp, err := http.Get(baseURL + "/api/health")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Unknown endpoints should yield a JSON 404 response", func() {
+			resp, err := http.Get(baseURL + "/api/unknown")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+			var body ErrorResponse
+			So(json.NewDecoder(resp.Body).Decode(&body), ShouldBeNil)
+			So(body.Status, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Shutting down the server twice should not fail", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			So(s.Shutdown(ctx), ShouldBeNil)
+		})
+
+		Convey("Panicking handlers should result in a 500 response", func() {
+			resp, err := http.Get(baseURL + "/api/panic")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
+		})
+
+		Reset(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			So(s.Shutdown(ctx), ShouldBeNil)
+		})
+	})
+}
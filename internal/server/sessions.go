@@ -0,0 +1,302 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultSessionLifetime is used if no session lifetime has been configured
+	defaultSessionLifetime = 30 * 24 * time.Hour
+	// sessionCleanupInterval defines how often expired sessions are removed from the database
+	sessionCleanupInterval = time.Hour
+)
+
+// ErrInvalidLogin is returned when a login attempt uses an unknown user name or a wrong password
+var ErrInvalidLogin = NewStatusError(http.StatusUnauthorized, "Invalid user name or password")
+
+// LoginRequest is the request body of POST /api/login
+type LoginRequest struct {
+	// The name of the user to log in
+	Username string `json:"username"`
+	// The user's password
+	Password string `json:"password"`
+}
+
+// SessionResponse is the JSON representation of a login session
+type SessionResponse struct {
+	// The ID of the session - used for revoking it
+	ID models.SessionID `json:"id"`
+	// Set if this is the session used for the current request
+	Current bool `json:"current"`
+	// The IP address the session has last been used from
+	IP string `json:"ip"`
+	// The user agent of the client that has last used the session
+	UserAgent string `json:"userAgent"`
+	// The time of the login
+	CreatedAt time.Time `json:"createdAt"`
+	// The time the session has last been used
+	LastSeen time.Time `json:"lastSeen"`
+	// The time the session expires unless it is used before
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SessionListResponse is the response of the session listing endpoints
+type SessionListResponse struct {
+	// The active sessions - the most recently used first
+	Sessions []SessionResponse `json:"sessions"`
+	// The number of sessions returned
+	Total int `json:"total"`
+}
+
+// newSessionResponse converts the session model into its JSON representation
+func newSessionResponse(sess *models.Session, current *models.Session) SessionResponse {
+	return SessionResponse{
+		ID:        sess.ID,
+		Current:   current != nil && current.ID == sess.ID,
+		IP:        sess.IP,
+		UserAgent: sess.UserAgent,
+		CreatedAt: sess.CreatedAt,
+		LastSeen:  sess.LastSeen,
+		ExpiresAt: sess.ExpiresAt,
+	}
+}
+
+// UpdateSessionConfig changes the session settings of the running server - they apply to sessions created or used
+// afterwards
+func (s *Server) UpdateSessionConfig(cfg models.SessionConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deps.SessionConfig = cfg
+}
+
+// sessionConfig returns the current session settings
+func (s *Server) sessionConfig() models.SessionConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deps.SessionConfig
+}
+
+// sessionLifetime returns the configured time a session stays valid after its last usage
+func (s *Server) sessionLifetime() time.Duration {
+	lifetime := s.sessionConfig().Lifetime
+	if lifetime <= 0 {
+		return defaultSessionLifetime
+	}
+	return time.Duration(lifetime) * time.Hour
+}
+
+// setSessionCookie sends the session cookie to the client - an empty token removes the cookie
+func (s *Server) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || s.sessionConfig().SecureCookie,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
+
+// registerLoginRoutes registers the login endpoint at the given public router
+func (s *Server) registerLoginRoutes(r *mux.Router) {
+	if s.deps.Sessions == nil {
+		return
+	}
+	r.Handle("/login", s.handle(s.login)).Methods(http.MethodPost)
+}
+
+// registerSessionRoutes registers the session management endpoints at the given router
+func (s *Server) registerSessionRoutes(r *mux.Router) {
+	if s.deps.Sessions == nil {
+		return
+	}
+	r.Handle("/logout", s.handle(s.logout)).Methods(http.MethodPost)
+	r.Handle("/sessions", s.requireCredentials(s.handle(s.listOwnSessions))).Methods(http.MethodGet)
+	r.Handle("/sessions/{session}", s.requireCredentials(s.handle(s.revokeOwnSession))).Methods(http.MethodDelete)
+
+	manage := func(h apiHandler) http.Handler {
+		return s.requireCredentials(s.requirePermission(models.PermUsersManage)(s.handle(h)))
+	}
+	r.Handle("/users/{id}/sessions", manage(s.listUserSessions)).Methods(http.MethodGet)
+	r.Handle("/users/{id}/sessions", manage(s.revokeUserSessions)).Methods(http.MethodDelete)
+	r.Handle("/users/{id}/sessions/{session}", manage(s.revokeUserSession)).Methods(http.MethodDelete)
+}
+
+// login checks the given credentials and starts a new session stored in a cookie
+func (s *Server) login(w http.ResponseWriter, r *http.Request) error {
+	var req LoginRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	user, err := s.deps.Users.GetByCredentials(req.Username, req.Password)
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			s.logger.Info("Login failed", log.FldUser, req.Username, log.FldRemote, s.clientIP(r))
+			return ErrInvalidLogin
+		}
+		return err
+	}
+	token, err := models.NewSessionToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sess := &models.Session{
+		UserID:    user.ID,
+		TokenHash: models.HashSessionToken(token),
+		IP:        s.clientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(s.sessionLifetime()),
+	}
+	if err := s.deps.Sessions.Create(sess); err != nil {
+		return err
+	}
+	s.logger.Info("User logged in", log.FldUser, user.Name, log.FldSession, sess.ID, log.FldRemote, s.clientIP(r))
+	s.setSessionCookie(w, r, token, sess.ExpiresAt)
+	return writeJSON(w, http.StatusCreated, newSessionResponse(sess, sess))
+}
+
+// logout ends the current session
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) error {
+	if sess := sessionFromContext(r.Context()); sess != nil {
+		if err := s.deps.Sessions.Delete(sess.ID); err != nil {
+			return err
+		}
+		s.logger.Info("User logged out", log.FldUser, userFromContext(r.Context()).Name, log.FldSession, sess.ID)
+	}
+	s.setSessionCookie(w, r, "", time.Time{})
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// writeSessions sends the active sessions of the given user to the client
+func (s *Server) writeSessions(w http.ResponseWriter, r *http.Request, userID models.UserID) error {
+	sessions, err := s.deps.Sessions.GetByUser(userID, time.Now())
+	if err != nil {
+		return err
+	}
+	current := sessionFromContext(r.Context())
+	res := SessionListResponse{Sessions: make([]SessionResponse, 0, len(sessions))}
+	for _, sess := range sessions {
+		res.Sessions = append(res.Sessions, newSessionResponse(sess, current))
+	}
+	res.Total = len(res.Sessions)
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// revokeSession ends a single session of the given user - sessions of other users are treated as non-existing
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request, userID models.UserID) error {
+	sess, err := s.deps.Sessions.GetByID(models.SessionID(mux.Vars(r)["session"]))
+	if err != nil {
+		return err
+	}
+	if sess.UserID != userID {
+		return repo.ErrNotExisting
+	}
+	if err := s.deps.Sessions.Delete(sess.ID); err != nil {
+		return err
+	}
+	s.logger.Info(
+		"Session revoked",
+		log.FldSession, sess.ID,
+		log.FldUser, userFromContext(r.Context()).Name,
+	)
+	if current := sessionFromContext(r.Context()); current != nil && current.ID == sess.ID {
+		s.setSessionCookie(w, r, "", time.Time{})
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// listOwnSessions returns the active sessions of the current user
+func (s *Server) listOwnSessions(w http.ResponseWriter, r *http.Request) error {
+	return s.writeSessions(w, r, userFromContext(r.Context()).ID)
+}
+
+// revokeOwnSession ends one of the current user's sessions
+func (s *Server) revokeOwnSession(w http.ResponseWriter, r *http.Request) error {
+	return s.revokeSession(w, r, userFromContext(r.Context()).ID)
+}
+
+// userFromPath returns the ID of the user addressed by the request path - if the user exists
+func (s *Server) userFromPath(r *http.Request) (models.UserID, error) {
+	id := models.UserID(mux.Vars(r)["id"])
+	exists, err := s.deps.Users.Exists(id)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", repo.ErrNotExisting
+	}
+	return id, nil
+}
+
+// listUserSessions returns the active sessions of any user
+func (s *Server) listUserSessions(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.writeSessions(w, r, id)
+}
+
+// revokeUserSession ends a single session of any user
+func (s *Server) revokeUserSession(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.revokeSession(w, r, id)
+}
+
+// revokeUserSessions ends all sessions of any user
+func (s *Server) revokeUserSessions(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	if err := s.deps.Sessions.DeleteByUser(id); err != nil {
+		return err
+	}
+	s.logger.Info(fmt.Sprintf("All sessions of user '%s' revoked", id), log.FldUser, userFromContext(r.Context()).Name)
+	if current := sessionFromContext(r.Context()); current != nil && current.UserID == id {
+		s.setSessionCookie(w, r, "", time.Time{})
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// cleanupSessions periodically removes expired sessions from the database until the server is shut down
+func (s *Server) cleanupSessions() {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+	for {
+		num, err := s.deps.Sessions.DeleteExpired(time.Now())
+		if err != nil {
+			s.logger.Error("Failed to delete expired sessions", err)
+		} else if num > 0 {
+			s.logger.Info(fmt.Sprintf("Deleted %d expired sessions", num))
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
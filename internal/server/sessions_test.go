@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeSessionRepo keeps the sessions in memory
+type fakeSessionRepo struct {
+	mu       sync.Mutex
+	sessions map[models.SessionID]models.Session
+}
+
+func newFakeSessionRepo() *fakeSessionRepo {
+	return &fakeSessionRepo{sessions: make(map[models.SessionID]models.Session)}
+}
+
+func (r *fakeSessionRepo) Create(s *models.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.ID = models.SessionID(uuid.NewV4().String())
+	r.sessions[s.ID] = *s
+	return nil
+}
+
+func (r *fakeSessionRepo) Touch(s *models.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[s.ID]; !ok {
+		return repo.ErrNotExisting
+	}
+	r.sessions[s.ID] = *s
+	return nil
+}
+
+func (r *fakeSessionRepo) Delete(id models.SessionID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+	return nil
+}
+
+func (r *fakeSessionRepo) DeleteByUser(userID models.UserID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, s := range r.sessions {
+		if s.UserID == userID {
+			delete(r.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (r *fakeSessionRepo) DeleteExpired(now time.Time) (uint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var num uint
+	for id, s := range r.sessions {
+		if s.Expired(now) {
+			delete(r.sessions, id)
+			num++
+		}
+	}
+	return num, nil
+}
+
+func (r *fakeSessionRepo) GetByID(id models.SessionID) (*models.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, repo.ErrNotExisting
+	}
+	return &s, nil
+}
+
+func (r *fakeSessionRepo) GetByTokenHash(hash string) (*models.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.TokenHash == hash {
+			return &s, nil
+		}
+	}
+	return nil, repo.ErrNotExisting
+}
+
+func (r *fakeSessionRepo) GetByUser(userID models.UserID, now time.Time) ([]*models.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []*models.Session{}
+	for _, s := range r.sessions {
+		if s.UserID == userID && !s.Expired(now) {
+			sess := s
+			res = append(res, &sess)
+		}
+	}
+	return res, nil
+}
+
+func TestSessions(t *testing.T) {
+	Convey("Having a server with a session store", t, func() {
+		sessions := newFakeSessionRepo()
+		roles := newFakeRoleRepo(models.PermDevicesView)
+		s := New("", Dependencies{
+			Users:         newFakeUserRepo(),
+			Roles:         roles,
+			Sessions:      sessions,
+			SessionConfig: models.SessionConfig{Lifetime: 1},
+			Devices:       newTestDevices(),
+		}, createTestLogger())
+
+		request := func(method, path string, body interface{}, cookie *http.Cookie) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			if body != nil {
+				json.NewEncoder(&buf).Encode(body)
+			}
+			req := httptest.NewRequest(method, path, &buf)
+			req.Header.Set("User-Agent", "Test/1.0")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+		login := func() *http.Cookie {
+			rec := request(http.MethodPost, "/api/login", LoginRequest{Username: testUser, Password: testPassword}, nil)
+			So(rec.Code, ShouldEqual, http.StatusCreated)
+			cookies := rec.Result().Cookies()
+			So(cookies, ShouldHaveLength, 1)
+			return cookies[0]
+		}
+
+		Convey("Logging in should issue a session cookie", func() {
+			cookie := login()
+			So(cookie.Name, ShouldEqual, sessionCookie)
+			So(cookie.HttpOnly, ShouldBeTrue)
+			So(cookie.Value, ShouldNotBeEmpty)
+			So(sessions.sessions, ShouldHaveLength, 1)
+			for _, sess := range sessions.sessions {
+				So(sess.TokenHash, ShouldEqual, models.HashSessionToken(cookie.Value))
+				So(sess.UserAgent, ShouldEqual, "Test/1.0")
+				So(sess.IP, ShouldEqual, "192.0.2.1")
+				So(sess.ExpiresAt.Sub(sess.CreatedAt), ShouldEqual, time.Hour)
+			}
+
+			rec := request(http.MethodGet, "/api/devices", nil, cookie)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Changed session settings should apply to new sessions", func() {
+			s.UpdateSessionConfig(models.SessionConfig{Lifetime: 2, SecureCookie: true})
+			cookie := login()
+			So(cookie.Secure, ShouldBeTrue)
+			for _, sess := range sessions.sessions {
+				So(sess.ExpiresAt.Sub(sess.CreatedAt), ShouldEqual, 2*time.Hour)
+			}
+		})
+
+		Convey("Logging in with invalid credentials should fail", func() {
+			rec := request(http.MethodPost, "/api/login", LoginRequest{Username: testUser, Password: "wrong"}, nil)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rec.Result().Cookies(), ShouldBeEmpty)
+			So(sessions.sessions, ShouldBeEmpty)
+		})
+
+		Convey("Unknown or expired sessions should be rejected", func() {
+			rec := request(http.MethodGet, "/api/devices", nil, &http.Cookie{Name: sessionCookie, Value: "dalek"})
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+
+			cookie := login()
+			for id, sess := range sessions.sessions {
+				sess.ExpiresAt = time.Now().Add(-time.Second)
+				sessions.sessions[id] = sess
+			}
+			rec = request(http.MethodGet, "/api/devices", nil, cookie)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			So(sessions.sessions, ShouldBeEmpty)
+		})
+
+		Convey("Users should be able to list and revoke their sessions", func() {
+			first := login()
+			second := login()
+			rec := request(http.MethodGet, "/api/sessions", nil, first)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var res SessionListResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			So(res.Total, ShouldEqual, 2)
+			var current, other SessionResponse
+			for _, sess := range res.Sessions {
+				if sess.Current {
+					current = sess
+				} else {
+					other = sess
+				}
+			}
+			So(current.ID, ShouldNotBeEmpty)
+			So(other.ID, ShouldNotBeEmpty)
+
+			rec = request(http.MethodDelete, "/api/sessions/"+string(other.ID), nil, first)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			rec = request(http.MethodGet, "/api/sessions", nil, second)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+
+			rec = request(http.MethodPost, "/api/logout", nil, first)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			So(rec.Result().Cookies()[0].MaxAge, ShouldBeLessThan, 0)
+			rec = request(http.MethodGet, "/api/sessions", nil, first)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Only user managers should be able to revoke the sessions of others", func() {
+			cookie := login()
+			rec := request(http.MethodDelete, "/api/users/user-1/sessions", nil, cookie)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+
+			roles.permissions = models.Permissions{models.PermUsersManage}
+			rec = request(http.MethodGet, "/api/users/user-1/sessions", nil, cookie)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			rec = request(http.MethodGet, "/api/users/unknown/sessions", nil, cookie)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			rec = request(http.MethodDelete, "/api/users/user-1/sessions", nil, cookie)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			So(sessions.sessions, ShouldBeEmpty)
+		})
+	})
+}
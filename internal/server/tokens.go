@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/gorilla/mux"
+)
+
+// TokenResponse is the JSON representation of a personal API token
+type TokenResponse struct {
+	// The ID of the token - used for revoking it
+	ID models.APITokenID `json:"id"`
+	// The name describing what the token is used for
+	Name string `json:"name"`
+	// The permissions the token is restricted to - empty if it has all permissions of its user
+	Scopes []models.Permission `json:"scopes"`
+	// The creation time of the token
+	CreatedAt time.Time `json:"createdAt"`
+	// The time after which the token is no longer valid - omitted if the token does not expire
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// The time the token has last been used - omitted if the token has never been used
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	// Set if the token has expired
+	Expired bool `json:"expired"`
+	// The token itself - only returned once when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+// TokenListResponse is the response of the token listing endpoints
+type TokenListResponse struct {
+	// The tokens ordered by name
+	Tokens []TokenResponse `json:"tokens"`
+	// The number of tokens returned
+	Total int `json:"total"`
+}
+
+// CreateTokenRequest is the request body of POST /api/tokens
+type CreateTokenRequest struct {
+	// A name describing what the token is used for - unique per user
+	Name string `json:"name"`
+	// The permissions to restrict the token to - e.g. ["devices.view", "devices.control:light_*"]
+	Scopes []models.Permission `json:"scopes,omitempty"`
+	// The time after which the token is no longer valid - the token does not expire if omitted
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// NewTokenResponse converts the token model into its JSON representation - the token itself is not included
+func NewTokenResponse(t *models.APIToken) TokenResponse {
+	res := TokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+		LastUsed:  t.LastUsed,
+		Expired:   t.Expired(time.Now()),
+	}
+	if res.Scopes == nil {
+		res.Scopes = []models.Permission{}
+	}
+	return res
+}
+
+// registerTokenRoutes registers the API token management endpoints at the given router
+func (s *Server) registerTokenRoutes(r *mux.Router) {
+	if s.deps.Tokens == nil {
+		return
+	}
+	own := func(h apiHandler) http.Handler {
+		return s.requireCredentials(s.handle(h))
+	}
+	r.Handle("/tokens", own(s.listOwnTokens)).Methods(http.MethodGet)
+	r.Handle("/tokens", own(s.createToken)).Methods(http.MethodPost)
+	r.Handle("/tokens/{token}", own(s.revokeOwnToken)).Methods(http.MethodDelete)
+
+	manage := func(h apiHandler) http.Handler {
+		return s.requireCredentials(s.requirePermission(models.PermUsersManage)(s.handle(h)))
+	}
+	r.Handle("/users/{id}/tokens", manage(s.listUserTokens)).Methods(http.MethodGet)
+	r.Handle("/users/{id}/tokens/{token}", manage(s.revokeUserToken)).Methods(http.MethodDelete)
+}
+
+// createToken creates a new API token for the current user
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) error {
+	var req CreateTokenRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return NewStatusError(http.StatusBadRequest, "The token needs a name")
+	}
+	now := time.Now()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		return NewStatusError(http.StatusBadRequest, "The expiry time must be in the future")
+	}
+	secret, err := models.NewAPIToken()
+	if err != nil {
+		return err
+	}
+	user := userFromContext(r.Context())
+	token := &models.APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		TokenHash: models.HashAPIToken(secret),
+		Scopes:    req.Scopes,
+		CreatedAt: now,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := s.deps.Tokens.Create(token); err != nil {
+		return err
+	}
+	s.logger.Info("API token created", log.FldUser, user.Name, log.FldToken, token.ID)
+	res := NewTokenResponse(token)
+	res.Token = secret
+	return writeJSON(w, http.StatusCreated, res)
+}
+
+// writeTokens sends the tokens of the given user to the client
+func (s *Server) writeTokens(w http.ResponseWriter, userID models.UserID) error {
+	tokens, err := s.deps.Tokens.GetByUser(userID)
+	if err != nil {
+		return err
+	}
+	res := TokenListResponse{Tokens: make([]TokenResponse, 0, len(tokens))}
+	for _, t := range tokens {
+		res.Tokens = append(res.Tokens, NewTokenResponse(t))
+	}
+	res.Total = len(res.Tokens)
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// revokeToken deletes a token of the given user - tokens of other users are treated as non-existing
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request, userID models.UserID) error {
+	token, err := s.deps.Tokens.GetByID(models.APITokenID(mux.Vars(r)["token"]))
+	if err != nil {
+		return err
+	}
+	if token.UserID != userID {
+		return repo.ErrNotExisting
+	}
+	if err := s.deps.Tokens.Delete(token.ID); err != nil {
+		return err
+	}
+	s.logger.Info("API token revoked", log.FldUser, userFromContext(r.Context()).Name, log.FldToken, token.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// listOwnTokens returns the tokens of the current user
+func (s *Server) listOwnTokens(w http.ResponseWriter, r *http.Request) error {
+	return s.writeTokens(w, userFromContext(r.Context()).ID)
+}
+
+// revokeOwnToken deletes one of the current user's tokens
+func (s *Server) revokeOwnToken(w http.ResponseWriter, r *http.Request) error {
+	return s.revokeToken(w, r, userFromContext(r.Context()).ID)
+}
+
+// listUserTokens returns the tokens of any user
+func (s *Server) listUserTokens(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.writeTokens(w, id)
+}
+
+// revokeUserToken deletes a token of any user
+func (s *Server) revokeUserToken(w http.ResponseWriter, r *http.Request) error {
+	id, err := s.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.revokeToken(w, r, id)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	uuid "github.com/satori/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeTokenRepo keeps the API tokens in memory
+type fakeTokenRepo struct {
+	mu     sync.Mutex
+	tokens map[models.APITokenID]models.APIToken
+}
+
+func newFakeTokenRepo() *fakeTokenRepo {
+	return &fakeTokenRepo{tokens: make(map[models.APITokenID]models.APIToken)}
+}
+
+func (r *fakeTokenRepo) Create(t *models.APIToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range t.Scopes {
+		if !s.IsValid() {
+			return repo.ErrInvalidPermission
+		}
+	}
+	t.ID = models.APITokenID(uuid.NewV4().String())
+	r.tokens[t.ID] = *t
+	return nil
+}
+
+func (r *fakeTokenRepo) Touch(id models.APITokenID, lastUsed time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[id]
+	if !ok {
+		return repo.ErrNotExisting
+	}
+	t.LastUsed = &lastUsed
+	r.tokens[id] = t
+	return nil
+}
+
+func (r *fakeTokenRepo) Delete(id models.APITokenID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tokens, id)
+	return nil
+}
+
+func (r *fakeTokenRepo) GetByID(id models.APITokenID) (*models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[id]
+	if !ok {
+		return nil, repo.ErrNotExisting
+	}
+	return &t, nil
+}
+
+func (r *fakeTokenRepo) GetByTokenHash(hash string) (*models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.tokens {
+		if t.TokenHash == hash {
+			return &t, nil
+		}
+	}
+	return nil, repo.ErrNotExisting
+}
+
+func (r *fakeTokenRepo) GetByUser(userID models.UserID) ([]*models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []*models.APIToken{}
+	for _, t := range r.tokens {
+		if t.UserID == userID {
+			token := t
+			res = append(res, &token)
+		}
+	}
+	return res, nil
+}
+
+func TestTokens(t *testing.T) {
+	Convey("Having a server with a token store", t, func() {
+		tokens := newFakeTokenRepo()
+		commander := &fakeCommander{}
+		s := New("", Dependencies{
+			Users:     newFakeUserRepo(),
+			Roles:     newFakeRoleRepo(),
+			Tokens:    tokens,
+			Devices:   newTestDevices(),
+			Commander: commander,
+		}, createTestLogger())
+
+		request := func(method, path string, body interface{}, bearer string) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			if body != nil {
+				json.NewEncoder(&buf).Encode(body)
+			}
+			req := httptest.NewRequest(method, path, &buf)
+			if bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+bearer)
+			} else {
+				req.SetBasicAuth(testUser, testPassword)
+			}
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+		create := func(req CreateTokenRequest) TokenResponse {
+			rec := request(http.MethodPost, "/api/tokens", req, "")
+			So(rec.Code, ShouldEqual, http.StatusCreated)
+			var res TokenResponse
+			So(json.NewDecoder(rec.Body).Decode(&res), ShouldBeNil)
+			return res
+		}
+
+		Convey("Created tokens should be shown only once and stored as hash", func() {
+			res := create(CreateTokenRequest{Name: "Wall panel"})
+			So(res.Token, ShouldStartWith, "micasa_")
+			stored, err := tokens.GetByID(res.ID)
+			So(err, ShouldBeNil)
+			So(stored.TokenHash, ShouldEqual, models.HashAPIToken(res.Token))
+
+			rec := request(http.MethodGet, "/api/tokens", nil, "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var list TokenListResponse
+			So(json.NewDecoder(rec.Body).Decode(&list), ShouldBeNil)
+			So(list.Total, ShouldEqual, 1)
+			So(list.Tokens[0].Name, ShouldEqual, "Wall panel")
+			So(list.Tokens[0].Token, ShouldBeEmpty)
+		})
+
+		Convey("Invalid token requests should be rejected", func() {
+			rec := request(http.MethodPost, "/api/tokens", CreateTokenRequest{}, "")
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			past := time.Now().Add(-time.Hour)
+			rec = request(http.MethodPost, "/api/tokens", CreateTokenRequest{Name: "Old", ExpiresAt: &past}, "")
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			rec = request(http.MethodPost, "/api/tokens", CreateTokenRequest{Name: "Bad", Scopes: []models.Permission{"lights.explode"}}, "")
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(tokens.tokens, ShouldBeEmpty)
+		})
+
+		Convey("Tokens should be accepted as bearer tokens and track their usage", func() {
+			res := create(CreateTokenRequest{Name: "Script"})
+			rec := request(http.MethodGet, "/api/devices", nil, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			stored, err := tokens.GetByID(res.ID)
+			So(err, ShouldBeNil)
+			So(stored.LastUsed, ShouldNotBeNil)
+
+			rec = request(http.MethodGet, "/api/devices", nil, "micasa_unknown")
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Scoped tokens should be restricted to their scopes", func() {
+			res := create(CreateTokenRequest{Name: "Kids", Scopes: []models.Permission{"devices.view", "devices.control:lamp"}})
+			rec := request(http.MethodPost, "/api/devices/lamp/set", SetRequest{Command: "off"}, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			rec = request(http.MethodPost, "/api/devices/heater/set", SetRequest{Command: "desired-temp", Args: []string{"30"}}, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+			So(commander.commands, ShouldResemble, []string{"lamp off"})
+		})
+
+		Convey("Tokens should not be able to manage tokens", func() {
+			res := create(CreateTokenRequest{Name: "Script"})
+			rec := request(http.MethodPost, "/api/tokens", CreateTokenRequest{Name: "Escalated"}, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+			rec = request(http.MethodGet, "/api/tokens", nil, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Expired and revoked tokens should be rejected", func() {
+			res := create(CreateTokenRequest{Name: "Script"})
+			stored := tokens.tokens[res.ID]
+			past := time.Now().Add(-time.Second)
+			stored.ExpiresAt = &past
+			tokens.tokens[res.ID] = stored
+			rec := request(http.MethodGet, "/api/devices", nil, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+
+			res = create(CreateTokenRequest{Name: "Panel"})
+			rec = request(http.MethodDelete, "/api/tokens/"+string(res.ID), nil, "")
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			rec = request(http.MethodGet, "/api/devices", nil, res.Token)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("User managers should be able to revoke the tokens of others", func() {
+			res := create(CreateTokenRequest{Name: "Script"})
+			rec := request(http.MethodGet, "/api/users/user-1/tokens", nil, "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			rec = request(http.MethodDelete, "/api/users/unknown/tokens/"+string(res.ID), nil, "")
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			rec = request(http.MethodDelete, "/api/users/user-1/tokens/"+string(res.ID), nil, "")
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+			So(tokens.tokens, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// Time allowed to write a message to the client
+	wsWriteWait = 10 * time.Second
+	// Time allowed to read the next pong message from the client
+	wsPongWait = 60 * time.Second
+	// Send pings to the client with this period - must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// Maximum size of a message sent by the client
+	wsMaxMessageSize = 4096
+	// Number of events buffered for each connection before events are dropped
+	wsBufferSize = 256
+
+	// WSTypeSubscribe is the type of the message a client sends to define what it wants to receive
+	WSTypeSubscribe = "subscribe"
+	// WSTypeSubscribed confirms a subscription
+	WSTypeSubscribed = "subscribed"
+	// WSTypeEvent is the type of the messages carrying a reading change
+	WSTypeEvent = "event"
+	// WSTypeOverflow tells the client that events have been dropped because it did not keep up - the client should
+	// reload the device states using the REST API
+	WSTypeOverflow = "overflow"
+	// WSTypeError reports an invalid message sent by the client
+	WSTypeError = "error"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// WSSubscription is the message a client sends to select the events it wants to receive. Devices and rooms are
+// combined - an event is delivered if its device is listed or is located in one of the rooms. If neither devices nor
+// rooms are given, events of all devices are delivered. Reading patterns further restrict the events to the readings
+// matching one of the patterns. Device names and reading patterns may contain the wildcards `*` and `?`.
+type WSSubscription struct {
+	Type     string   `json:"type"`
+	Devices  []string `json:"devices,omitempty"`
+	Rooms    []string `json:"rooms,omitempty"`
+	Readings []string `json:"readings,omitempty"`
+}
+
+// WSMessage is a message sent from the server to the client
+type WSMessage struct {
+	Type string `json:"type"`
+	// The reading change - for messages of type "event"
+	Event *events.Event `json:"event,omitempty"`
+	// The number of events dropped - for messages of type "overflow"
+	Dropped uint64 `json:"dropped,omitempty"`
+	// The active subscription - for messages of type "subscribed"
+	Subscription *WSSubscription `json:"subscription,omitempty"`
+	// The error message - for messages of type "error"
+	Error string `json:"error,omitempty"`
+}
+
+// wsConn is a single WebSocket client connection
+type wsConn struct {
+	s      *Server
+	conn   *websocket.Conn
+	sub    *events.Subscription
+	logger log.Logger
+	// The permissions of the connected user - only events of viewable devices are sent
+	permissions models.PermissionChecker
+
+	mu sync.Mutex
+	// The client's subscription - nothing is sent before the client has subscribed
+	filter *WSSubscription
+	// Control messages to send to the client
+	out chan WSMessage
+}
+
+// registerWebSocketRoutes registers the WebSocket endpoint at the given router
+func (s *Server) registerWebSocketRoutes(r *mux.Router) {
+	view := s.requirePermission(models.PermDevicesView)
+	r.Handle("/ws", view(s.handle(s.serveWebSocket))).Methods(http.MethodGet)
+}
+
+// serveWebSocket upgrades the connection to a WebSocket connection pushing reading changes to the client
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) error {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already sent an error response
+		return nil
+	}
+	// The connection ID tells apart the log entries of several connections using the same login session or token
+	keyvals := []interface{}{
+		log.FldConnection, uuid.NewV4().String(),
+		log.FldUser, userFromContext(r.Context()).Name,
+		log.FldRemote, s.clientIP(r),
+	}
+	if sess := sessionFromContext(r.Context()); sess != nil {
+		keyvals = append(keyvals, log.FldSession, sess.ID)
+	} else if token := tokenFromContext(r.Context()); token != nil {
+		keyvals = append(keyvals, log.FldToken, token.ID)
+	}
+	c := &wsConn{
+		s:           s,
+		conn:        conn,
+		permissions: permissionsFromContext(r.Context()),
+		logger:      s.logger.With(keyvals...),
+		out:         make(chan WSMessage, 16),
+	}
+	// The client's subscription is checked by the bus, so only events the client would have received count as
+	// dropped. Rooms are resolved using the device repository.
+	c.sub = s.deps.Bus.Subscribe(events.Filter{Func: c.matches}, wsBufferSize)
+	c.logger.Info("WebSocket client connected")
+	go c.writeLoop()
+	c.readLoop()
+	return nil
+}
+
+// readLoop processes the messages sent by the client until the connection is closed
+func (c *wsConn) readLoop() {
+	defer func() {
+		c.sub.Unsubscribe()
+		c.conn.Close()
+		c.logger.Info("WebSocket client disconnected")
+	}()
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var msg WSSubscription
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if isJSONError(err) {
+				c.send(WSMessage{Type: WSTypeError, Error: "Malformed message"})
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Debug("Failed to read from WebSocket", log.FldError, err)
+			}
+			return
+		}
+		if msg.Type != WSTypeSubscribe {
+			c.send(WSMessage{Type: WSTypeError, Error: "Unknown message type"})
+			continue
+		}
+		c.mu.Lock()
+		c.filter = &msg
+		c.mu.Unlock()
+		c.logger.Debug("WebSocket subscription changed")
+		c.send(WSMessage{Type: WSTypeSubscribed, Subscription: &msg})
+	}
+}
+
+// isJSONError checks if the error has been caused by a malformed JSON message
+func isJSONError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return false
+}
+
+// send queues a control message - the message is dropped if the client does not keep up
+func (c *wsConn) send(msg WSMessage) {
+	select {
+	case c.out <- msg:
+	default:
+	}
+}
+
+// writeLoop sends events, control messages and pings to the client. A client that does not accept messages within
+// the write timeout is disconnected.
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	var reported uint64
+	for {
+		var msg WSMessage
+		select {
+		case e, ok := <-c.sub.C:
+			if !ok {
+				c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if dropped := c.sub.Dropped(); dropped > reported {
+				// Tell the client about the gap before continuing with the current events
+				if err := c.write(WSMessage{Type: WSTypeOverflow, Dropped: dropped - reported}); err != nil {
+					return
+				}
+				reported = dropped
+			}
+			if !c.matches(e) {
+				continue
+			}
+			msg = WSMessage{Type: WSTypeEvent, Event: &e}
+		case msg = <-c.out:
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		}
+		if err := c.write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (c *wsConn) write(msg WSMessage) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.logger.Debug("Failed to write to WebSocket", log.FldError, err)
+		return err
+	}
+	return nil
+}
+
+// matches checks if the event matches the client's subscription
+func (c *wsConn) matches(e events.Event) bool {
+	c.mu.Lock()
+	f := c.filter
+	c.mu.Unlock()
+	if f == nil || !c.permissions.Allows(models.PermDevicesView, e.Device) {
+		return false
+	}
+	if !(events.Filter{Readings: f.Readings}).Matches(e) {
+		return false
+	}
+	if len(f.Devices) == 0 && len(f.Rooms) == 0 {
+		return true
+	}
+	if len(f.Devices) > 0 && (events.Filter{Devices: f.Devices}).Matches(e) {
+		return true
+	}
+	if len(f.Rooms) > 0 {
+		dev, err := c.s.deps.Devices.GetByName(e.Device)
+		if err != nil {
+			return false
+		}
+		for _, room := range f.Rooms {
+			if dev.InRoom(room) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derWhity/micasa/internal/events"
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func readWSMessage(conn *websocket.Conn) WSMessage {
+	var msg WSMessage
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	So(conn.ReadJSON(&msg), ShouldBeNil)
+	return msg
+}
+
+func TestWebSocket(t *testing.T) {
+	Convey("Having a server with an event bus", t, func() {
+		bus := events.NewBus(createTestLogger())
+		logs := log.NewBuffer(100)
+		sessions := newFakeSessionRepo()
+		s := New("", Dependencies{
+			Users:         newFakeUserRepo(),
+			Roles:         newFakeRoleRepo(),
+			Sessions:      sessions,
+			SessionConfig: models.SessionConfig{Lifetime: 1},
+			Devices:       newTestDevices(),
+			Bus:           bus,
+		}, log.New(logs, log.LvlDebug))
+		ts := httptest.NewServer(s.Router())
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws"
+		header := http.Header{}
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(testUser+":"+testPassword)))
+
+		Convey("Unauthenticated clients should be rejected", func() {
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			So(err, ShouldNotBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Clients should be logged with their login session and the ID of the connection", func() {
+			connected := func(header http.Header) log.Entry {
+				conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				// The client is logged as connected before its messages are processed
+				So(conn.WriteJSON(WSSubscription{Type: WSTypeSubscribe}), ShouldBeNil)
+				So(readWSMessage(conn).Type, ShouldEqual, WSTypeSubscribed)
+				entries := logs.Entries(log.EntryFilter{}, 0)
+				for i := len(entries) - 1; i >= 0; i-- {
+					if entries[i].Message == "WebSocket client connected" {
+						return entries[i]
+					}
+				}
+				So("no entry", ShouldBeEmpty)
+				return log.Entry{}
+			}
+
+			body := strings.NewReader(`{"username": "` + testUser + `", "password": "` + testPassword + `"}`)
+			resp, err := http.Post(ts.URL+"/api/login", "application/json", body)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.Cookies(), ShouldHaveLength, 1)
+			cookie := http.Header{}
+			cookie.Set("Cookie", resp.Cookies()[0].String())
+			entry := connected(cookie)
+			So(entry.User, ShouldEqual, testUser)
+			So(sessions.sessions, ShouldHaveLength, 1)
+			for id := range sessions.sessions {
+				So(entry.Fields[log.FldSession], ShouldEqual, string(id))
+			}
+			So(entry.Fields[log.FldConnection], ShouldNotBeEmpty)
+
+			entry2 := connected(header)
+			So(entry2.Fields, ShouldNotContainKey, log.FldSession)
+			So(entry2.Fields[log.FldConnection], ShouldNotBeEmpty)
+			So(entry2.Fields[log.FldConnection], ShouldNotEqual, entry.Fields[log.FldConnection])
+		})
+
+		Convey("Having a connected client", func() {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+			So(err, ShouldBeNil)
+
+			subscribe := func(sub WSSubscription) {
+				sub.Type = WSTypeSubscribe
+				So(conn.WriteJSON(sub), ShouldBeNil)
+				So(readWSMessage(conn).Type, ShouldEqual, WSTypeSubscribed)
+			}
+
+			Convey("The client should receive the events of subscribed devices", func() {
+				subscribe(WSSubscription{Devices: []string{"lamp"}})
+				bus.Publish(events.Event{Device: "heater", Reading: "state", Value: "on"})
+				bus.Publish(events.Event{Device: "lamp", Reading: "state", Value: "off"})
+				msg := readWSMessage(conn)
+				So(msg.Type, ShouldEqual, WSTypeEvent)
+				So(msg.Event.Device, ShouldEqual, "lamp")
+				So(msg.Event.Value, ShouldEqual, "off")
+			})
+
+			Convey("The client should receive the events of subscribed rooms and readings", func() {
+				subscribe(WSSubscription{Rooms: []string{"bath"}, Readings: []string{"*-temp"}})
+				bus.Publish(events.Event{Device: "heater", Reading: "state", Value: "on"})
+				bus.Publish(events.Event{Device: "lamp", Reading: "measured-temp", Value: "20"})
+				bus.Publish(events.Event{Device: "heater", Reading: "measured-temp", Value: "21"})
+				msg := readWSMessage(conn)
+				So(msg.Event.Device, ShouldEqual, "heater")
+				So(msg.Event.Value, ShouldEqual, "21")
+			})
+
+			Convey("Events of other devices should not be reported as dropped", func() {
+				subscribe(WSSubscription{Devices: []string{"lamp"}})
+				for i := 0; i < 10*wsBufferSize; i++ {
+					bus.Publish(events.Event{Device: "heater", Reading: "state", Value: "on"})
+				}
+				bus.Publish(events.Event{Device: "lamp", Reading: "state", Value: "off"})
+				msg := readWSMessage(conn)
+				So(msg.Type, ShouldEqual, WSTypeEvent)
+				So(msg.Event.Device, ShouldEqual, "lamp")
+			})
+
+			Convey("Invalid messages should be answered with an error", func() {
+				So(conn.WriteMessage(websocket.TextMessage, []byte("{nope")), ShouldBeNil)
+				So(readWSMessage(conn).Type, ShouldEqual, WSTypeError)
+				So(conn.WriteJSON(WSSubscription{Type: "unsubscribe"}), ShouldBeNil)
+				So(readWSMessage(conn).Type, ShouldEqual, WSTypeError)
+			})
+
+			Reset(func() {
+				conn.Close()
+			})
+		})
+
+		Reset(func() {
+			bus.Close()
+			ts.Close()
+		})
+	})
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/derWhity/micasa/internal/log"
+	"github.com/derWhity/micasa/internal/models"
+	"github.com/derWhity/micasa/internal/repo"
+	"github.com/pkg/errors"
+)
+
+// Whitelist knows the clients which may access the API without logging in and the trusted reverse proxies
+type Whitelist interface {
+	// IsWhitelisted checks whether the client with the given IP address is on the whitelist
+	IsWhitelisted(ip net.IP) bool
+	// IsTrustedProxy checks whether the X-Forwarded-For header added by the given address is trusted
+	IsTrustedProxy(ip net.IP) bool
+}
+
+// UpdateWhitelistConfig changes the whitelist settings of the running server - the addresses themselves are looked
+// up using the Whitelist dependency
+func (s *Server) UpdateWhitelistConfig(cfg models.WhitelistConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deps.WhitelistConfig = cfg
+}
+
+// whitelistConfig returns the current whitelist settings
+func (s *Server) whitelistConfig() models.WhitelistConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deps.WhitelistConfig
+}
+
+// clientIP returns the IP address of the client sending the request. Requests forwarded by trusted reverse proxies
+// are attributed to the last address of the X-Forwarded-For header which does not belong to a trusted proxy.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if s.deps.Whitelist == nil || !s.deps.Whitelist.IsTrustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	// Every proxy appends the address it has received the request from - only the trusted ones can be believed
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !s.deps.Whitelist.IsTrustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// isWhitelisted checks whether the client sending the request is on the whitelist
+func (s *Server) isWhitelisted(r *http.Request) bool {
+	return s.deps.Whitelist != nil && s.deps.Whitelist.IsWhitelisted(net.ParseIP(s.clientIP(r)))
+}
+
+// restrictClients is a middleware that rejects all requests of clients which are not on the whitelist - if the
+// whitelist is restrictive
+func (s *Server) restrictClients(next http.Handler) http.Handler {
+	return s.handle(func(w http.ResponseWriter, r *http.Request) error {
+		if s.whitelistConfig().Restrict && !s.isWhitelisted(r) {
+			s.logger.Info("Rejected request of a client not on the whitelist", log.FldRemote, s.clientIP(r))
+			return NewStatusError(http.StatusForbidden, "Access denied for your address")
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// isCrossSite checks whether the request may have been sent by a web page of another site. Browsers send simple
+// requests - e.g. a form POST with a text/plain body - to any site without asking it first, so changes are only
+// accepted with a JSON body. The Origin header is sent by browsers for cross-site requests including WebSockets.
+func isCrossSite(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err != nil || mediaType != "application/json"
+}
+
+// authenticateWhitelisted identifies whitelisted clients sending no credentials as the user configured for them. It
+// returns ErrUnauthorized if the client is not on the whitelist or no user has been configured. As the browsers on
+// the whitelisted clients would act as that user for every web page they show, cross-site requests are rejected.
+func (s *Server) authenticateWhitelisted(r *http.Request) (*identity, error) {
+	name := s.whitelistConfig().User
+	if name == "" || !s.isWhitelisted(r) {
+		return nil, ErrUnauthorized
+	}
+	if isCrossSite(r) {
+		s.logger.Warn(
+			"Rejected a possibly cross-site request of a whitelisted client",
+			log.FldRemote, s.clientIP(r),
+			log.FldMethod, r.Method,
+			log.FldPath, r.URL.Path,
+		)
+		return nil, NewStatusError(
+			http.StatusForbidden,
+			"Requests of whitelisted clients must not come from other sites and must send changes as application/json",
+		)
+	}
+	user, err := s.deps.Users.GetByName(name)
+	if err != nil {
+		if errors.Cause(err) == repo.ErrNotExisting {
+			s.logger.Warn("The user configured for whitelisted clients does not exist", log.FldUser, name)
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	return &identity{user: user, whitelisted: true}, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/derWhity/micasa/internal/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeWhitelist whitelists 192.168.1.0/24 and trusts the proxy 10.0.0.1
+type fakeWhitelist struct{}
+
+func (fakeWhitelist) IsWhitelisted(ip net.IP) bool {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	return lan.Contains(ip)
+}
+
+func (fakeWhitelist) IsTrustedProxy(ip net.IP) bool {
+	return ip.Equal(net.ParseIP("10.0.0.1"))
+}
+
+func TestWhitelist(t *testing.T) {
+	Convey("Having a server with a whitelist", t, func() {
+		commander := &fakeCommander{}
+		s := New("", Dependencies{
+			Commander:       commander,
+			Users:           newFakeUserRepo(),
+			Roles:           newFakeRoleRepo(),
+			Devices:         newTestDevices(),
+			Sessions:        newFakeSessionRepo(),
+			Tokens:          newFakeTokenRepo(),
+			Whitelist:       fakeWhitelist{},
+			WhitelistConfig: models.WhitelistConfig{User: testUser},
+		}, createTestLogger())
+
+		request := func(path string, remote string, forwardedFor ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = remote + ":54321"
+			for _, f := range forwardedFor {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("whitelisted clients should not need to log in", func() {
+			So(request("/api/devices", "192.168.1.10").Code, ShouldEqual, http.StatusOK)
+			So(request("/api/devices", "192.168.2.10").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("whitelisted clients without credentials should not manage credentials", func() {
+			So(request("/api/tokens", "192.168.1.10").Code, ShouldEqual, http.StatusForbidden)
+			So(request("/api/sessions", "192.168.1.10").Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("whitelisted clients should be protected against requests of other sites", func() {
+			set := func(contentType string, origin string) int {
+				req := httptest.NewRequest(http.MethodPost, "/api/devices/lamp/set", strings.NewReader(`{"command": "off"}`))
+				req.RemoteAddr = "192.168.1.10:54321"
+				if contentType != "" {
+					req.Header.Set("Content-Type", contentType)
+				}
+				if origin != "" {
+					req.Header.Set("Origin", origin)
+				}
+				rec := httptest.NewRecorder()
+				s.Router().ServeHTTP(rec, req)
+				return rec.Code
+			}
+			So(set("text/plain", ""), ShouldEqual, http.StatusForbidden)
+			So(set("", ""), ShouldEqual, http.StatusForbidden)
+			So(set("application/json", "http://evil.example.com"), ShouldEqual, http.StatusForbidden)
+			So(commander.commands, ShouldBeEmpty)
+			So(set("application/json; charset=utf-8", ""), ShouldEqual, http.StatusNoContent)
+			So(set("application/json", "http://example.com"), ShouldEqual, http.StatusNoContent)
+			So(commander.commands, ShouldResemble, []string{"lamp off", "lamp off"})
+		})
+
+		Convey("whitelisted clients should need to log in if no user is configured", func() {
+			s.UpdateWhitelistConfig(models.WhitelistConfig{})
+			So(request("/api/devices", "192.168.1.10").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("a restrictive whitelist should reject all other clients", func() {
+			s.UpdateWhitelistConfig(models.WhitelistConfig{Restrict: true})
+			So(request("/api/health", "192.168.2.10").Code, ShouldEqual, http.StatusForbidden)
+			So(request("/api/health", "192.168.1.10").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("X-Forwarded-For should only be believed if set by trusted proxies", func() {
+			So(request("/api/devices", "10.0.0.1", "192.168.1.10").Code, ShouldEqual, http.StatusOK)
+			So(request("/api/devices", "10.0.0.1", "8.8.8.8, 192.168.1.10").Code, ShouldEqual, http.StatusOK)
+			So(request("/api/devices", "10.0.0.1", "192.168.1.10, 8.8.8.8").Code, ShouldEqual, http.StatusUnauthorized)
+			So(request("/api/devices", "10.0.0.1", "192.168.1.10", "10.0.0.1").Code, ShouldEqual, http.StatusOK)
+			So(request("/api/devices", "10.0.0.1", "garbage").Code, ShouldEqual, http.StatusUnauthorized)
+			So(request("/api/devices", "8.8.8.8", "192.168.1.10").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}